@@ -9,6 +9,7 @@ const (
 	SpanID       = ".id"
 	SpanParentID = ".parent_id"
 	SpanTraceID  = ".trace_id"
+	SpanIsRoot   = ".is_root"
 
 	SpanName      = ".name"
 	SpanEventName = ".event_name"
@@ -20,6 +21,12 @@ const (
 
 	SpanStatusCode    = ".status_code"
 	SpanStatusMessage = ".status_message"
+	SpanStatusClass   = ".status_class"
+
+	SpanSelfDuration = ".self_duration"
+	SpanTraceOffset  = ".trace_offset"
+
+	SpanHasErrorDescendant = ".has_error_descendant"
 
 	SpanCount       = ".count"
 	SpanCountPerMin = ".count_per_min"
@@ -32,6 +39,10 @@ const (
 	SpanEventErrorCount = ".event_error_count"
 	SpanEventLogCount   = ".event_log_count"
 
+	// TraceSampled is whether the trace was sampled, derived from SamplingPriority.
+	TraceSampled     = "trace.sampled"
+	SamplingPriority = "sampling.priority"
+
 	ServiceName    = "service.name"
 	ServiceVersion = "service.version"
 	PeerService    = "peer.service"
@@ -96,6 +107,7 @@ const (
 	NetHostName          = "net.host.name"
 
 	LogMessage        = "log.message"
+	LogBody           = "log.body"
 	LogSeverity       = "log.severity"
 	LogSeverityNumber = "log.severity_number"
 	LogSource         = "log.source"
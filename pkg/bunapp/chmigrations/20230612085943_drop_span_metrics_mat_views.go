@@ -15,7 +15,7 @@ func init() {
 		conf := app.Config()
 		for i := range conf.MetricsFromSpans {
 			metric := &conf.MetricsFromSpans[i]
-			viewName := metric.ViewName()
+			viewName := conf.LegacySpanMetricViewName(metric.Name)
 			if _, err := db.ExecContext(ctx, "DROP VIEW IF EXISTS ?", ch.Ident(viewName)); err != nil {
 				return err
 			}
@@ -0,0 +1,27 @@
+package chmigrations
+
+import (
+	"context"
+
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/go-clickhouse/chmigrate"
+	"github.com/uptrace/uptrace/pkg/bunapp"
+)
+
+// Distributed tables copy the columns of the local tables when they are created,
+// so they are recreated to pick up the tdigest column.
+func init() {
+	recreateDist := func(ctx context.Context, db *ch.DB) error {
+		app := bunapp.AppFromContext(ctx)
+		if app.Config().CHSchema.Cluster == "" {
+			return nil
+		}
+
+		f, err := bunapp.FS().Open("sql/ch_recreate_distributed.up.sql")
+		if err != nil {
+			return err
+		}
+		return chmigrate.Exec(ctx, db, f)
+	}
+	Migrations.MustRegister(recreateDist, recreateDist)
+}
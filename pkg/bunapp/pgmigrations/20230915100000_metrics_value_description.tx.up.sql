@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN value_description varchar(1000);
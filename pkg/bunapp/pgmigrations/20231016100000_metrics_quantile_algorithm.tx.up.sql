@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN quantile_algorithm varchar(100);
@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN view_name varchar(500);
@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN service varchar(500);
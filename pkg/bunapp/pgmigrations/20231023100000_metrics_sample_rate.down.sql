@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+DROP COLUMN IF EXISTS sample_rate;
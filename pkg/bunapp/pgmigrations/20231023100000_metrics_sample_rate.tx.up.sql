@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN sample_rate double precision;
@@ -0,0 +1,2 @@
+ALTER TABLE metrics
+ADD COLUMN bucket_bounds double precision[];
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/uptrace/uptrace/pkg/attrkey"
 	"github.com/wneessen/go-mail"
 	"gopkg.in/yaml.v3"
@@ -39,6 +40,10 @@ func ReadConfig(confPath, service string) (*Config, error) {
 	conf.Path = confPath
 	conf.Service = service
 
+	if err := includeSpanMetrics(conf, filepath.Dir(confPath)); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", conf.Path, err)
+	}
+
 	fixUpConfig(conf)
 	if err := validateConfig(conf); err != nil {
 		return nil, fmt.Errorf("invalid config %s: %w", conf.Path, err)
@@ -120,17 +125,79 @@ func expandEnv(conf string) string {
 	})
 }
 
-func fixUpConfig(conf *Config) {
+// includeSpanMetrics appends the span metrics from the files matched by
+// MetricsFromSpansInclude. Included metrics must have unique names.
+func includeSpanMetrics(conf *Config, dir string) error {
+	if len(conf.MetricsFromSpansInclude) == 0 {
+		return nil
+	}
+
+	sources := make(map[string]string, len(conf.MetricsFromSpans))
 	for i := range conf.MetricsFromSpans {
-		metric := &conf.MetricsFromSpans[i]
-		metric.Value = cleanAttrName(metric.Value)
-		for i, attr := range metric.Attrs {
-			metric.Attrs[i] = cleanAttrName(attr)
+		sources[conf.MetricsFromSpans[i].Name] = conf.Path
+	}
+
+	for _, pattern := range conf.MetricsFromSpansInclude {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid metrics_from_spans_include %q: %w", pattern, err)
 		}
-		for i, attr := range metric.Annotations {
-			metric.Annotations[i] = cleanAttrName(attr)
+
+		for _, path := range paths {
+			metrics, err := readSpanMetrics(path)
+			if err != nil {
+				return err
+			}
+			for _, metric := range metrics {
+				if source, ok := sources[metric.Name]; ok {
+					return fmt.Errorf("span metric %q is defined in %s and %s",
+						metric.Name, source, path)
+				}
+				sources[metric.Name] = path
+				conf.MetricsFromSpans = append(conf.MetricsFromSpans, metric)
+			}
 		}
-		metric.Where = cleanAttrName(metric.Where)
+	}
+	return nil
+}
+
+func readSpanMetrics(path string) ([]SpanMetric, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		MetricsFromSpans []SpanMetric `yaml:"metrics_from_spans"`
+	}
+	if err := yaml.Unmarshal([]byte(expandEnv(string(b))), &file); err != nil {
+		return nil, fmt.Errorf("invalid span metrics file %s: %w", path, err)
+	}
+	return file.MetricsFromSpans, nil
+}
+
+func fixUpConfig(conf *Config) {
+	for i := range conf.MetricsFromSpans {
+		fixUpSpanMetric(&conf.MetricsFromSpans[i])
+	}
+	for i := range conf.MetricsFromLogs {
+		fixUpSpanMetric(&conf.MetricsFromLogs[i])
+	}
+}
+
+func fixUpSpanMetric(metric *SpanMetric) {
+	metric.Value = cleanAttrName(metric.Value)
+	for i, attr := range metric.Attrs {
+		metric.Attrs[i] = cleanAttrName(attr)
+	}
+	for i, attr := range metric.Annotations {
+		metric.Annotations[i] = cleanAttrName(attr)
+	}
+	for i, cond := range metric.Where {
+		metric.Where[i] = cleanAttrName(cond)
 	}
 }
 
@@ -152,6 +219,9 @@ func validateConfig(conf *Config) error {
 	if err := validateProjects(conf.Projects); err != nil {
 		return err
 	}
+	if err := validateViewNameTemplate(conf.ViewNameTemplate); err != nil {
+		return err
+	}
 
 	if err := conf.Listen.GRPC.init(); err != nil {
 		return fmt.Errorf("invalid listen.grpc option: %w", err)
@@ -253,6 +323,45 @@ type Config struct {
 	} `yaml:"auth" json:"auth"`
 
 	MetricsFromSpans []SpanMetric `yaml:"metrics_from_spans"`
+	// MetricsFromSpansInclude is a list of globs relative to the config file.
+	// The metrics_from_spans of the matched files are appended to MetricsFromSpans.
+	MetricsFromSpansInclude []string `yaml:"metrics_from_spans_include"`
+	// MetricsFromLogs are created the same way as MetricsFromSpans from the stored logs.
+	MetricsFromLogs []SpanMetric `yaml:"metrics_from_logs"`
+
+	// ViewNameTemplate is the name of span metric views where {name} is replaced
+	// with the metric name. Defaults to DefaultViewNameTemplate.
+	ViewNameTemplate string `yaml:"view_name_template"`
+
+	// AllowRawMetricExpr allows span metrics to use raw ClickHouse value expressions.
+	AllowRawMetricExpr bool `yaml:"allow_raw_metric_expr"`
+
+	// AllowSelfDuration allows span metrics to use span.self_duration,
+	// which joins every inserted block with the child spans.
+	AllowSelfDuration bool `yaml:"allow_self_duration"`
+
+	// AllowTraceOffset allows span metrics to use span.trace_offset,
+	// which joins every inserted block with the start time of the traces.
+	AllowTraceOffset bool `yaml:"allow_trace_offset"`
+
+	// AllowErrorDescendant allows span metrics to use span.has_error_descendant,
+	// which joins every inserted block with the spans of the traces that have errors.
+	AllowErrorDescendant bool `yaml:"allow_error_descendant"`
+
+	// MaxBackfill limits how far back span metrics are populated. Zero means no limit.
+	MaxBackfill time.Duration `yaml:"max_backfill"`
+
+	// SpanMetricStaleAfter flags span metrics whose latest bucket is older than this
+	// in the uptrace.span_metrics.staleness gauge. Zero disables the check.
+	SpanMetricStaleAfter time.Duration `yaml:"span_metric_stale_after"`
+
+	// MaxQueryLength limits the length of metric queries and span metric expressions
+	// in bytes. Zero means the default of 8KB and a negative value disables the limit.
+	MaxQueryLength int `yaml:"max_query_length"`
+
+	// Vars are the template variables that metric queries and span metric values
+	// can use as ${name}, e.g. to share metric definitions across environments.
+	Vars map[string]string `yaml:"vars"`
 
 	CHSchema struct {
 		Compression string `yaml:"compression"`
@@ -336,11 +445,245 @@ type SpanMetric struct {
 	Value       string   `yaml:"value"`
 	Attrs       []string `yaml:"attrs"`
 	Annotations []string `yaml:"annotations"`
-	Where       string   `yaml:"where"`
+	// Where is a list of conditions that are AND-ed. A single condition
+	// can be written as a string.
+	Where []string `yaml:"where"`
+	// Service limits the metric to the spans of the service. It is AND-ed with Where
+	// and stored in the metric metadata.
+	Service string `yaml:"service"`
+	// RootOnly limits the metric to root spans, so it counts requests rather than
+	// internal spans. It is AND-ed with Where and stored in the metric metadata.
+	RootOnly bool `yaml:"root_only"`
+
+	// ValueDescription is a human-readable explanation of the value expression.
+	ValueDescription string `yaml:"value_description"`
+
+	// Enabled controls whether the metric is written. Disabling a metric drops
+	// its materialized view but keeps the metadata and existing data. Defaults to true.
+	Enabled *bool `yaml:"enabled"`
+
+	// BucketUnit is the time bucket spans are aggregated into: minute (default) or hour.
+	BucketUnit string `yaml:"bucket_unit"`
+	// Timezone is an IANA time zone, e.g. America/New_York, used to round span time
+	// to buckets. Defaults to the ClickHouse server time zone.
+	Timezone string `yaml:"timezone"`
+
+	// OrderBy is not supported, because metrics are written to the shared measure_minutes
+	// table. It is decoded only to reject configs that set it.
+	OrderBy []string `yaml:"order_by"`
+
+	// ThresholdDict is a ClickHouse dictionary keyed by service name with a threshold
+	// attribute that where filters can reference as $threshold.
+	ThresholdDict string `yaml:"threshold_dict"`
+
+	// Deduplicate is not supported, because materialized views can't drop spans counted
+	// in earlier inserts. It is decoded only to reject configs that set it.
+	Deduplicate bool `yaml:"deduplicate"`
+
+	// SampleRate is the fraction of traces (0-1) used to compute the metric.
+	// Zero or one disables sampling.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// SourceTable is a table in the ClickHouse database with the columns of spans_index,
+	// e.g. a pre-sampled copy, that the metric reads instead of spans_index.
+	SourceTable string `yaml:"source_table"`
+	// SourceSampleRate is the fraction of spans (0-1) stored in SourceTable.
+	// Counts and sums are scaled up like with SampleRate.
+	SourceSampleRate float64 `yaml:"source_sample_rate"`
+
+	// Numerator is the where condition of the spans counted by a ratio metric.
+	Numerator string `yaml:"numerator"`
+	// Denominator is the where condition of the spans the numerator is divided by.
+	// When empty, the denominator is the number of all spans matched by the metric.
+	Denominator string `yaml:"denominator"`
+
+	// Weight is the expression each value is weighted by in a weighted_avg metric.
+	// By default, every span has the weight of 1.
+	Weight string `yaml:"weight"`
+
+	// ApdexThreshold is the target span duration T of an apdex metric. Spans faster
+	// than T are satisfied, and spans faster than 4T are tolerated.
+	ApdexThreshold time.Duration `yaml:"apdex_threshold"`
+
+	// Populate fills the metric with the spans stored before the view is created.
+	Populate bool `yaml:"populate"`
+	// Backfill limits populate to the spans stored during this period before
+	// the view is created. Zero means all stored spans.
+	Backfill time.Duration `yaml:"backfill"`
+
+	// SkipZero drops data points with a zero count or sum instead of storing them.
+	SkipZero bool `yaml:"skip_zero"`
+
+	// ZeroDuration is either skip or include. Skip ignores spans with zero duration,
+	// e.g. incomplete spans. Defaults to skip for histograms of span.duration.
+	ZeroDuration string `yaml:"zero_duration"`
+
+	// Total additionally stores the metric aggregated across all attrs
+	// with every attr set to __total__.
+	Total bool `yaml:"total"`
+
+	// RawValue is a ClickHouse expression set with `value: { raw: "..." }`.
+	// It is used as is instead of compiling the value.
+	RawValue string `yaml:"-"`
+
+	// QuantileAlgorithm is the algorithm of histogram percentiles:
+	// bfloat16 (default) or tdigest, which is more accurate and takes more space.
+	QuantileAlgorithm string `yaml:"quantile_algorithm"`
+	// HistogramBuckets makes a histogram store cumulative counts of the values less than
+	// or equal to each bound, like Prometheus histograms, instead of percentiles.
+	HistogramBuckets *HistogramBuckets `yaml:"histogram_buckets"`
+
+	// RelativeTo divides the span duration by the duration of another span in the trace.
+	// The only supported value is "root".
+	RelativeTo string `yaml:"relative_to"`
+}
+
+// HistogramBuckets are the upper bounds of fixed histogram buckets.
+// Exactly one of Bounds, Linear, and Exponential is set.
+type HistogramBuckets struct {
+	// Bounds are explicit bounds in ascending order.
+	Bounds []float64 `yaml:"bounds"`
+	// Linear bounds are start, start + width, start + 2*width, and so on.
+	Linear *LinearBuckets `yaml:"linear"`
+	// Exponential bounds are start, start * factor, start * factor^2, and so on.
+	Exponential *ExponentialBuckets `yaml:"exponential"`
+}
+
+type LinearBuckets struct {
+	Start float64 `yaml:"start"`
+	Width float64 `yaml:"width"`
+	Count int     `yaml:"count"`
+}
+
+type ExponentialBuckets struct {
+	Start  float64 `yaml:"start"`
+	Factor float64 `yaml:"factor"`
+	Count  int     `yaml:"count"`
+}
+
+// UnmarshalYAML accepts the value either as an expression or as a mapping
+// with a raw ClickHouse expression, for example, `value: { raw: "avg(duration)" }`,
+// and the where conditions either as a string or as a list.
+func (m *SpanMetric) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		copied := *node
+		copied.Content = make([]*yaml.Node, 0, len(node.Content))
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			switch {
+			case key.Value == "value" && value.Kind == yaml.MappingNode:
+				var raw struct {
+					Raw string `yaml:"raw"`
+				}
+				if err := value.Decode(&raw); err != nil {
+					return err
+				}
+				if raw.Raw == "" {
+					return fmt.Errorf("span metric value requires a raw expression")
+				}
+				m.RawValue = raw.Raw
+				continue
+			case key.Value == "where" && value.Kind == yaml.ScalarNode && value.Tag != "!!null":
+				if strings.TrimSpace(value.Value) == "" {
+					// An empty where matches all spans.
+					continue
+				}
+				value = &yaml.Node{
+					Kind:    yaml.SequenceNode,
+					Tag:     "!!seq",
+					Content: []*yaml.Node{value},
+				}
+			}
+
+			copied.Content = append(copied.Content, key, value)
+		}
+
+		node = &copied
+	}
+
+	type spanMetric SpanMetric
+	return node.Decode((*spanMetric)(m))
+}
+
+func (m *SpanMetric) IsEnabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// DefaultViewNameTemplate is the name of span metric views unless view_name_template is set.
+const DefaultViewNameTemplate = "metrics_{name}_mv"
+
+// SpanMetricViewName returns the name of the materialized view that writes the span metric.
+func (c *Config) SpanMetricViewName(name string) string {
+	return SpanMetricViewName(c.ViewNameTemplate, name)
+}
+
+// LegacySpanMetricViewName returns the name of the view created for the span metric
+// by older versions.
+func (c *Config) LegacySpanMetricViewName(name string) string {
+	return LegacySpanMetricViewName(c.ViewNameTemplate, name)
 }
 
-func (m *SpanMetric) ViewName() string {
-	return "metrics_" + strings.ReplaceAll(m.Name, ".", "_") + "_mv"
+// SpanMetricViewName replaces {name} in the template with the metric name.
+// An empty template is the DefaultViewNameTemplate.
+func SpanMetricViewName(template, name string) string {
+	if template == "" {
+		template = DefaultViewNameTemplate
+	}
+	return strings.ReplaceAll(template, "{name}", viewNamePart(name))
+}
+
+// LegacySpanMetricViewName returns the view name used before names with underscores
+// were suffixed with a hash.
+func LegacySpanMetricViewName(template, name string) string {
+	if template == "" {
+		template = DefaultViewNameTemplate
+	}
+	return strings.ReplaceAll(template, "{name}", strings.ReplaceAll(name, ".", "_"))
+}
+
+// viewNamePart replaces dots in the metric name with underscores. Names that already
+// contain underscores are suffixed with a hash of the name, so, for example,
+// http.server_duration and http_server.duration get different views.
+func viewNamePart(name string) string {
+	part := strings.ReplaceAll(name, ".", "_")
+	if !strings.Contains(name, "_") {
+		return part
+	}
+	return fmt.Sprintf("%s_%08x", part, uint32(xxhash.Sum64String(name)))
+}
+
+var viewNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateViewNameTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	if !strings.Contains(template, "{name}") {
+		return fmt.Errorf("view_name_template %q must contain {name}", template)
+	}
+	if name := SpanMetricViewName(template, "metric"); !viewNameRE.MatchString(name) {
+		return fmt.Errorf("view_name_template %q produces an invalid view name %q", template, name)
+	}
+	return nil
+}
+
+func (m *SpanMetric) IsSampled() bool {
+	return m.SampleRate > 0 && m.SampleRate < 1
+}
+
+// ScaleRate returns the fraction of spans the metric is computed from, combining
+// SampleRate and SourceSampleRate. It is 1 when the metric sees all spans.
+func (m *SpanMetric) ScaleRate() float64 {
+	rate := 1.0
+	if m.IsSampled() {
+		rate *= m.SampleRate
+	}
+	if m.SourceSampleRate > 0 && m.SourceSampleRate < 1 {
+		rate *= m.SourceSampleRate
+	}
+	return rate
 }
 
 type Listen struct {
@@ -0,0 +1,127 @@
+package bunconf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanMetricViewName(t *testing.T) {
+	type Test struct {
+		template string
+		wanted   string
+		valid    bool
+	}
+
+	tests := []Test{
+		{"", "metrics_uptrace_tracing_spans_mv", true},
+		{"um_{name}_mv", "um_uptrace_tracing_spans_mv", true},
+		{"{name}", "uptrace_tracing_spans", true},
+		{"um_mv", "um_mv", false},
+		{"um-{name}", "um-uptrace_tracing_spans", false},
+		{"1_{name}", "1_uptrace_tracing_spans", false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			conf := &Config{ViewNameTemplate: test.template}
+			require.Equal(t, test.wanted, conf.SpanMetricViewName("uptrace.tracing.spans"))
+
+			err := validateViewNameTemplate(test.template)
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestSpanMetricViewNameCollisions(t *testing.T) {
+	names := []string{
+		"http.server_duration",
+		"http_server.duration",
+		"http.server.duration",
+		"http_server_duration",
+	}
+
+	seen := make(map[string]string, len(names))
+	for _, name := range names {
+		viewName := SpanMetricViewName("", name)
+		require.Regexp(t, viewNameRE, viewName)
+		require.NotContains(t, seen, viewName, "%s and %s", name, seen[viewName])
+		seen[viewName] = name
+	}
+
+	require.Equal(t, "metrics_http_server_duration_mv",
+		SpanMetricViewName("", "http.server.duration"))
+	require.Regexp(t, `^metrics_http_server_duration_[0-9a-f]{8}_mv$`,
+		SpanMetricViewName("", "http_server_duration"))
+	require.Equal(t, "metrics_http_server_duration_mv",
+		LegacySpanMetricViewName("", "http_server_duration"))
+}
+
+func TestIncludeSpanMetrics(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	confPath := writeFile("uptrace.yml", `
+metrics_from_spans:
+  - name: main.requests
+    instrument: counter
+    value: count()
+metrics_from_spans_include:
+  - metrics.d/*.yaml
+`)
+	writeFile("metrics.d/a.yaml", `
+metrics_from_spans:
+  - name: team_a.requests
+    instrument: counter
+    value: count()
+    where: span.kind = 'server'
+`)
+	writeFile("metrics.d/b.yaml", `
+metrics_from_spans:
+  - name: team_b.duration
+    instrument: histogram
+    value: span.duration
+`)
+
+	conf, err := ReadConfig(confPath, "")
+	require.NoError(t, err)
+
+	var names []string
+	for _, metric := range conf.MetricsFromSpans {
+		names = append(names, metric.Name)
+	}
+	require.Equal(t, []string{"main.requests", "team_a.requests", "team_b.duration"}, names)
+	require.Equal(t, ".duration", conf.MetricsFromSpans[2].Value)
+	require.Equal(t, []string{".kind = 'server'"}, conf.MetricsFromSpans[1].Where)
+
+	dupPath := writeFile("metrics.d/c.yaml", `
+metrics_from_spans:
+  - name: team_a.requests
+    instrument: counter
+    value: count()
+`)
+	_, err = ReadConfig(confPath, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `span metric "team_a.requests" is defined in`)
+	require.Contains(t, err.Error(), dupPath)
+}
+
+func TestReadShippedConfigs(t *testing.T) {
+	for _, name := range []string{"uptrace.yml", "uptrace.dist.yml"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadConfig(filepath.Join("..", "..", "config", name), "")
+			require.NoError(t, err)
+		})
+	}
+}
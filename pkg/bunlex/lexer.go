@@ -87,6 +87,16 @@ func (l *Lexer) ReadSepFunc(start int, isSep func(byte) bool) (_ string, ok bool
 }
 
 func (l *Lexer) ReadUnquoted(quote byte) (string, error) {
+	return l.readUnquoted(quote, false)
+}
+
+// ReadUnquotedKeepEscapes is like ReadUnquoted, but keeps unknown escapes such as `\d`
+// as is instead of dropping them, so regular expressions survive unquoting.
+func (l *Lexer) ReadUnquotedKeepEscapes(quote byte) (string, error) {
+	return l.readUnquoted(quote, true)
+}
+
+func (l *Lexer) readUnquoted(quote byte, keepEscapes bool) (string, error) {
 	pos := l.Pos()
 	var buf []byte
 
@@ -119,6 +129,9 @@ loop:
 				continue loop
 			default:
 				l.i++
+				if keepEscapes {
+					buf = append(buf, '\\', next)
+				}
 				continue loop
 			}
 		case quote:
@@ -130,7 +143,7 @@ loop:
 
 	if quote == '`' {
 		l.SetPos(pos)
-		return l.ReadUnquoted('\'')
+		return l.readUnquoted('\'', keepEscapes)
 	}
 
 	return string(buf), syntaxError(l.s[pos:], "missing %q at the end of a string", quote)
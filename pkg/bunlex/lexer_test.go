@@ -0,0 +1,59 @@
+package bunlex
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadUnquoted(t *testing.T) {
+	type Test struct {
+		in          string
+		quote       byte
+		keepEscapes bool
+		out         string
+	}
+
+	tests := []Test{
+		{in: `foo'`, quote: '\'', out: `foo`},
+		{in: `a\\b'`, quote: '\'', out: `a\b`},
+		{in: `it\'s'`, quote: '\'', out: `it's`},
+		{in: `say \"hi\""`, quote: '"', out: `say "hi"`},
+		{in: `a\nb\rc\td'`, quote: '\'', out: "a\nb\rc\td"},
+		{in: `a\db'`, quote: '\'', out: `ab`},
+		{in: `a\.b\d'`, quote: '\'', out: `ab`},
+
+		{in: `a\\b'`, quote: '\'', keepEscapes: true, out: `a\b`},
+		{in: `it\'s'`, quote: '\'', keepEscapes: true, out: `it's`},
+		{in: `a\nb\rc\td'`, quote: '\'', keepEscapes: true, out: "a\nb\rc\td"},
+		{in: `a\db'`, quote: '\'', keepEscapes: true, out: `a\db`},
+		{in: `^/api/v\d+/users\.json$'`, quote: '\'', keepEscapes: true, out: `^/api/v\d+/users\.json$`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			var lex Lexer
+			lex.Reset(test.in)
+
+			var got string
+			var err error
+			if test.keepEscapes {
+				got, err = lex.ReadUnquotedKeepEscapes(test.quote)
+			} else {
+				got, err = lex.ReadUnquoted(test.quote)
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.out, got)
+			require.False(t, lex.Valid())
+		})
+	}
+}
+
+func TestReadUnquotedMissingQuote(t *testing.T) {
+	var lex Lexer
+	lex.Reset(`foo\'`)
+
+	_, err := lex.ReadUnquoted('\'')
+	require.Error(t, err)
+}
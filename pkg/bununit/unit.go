@@ -30,6 +30,25 @@ func FromString(s string) string {
 	return fromString(s)
 }
 
+// NormalizeUnit returns the canonical form of the unit and reports whether the unit is known.
+// Besides the units below, UCUM annotations in curly braces such as {request} are accepted.
+func NormalizeUnit(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") && len(s) > 2 {
+		return s, true
+	}
+
+	unit := FromString(s)
+	switch unit {
+	case None, Percents, Utilization,
+		Nanoseconds, Microseconds, Milliseconds, Seconds, Duration,
+		Bytes, Kilobytes, Megabytes, Gigabytes, Terabytes:
+		return unit, true
+	default:
+		return unit, false
+	}
+}
+
 func fromString(s string) string {
 	switch s {
 	case "", "1", "0", "count":
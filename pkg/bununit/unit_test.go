@@ -0,0 +1,36 @@
+package bununit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeUnit(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+		known  bool
+	}
+
+	tests := []Test{
+		{"", None, true},
+		{"1", None, true},
+		{"ms", Milliseconds, true},
+		{"Milliseconds", Milliseconds, true},
+		{" us ", Microseconds, true},
+		{"By", Bytes, true},
+		{"%", Percents, true},
+		{"{request}", "{request}", true},
+		{"milisecond", "milisecond", false},
+		{"{}", "{}", false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			unit, ok := NormalizeUnit(test.in)
+			require.Equal(t, test.wanted, unit)
+			require.Equal(t, test.known, ok)
+		})
+	}
+}
@@ -9,4 +9,11 @@ const (
 	InstrumentHistogram Instrument = "histogram"
 	InstrumentCounter   Instrument = "counter"
 	InstrumentSummary   Instrument = "summary"
+	InstrumentRatio     Instrument = "ratio"
+	// InstrumentWeightedAvg stores the sum and the count of values
+	// so the average is computed after the rows are summed.
+	InstrumentWeightedAvg Instrument = "weighted_avg"
+	// InstrumentApdex stores the apdex score of span durations
+	// as the sum of satisfied and tolerated counts and the number of spans.
+	InstrumentApdex Instrument = "apdex"
 )
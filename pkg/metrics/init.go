@@ -43,6 +43,13 @@ func Init(ctx context.Context, app *bunapp.App) {
 	if err := initSpanMetrics(ctx, app); err != nil {
 		app.Logger.Error("initSpanMetrics failed", zap.Error(err))
 	}
+	if err := initLogMetrics(ctx, app); err != nil {
+		app.Logger.Error("initLogMetrics failed", zap.Error(err))
+	}
+	if err := initSpanMetricStaleness(app); err != nil {
+		app.Logger.Error("initSpanMetricStaleness failed", zap.Error(err))
+	}
+	NewSpanMetricReloader(app).watchSIGHUP()
 }
 
 func initOTLP(ctx context.Context, app *bunapp.App, mp *MeasureProcessor) {
@@ -65,6 +72,7 @@ func initRoutes(ctx context.Context, app *bunapp.App, mp *MeasureProcessor) {
 			g.GET("", metricHandler.List)
 			g.GET("/describe", metricHandler.Describe)
 			g.GET("/stats", metricHandler.Stats)
+			g.GET("/span-metric-funcs", metricHandler.SpanMetricFuncs)
 		})
 
 	api.
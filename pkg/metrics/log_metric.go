@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/tracing"
+	"go.uber.org/zap"
+)
+
+// logMetricWhere limits log metrics to the logs stored in spans_index.
+const logMetricWhere = ".type = '" + tracing.EventTypeLog + "'"
+
+func initLogMetrics(ctx context.Context, app *bunapp.App) error {
+	conf := app.Config()
+	stats := make(map[string]int)
+
+	spanMetrics := make(map[string]bool, len(conf.MetricsFromSpans))
+	for i := range conf.MetricsFromSpans {
+		spanMetrics[conf.MetricsFromSpans[i].Name] = true
+	}
+
+	var errs []error
+	for i := range conf.MetricsFromLogs {
+		metric := &conf.MetricsFromLogs[i]
+		if metric.Name == "" {
+			return fmt.Errorf("metric name can't be empty")
+		}
+		if spanMetrics[metric.Name] {
+			stats[spanMetricFailed]++
+			errs = append(errs, fmt.Errorf(
+				"log metric %q has the same name as a span metric", metric.Name))
+			continue
+		}
+
+		logMetric, err := newLogSpanMetric(metric)
+		if err != nil {
+			stats[spanMetricFailed]++
+			errs = append(errs, fmt.Errorf("createLogMetric %q failed: %w", metric.Name, err))
+			continue
+		}
+
+		status, err := createSpanMetricWithStats(ctx, app, logMetric)
+		stats[status]++
+		if err != nil {
+			errs = append(errs, fmt.Errorf("createLogMetric %q failed: %w", metric.Name, err))
+		}
+	}
+
+	if len(conf.MetricsFromLogs) > 0 {
+		app.Zap(ctx).Info("created metrics from logs",
+			zap.Int(spanMetricCreated, stats[spanMetricCreated]),
+			zap.Int(spanMetricUpdated, stats[spanMetricUpdated]),
+			zap.Int(spanMetricFailed, stats[spanMetricFailed]),
+			zap.Int(spanMetricDisabled, stats[spanMetricDisabled]))
+	}
+
+	return errors.Join(errs...)
+}
+
+// newLogSpanMetric returns the span metric that reads only logs from spans_index.
+// Log metrics support counters and gauges.
+func newLogSpanMetric(metric *bunconf.SpanMetric) (*bunconf.SpanMetric, error) {
+	metric, err := inferSpanMetricInstrument(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	switch Instrument(metric.Instrument) {
+	case InstrumentCounter, InstrumentGauge:
+	default:
+		return nil, fmt.Errorf("log metrics support counter and gauge instruments, got %q",
+			metric.Instrument)
+	}
+
+	logMetric := *metric
+	logMetric.Where = append([]string{logMetricWhere}, metric.Where...)
+	return &logMetric, nil
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+func TestNewLogSpanMetric(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:  "app.logs.errors",
+		Value: "count()",
+		Attrs: []string{"service.name", "log.severity"},
+		Where: []string{"log.severity = 'ERROR'", "log.body like '%timeout%'"},
+	}
+
+	logMetric, err := newLogSpanMetric(metric)
+	require.NoError(t, err)
+	require.Equal(t, "counter", logMetric.Instrument)
+	require.Len(t, metric.Where, 2)
+
+	query := renderSpanMetricView(t, logMetric)
+	require.Contains(t, query, `WHERE (s."type" = 'log' AND s."log_severity" = 'ERROR' `+
+		`AND s."log_message" LIKE '%timeout%')`)
+	require.Contains(t, query, `[toString(s."service_name"), toString(s."log_severity")] AS string_values`)
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", Value: "p50(log.size)"},
+		{Name: "test", Instrument: "additive", Value: "sum(log.size)"},
+	} {
+		_, err := newLogSpanMetric(metric)
+		require.Error(t, err)
+	}
+}
@@ -25,6 +25,25 @@ type Metric struct {
 	Unit        string     `json:"unit" bun:",nullzero"`
 	AttrKeys    []string   `json:"attrKeys" bun:",array"`
 
+	// ValueDescription explains what the value of a metric derived from spans means.
+	ValueDescription string `json:"valueDescription" bun:",nullzero"`
+	// QuantileAlgorithm is the algorithm of histogram percentiles written by a span metric.
+	// Empty means QuantileBFloat16.
+	QuantileAlgorithm string `json:"quantileAlgorithm" bun:",nullzero"`
+	// ViewName is the materialized view that writes a span metric, so tooling
+	// can map the view back to the metric.
+	ViewName string `json:"viewName" bun:",nullzero"`
+	// Service is the service a span metric is limited to.
+	Service string `json:"service" bun:",nullzero"`
+	// RootOnly reports whether a span metric only counts root spans, i.e. requests.
+	RootOnly bool `json:"rootOnly" bun:",nullzero"`
+	// SampleRate is the fraction of spans a span metric is computed from.
+	// Counts and sums are already scaled up. Zero means all spans.
+	SampleRate float64 `json:"sampleRate" bun:",nullzero"`
+	// BucketBounds are the bounds of a fixed-bucket histogram. Every bound and +Inf
+	// has a row labeled with the le attr that counts the values less than or equal to it.
+	BucketBounds []float64 `json:"bucketBounds" bun:",array"`
+
 	CreatedAt time.Time `json:"createdAt" bun:",nullzero"`
 	UpdatedAt time.Time `json:"updatedAt" bun:",nullzero"`
 
@@ -107,6 +126,13 @@ func UpsertMetric(ctx context.Context, app *bunapp.App, m *Metric) error {
 		Set("unit = EXCLUDED.unit").
 		Set("instrument = EXCLUDED.instrument").
 		Set("attr_keys = EXCLUDED.attr_keys").
+		Set("value_description = EXCLUDED.value_description").
+		Set("quantile_algorithm = EXCLUDED.quantile_algorithm").
+		Set("view_name = EXCLUDED.view_name").
+		Set("service = EXCLUDED.service").
+		Set("sample_rate = EXCLUDED.sample_rate").
+		Set("root_only = EXCLUDED.root_only").
+		Set("bucket_bounds = EXCLUDED.bucket_bounds").
 		Set("updated_at = EXCLUDED.updated_at").
 		Exec(ctx); err != nil {
 		return err
@@ -195,6 +195,12 @@ func selectMetricsFromCH(
 	return metrics, len(metrics) == limit, nil
 }
 
+func (h *MetricHandler) SpanMetricFuncs(w http.ResponseWriter, req bunrouter.Request) error {
+	return httputil.JSON(w, bunrouter.H{
+		"funcs": SupportedMetricFuncs(),
+	})
+}
+
 func (h *MetricHandler) Describe(w http.ResponseWriter, req bunrouter.Request) error {
 	ctx := req.Context()
 	project := org.ProjectFromContext(ctx)
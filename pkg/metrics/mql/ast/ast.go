@@ -175,6 +175,18 @@ func (fn *FuncCall) AppendTemplate(b []byte) []byte {
 	return b
 }
 
+type StringExpr struct {
+	Text string
+}
+
+func (e *StringExpr) AppendString(b []byte) []byte {
+	return strconv.AppendQuote(b, e.Text)
+}
+
+func (e *StringExpr) AppendTemplate(b []byte) []byte {
+	return e.AppendString(b)
+}
+
 type UniqExpr struct {
 	Name  Name
 	Attrs []string
@@ -224,6 +236,36 @@ func (e *BinaryExpr) AppendTemplate(b []byte) []byte {
 
 type BinaryOp string
 
+type UnaryExpr struct {
+	Op   UnaryOp
+	Expr Expr
+}
+
+func (e *UnaryExpr) AppendString(b []byte) []byte {
+	b = append(b, e.Op...)
+	if e.Op == UnaryNot {
+		b = append(b, ' ')
+	}
+	b = e.Expr.AppendString(b)
+	return b
+}
+
+func (e *UnaryExpr) AppendTemplate(b []byte) []byte {
+	b = append(b, e.Op...)
+	if e.Op == UnaryNot {
+		b = append(b, ' ')
+	}
+	b = e.Expr.AppendTemplate(b)
+	return b
+}
+
+type UnaryOp string
+
+const (
+	UnaryMinus UnaryOp = "-"
+	UnaryNot   UnaryOp = "not"
+)
+
 //------------------------------------------------------------------------------
 
 type Grouping struct {
@@ -3,15 +3,94 @@ package ast
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 )
 
+// DefaultMaxQueryLen is the default limit of Parse.
+const DefaultMaxQueryLen = 8 << 10
+
+// maxQueryLen is the limit used by Parse. It is set once at startup by SetMaxQueryLen.
+var maxQueryLen atomic.Int64
+
+func init() {
+	maxQueryLen.Store(DefaultMaxQueryLen)
+}
+
+// SetMaxQueryLen sets the limit used by Parse. Zero or less disables the limit.
+func SetMaxQueryLen(n int) {
+	maxQueryLen.Store(int64(n))
+}
+
+// MaxQueryLen returns the limit used by Parse.
+func MaxQueryLen() int {
+	return int(maxQueryLen.Load())
+}
+
+// CheckQueryLen returns an error when the query is longer than maxLen bytes so generated
+// or pathological queries are rejected before they are tokenized. Zero or less disables
+// the limit.
+func CheckQueryLen(s string, maxLen int) error {
+	if maxLen > 0 && len(s) > maxLen {
+		return fmt.Errorf("query is too long: %d bytes, the limit is %d bytes", len(s), maxLen)
+	}
+	return nil
+}
+
+// queryVars are the template variables used by Parse. They are set once at startup by SetVars.
+var queryVars atomic.Pointer[map[string]string]
+
+// SetVars sets the template variables that Parse replaces, see ParseWithVars.
+func SetVars(vars map[string]string) {
+	queryVars.Store(&vars)
+}
+
+// Vars returns the template variables used by Parse.
+func Vars() map[string]string {
+	if vars := queryVars.Load(); vars != nil {
+		return *vars
+	}
+	return nil
+}
+
 func Parse(s string) (any, error) {
+	return ParseWithVars(s, Vars(), MaxQueryLen())
+}
+
+// ParseWithVars parses the query after replacing template variables like ${service}
+// with the values from vars. Values are inserted as is, so string values must be quoted.
+// Queries longer than maxLen bytes are rejected, see CheckQueryLen.
+func ParseWithVars(s string, vars map[string]string, maxLen int) (any, error) {
 	if s == "" {
 		return nil, errors.New("query is empty")
 	}
+	if err := CheckQueryLen(s, maxLen); err != nil {
+		return nil, err
+	}
 
 	p := &queryParser{
-		lexer: newLexer(s),
+		lexer: acquireLexer(s),
+	}
+	defer releaseLexer(p.lexer)
+
+	if p.lexer.err != nil {
+		return nil, p.lexer.err
+	}
+
+	if p.lexer.hasVars() {
+		s, err := substituteVars(p.lexer, vars)
+		if err != nil {
+			return nil, err
+		}
+		if err := CheckQueryLen(s, maxLen); err != nil {
+			return nil, err
+		}
+		if err := p.lexer.Reset(s); err != nil {
+			return nil, err
+		}
+		if p.lexer.hasVars() {
+			return nil, errors.New("variable values can't contain variables")
+		}
 	}
 
 	expr, err := p.parseQuery()
@@ -21,6 +100,52 @@ func Parse(s string) (any, error) {
 	return expr, err
 }
 
+// UndefinedVarError is returned when the query uses a variable that is not in the vars.
+type UndefinedVarError struct {
+	Name string
+	// Pos is the byte offset of the variable in the query.
+	Pos int
+}
+
+func (e *UndefinedVarError) Error() string {
+	return fmt.Sprintf("undefined variable ${%s} at position %d", e.Name, e.Pos)
+}
+
+func (l *lexer) hasVars() bool {
+	for i := range l.tokens {
+		if l.tokens[i].ID == VAR_TOKEN {
+			return true
+		}
+	}
+	return false
+}
+
+func substituteVars(l *lexer, vars map[string]string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(l.s))
+
+	var pos int
+	for i := range l.tokens {
+		tok := &l.tokens[i]
+		if tok.ID != VAR_TOKEN {
+			continue
+		}
+
+		name := varName(tok.Text)
+		value, ok := vars[name]
+		if !ok {
+			return "", &UndefinedVarError{Name: name, Pos: tok.Start}
+		}
+
+		b.WriteString(l.s[pos:tok.Start])
+		b.WriteString(value)
+		pos = tok.Start + len(tok.Text)
+	}
+	b.WriteString(l.s[pos:])
+
+	return b.String(), nil
+}
+
 type queryParser struct {
 	*lexer
 	cutPos int
@@ -60,5 +185,23 @@ func (p *queryParser) errorWithHint() error {
 	text = append(text, arrow...)
 	text = append(text, p.s[pos:e]...)
 
-	return fmt.Errorf("unexpected %q in %q", tok.Text, text)
+	return &SyntaxError{
+		Pos:  pos,
+		Text: tok.Text,
+		Hint: string(text),
+	}
+}
+
+// SyntaxError is returned when the parser does not expect a token.
+type SyntaxError struct {
+	// Pos is the byte offset in the query where parsing stopped.
+	Pos int
+	// Text is the unexpected token.
+	Text string
+	// Hint is the query around Pos with an arrow pointing at Pos.
+	Hint string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("unexpected %q in %q", e.Text, e.Hint)
 }
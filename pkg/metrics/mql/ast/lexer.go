@@ -4,7 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/uptrace/uptrace/pkg/bunlex"
 	"github.com/uptrace/uptrace/pkg/bununit"
@@ -20,6 +24,7 @@ const (
 	NUMBER_TOKEN
 	DURATION_TOKEN
 	BYTES_TOKEN
+	VAR_TOKEN
 )
 
 var eofToken = &Token{ID: EOF_TOKEN}
@@ -41,32 +46,96 @@ func (t *Token) String() string {
 
 //------------------------------------------------------------------------------
 
+// InvalidChars are the bytes that can't appear in queries outside of quoted values.
+// The lexer rejects them instead of passing them to the parser as byte tokens.
+var InvalidChars = "@#;?`\\"
+
+// InvalidCharError is returned for queries that contain one of InvalidChars.
+type InvalidCharError struct {
+	Char byte
+	// Pos is the byte offset of the char in the query.
+	Pos int
+}
+
+func (e *InvalidCharError) Error() string {
+	return fmt.Sprintf("unexpected character %q at position %d", e.Char, e.Pos)
+}
+
 type lexer struct {
 	s   string
 	lex bunlex.Lexer
 
 	tokens []Token
 	pos    int
+	err    error
 }
 
 func newLexer(s string) *lexer {
 	lex := &lexer{
-		tokens: make([]Token, 0, 32),
+		tokens: make([]Token, 0, tokensCapHint(s)),
 	}
 	lex.Reset(s)
 	return lex
 }
 
+// tokensCapHint estimates the number of tokens in s, so long queries don't
+// reallocate the tokens slice several times.
+func tokensCapHint(s string) int {
+	const minCap = 32
+	if n := len(s) / 4; n > minCap {
+		return n
+	}
+	return minCap
+}
+
+// reserveTokens grows the tokens slice to fit the tokens of s.
+func (l *lexer) reserveTokens(s string) {
+	if n := tokensCapHint(s); cap(l.tokens) < n {
+		l.tokens = make([]Token, 0, n)
+	}
+}
+
+// maxPooledTokens prevents lexers that parsed very long queries from staying in the pool.
+const maxPooledTokens = 1024
+
+var lexerPool = sync.Pool{
+	New: func() any {
+		return &lexer{
+			tokens: make([]Token, 0, 32),
+		}
+	},
+}
+
+// acquireLexer returns a lexer from the pool reset to s.
+// The lexer must not be used by other goroutines and must be released with releaseLexer.
+func acquireLexer(s string) *lexer {
+	lex := lexerPool.Get().(*lexer)
+	lex.reserveTokens(s)
+	lex.Reset(s)
+	return lex
+}
+
+// releaseLexer returns the lexer to the pool. Tokens must not be used after the release.
+func releaseLexer(lex *lexer) {
+	if cap(lex.tokens) > maxPooledTokens {
+		return
+	}
+	lex.Reset("")
+	lexerPool.Put(lex)
+}
+
 func (l *lexer) Reset(s string) error {
 	l.s = s
 	l.lex.Reset(s)
 
 	l.tokens = l.tokens[:0]
 	l.pos = 0
+	l.err = nil
 
 	for {
 		tok, err := l.readToken()
 		if err != nil {
+			l.err = err
 			return err
 		}
 		if tok == eofToken {
@@ -109,7 +178,12 @@ func (l *lexer) readToken() (*Token, error) {
 	switch c {
 	case '\'', '"':
 		return l.quotedValue(c)
-	case '_', '$', '.':
+	case '$':
+		if l.lex.PeekByte() == '{' {
+			return l.variable(l.lex.Pos() - 1)
+		}
+		return l.ident(l.lex.Pos() - 1)
+	case '_', '.':
 		return l.ident(l.lex.Pos() - 1)
 	}
 
@@ -124,7 +198,17 @@ func (l *lexer) readToken() (*Token, error) {
 	if bunlex.IsAlpha(c) {
 		return l.ident(l.lex.Pos() - 1)
 	}
+	if c >= utf8.RuneSelf {
+		start := l.lex.Pos() - 1
+		if r, _ := utf8.DecodeRuneInString(l.s[start:]); unicode.IsLetter(r) {
+			l.lex.Rewind()
+			return l.ident(start)
+		}
+	}
 
+	if strings.IndexByte(InvalidChars, c) >= 0 {
+		return nil, &InvalidCharError{Char: c, Pos: l.lex.Pos() - 1}
+	}
 	return l.charToken(BYTE_TOKEN), nil
 }
 
@@ -135,7 +219,7 @@ func (l *lexer) charToken(id TokenID) *Token {
 
 func (l *lexer) quotedValue(end byte) (*Token, error) {
 	start := l.lex.Pos() - 1
-	s, err := l.lex.ReadUnquoted(end)
+	s, err := l.lex.ReadUnquotedKeepEscapes(end)
 	if err != nil {
 		return nil, err
 	}
@@ -173,17 +257,41 @@ func (l *lexer) isWordBoundary(c byte) bool {
 
 func (l *lexer) ident(start int) (*Token, error) {
 	for l.lex.Valid() {
-		c := l.lex.PeekByte()
-		if !isIdentChar(c) {
+		pos := l.lex.Pos()
+		r, size := utf8.DecodeRuneInString(l.s[pos:])
+		if !isIdentChar(r) {
 			break
 		}
-		l.lex.Advance()
+		l.lex.SetPos(pos + size)
 	}
 
 	s := l.s[start:l.lex.Pos()]
 	return l.token(IDENT_TOKEN, s, start), nil
 }
 
+// variable reads a template variable like ${service}. Unlike $name, which refers to
+// a metric, variables are replaced with their values before the query is parsed.
+func (l *lexer) variable(start int) (*Token, error) {
+	end := strings.IndexByte(l.s[start:], '}')
+	if end == -1 {
+		return nil, fmt.Errorf("unterminated variable at position %d", start)
+	}
+	end += start + 1
+
+	s := l.s[start:end]
+	if !IsIdent(varName(s)) {
+		return nil, fmt.Errorf("invalid variable %q at position %d", s, start)
+	}
+
+	l.lex.SetPos(end)
+	return l.token(VAR_TOKEN, s, start), nil
+}
+
+// varName returns the name of the variable token text, for example, service for ${service}.
+func varName(s string) string {
+	return s[2 : len(s)-1]
+}
+
 func (l *lexer) token(id TokenID, s string, start int) *Token {
 	l.tokens = append(l.tokens, Token{
 		ID:    id,
@@ -197,14 +305,14 @@ func IsIdent(s string) bool {
 	if s == "" {
 		return false
 	}
-	for _, c := range []byte(s) {
-		if !isIdentChar(c) {
+	for _, r := range s {
+		if !isIdentChar(r) {
 			return false
 		}
 	}
 	return true
 }
 
-func isIdentChar(c byte) bool {
-	return bunlex.IsAlnum(c) || c == '_' || c == '.'
+func isIdentChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
 }
@@ -0,0 +1,276 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLexerUnicodeIdent(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted []Token
+	}
+
+	tests := []Test{
+		{"服务.name", []Token{
+			{ID: IDENT_TOKEN, Text: "服务.name", Start: 0},
+		}},
+		{"sum(服务.size)", []Token{
+			{ID: IDENT_TOKEN, Text: "sum", Start: 0},
+			{ID: BYTE_TOKEN, Text: "(", Start: 3},
+			{ID: IDENT_TOKEN, Text: "服务.size", Start: 4},
+			{ID: BYTE_TOKEN, Text: ")", Start: 15},
+		}},
+		{"größe + 1", []Token{
+			{ID: IDENT_TOKEN, Text: "größe", Start: 0},
+			{ID: BYTE_TOKEN, Text: "+", Start: 8},
+			{ID: NUMBER_TOKEN, Text: "1", Start: 10},
+		}},
+		{"http.имя", []Token{
+			{ID: IDENT_TOKEN, Text: "http.имя", Start: 0},
+		}},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			lex := newLexer(test.in)
+			require.Equal(t, test.wanted, lex.tokens, "in=%q", test.in)
+		})
+	}
+}
+
+func TestParseInvalidChar(t *testing.T) {
+	type Test struct {
+		in   string
+		char byte
+		pos  int
+	}
+
+	tests := []Test{
+		{"sum(span.@duration)", '@', 9},
+		{"span.duration # comment", '#', 14},
+		{"p50(span.duration); drop", ';', 18},
+		{"sum(span.duration) ? 1", '?', 19},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := Parse(test.in)
+			var charErr *InvalidCharError
+			require.ErrorAs(t, err, &charErr)
+			require.Equal(t, test.char, charErr.Char)
+			require.Equal(t, test.pos, charErr.Pos)
+			require.Equal(t, fmt.Sprintf("unexpected character '%c' at position %d",
+				test.char, test.pos), err.Error())
+		})
+	}
+
+	_, err := Parse("sum(span.duration) as 'a@b'")
+	var charErr *InvalidCharError
+	require.False(t, errors.As(err, &charErr), err)
+}
+
+func TestParseMaxQueryLen(t *testing.T) {
+	query := "span.duration" + strings.Repeat(" + span.duration", 1<<10)
+	_, err := Parse(query)
+	require.EqualError(t, err,
+		fmt.Sprintf("query is too long: %d bytes, the limit is 8192 bytes", len(query)))
+
+	_, err = Parse("span.duration" + strings.Repeat(" + span.duration", 100))
+	require.NoError(t, err)
+
+	_, err = ParseWithVars("sum(span.duration)", nil, 10)
+	require.ErrorContains(t, err, "the limit is 10 bytes")
+
+	_, err = ParseWithVars(query, nil, -1)
+	require.NoError(t, err)
+
+	defer SetMaxQueryLen(DefaultMaxQueryLen)
+	SetMaxQueryLen(10)
+	_, err = Parse("sum(span.duration)")
+	require.ErrorContains(t, err, "the limit is 10 bytes")
+}
+
+func TestParseWithVars(t *testing.T) {
+	lex := newLexer("sum($calls) by ${attr}")
+	require.Equal(t, []Token{
+		{ID: IDENT_TOKEN, Text: "sum", Start: 0},
+		{ID: BYTE_TOKEN, Text: "(", Start: 3},
+		{ID: IDENT_TOKEN, Text: "$calls", Start: 4},
+		{ID: BYTE_TOKEN, Text: ")", Start: 10},
+		{ID: IDENT_TOKEN, Text: "by", Start: 12},
+		{ID: VAR_TOKEN, Text: "${attr}", Start: 15},
+	}, lex.tokens)
+
+	vars := map[string]string{
+		"alias":      "calls",
+		"attr":       "service.name",
+		"service":    "'api'",
+		"__interval": "5m",
+	}
+
+	got, err := ParseWithVars("sum($calls) as ${alias}", vars, DefaultMaxQueryLen)
+	require.NoError(t, err)
+	wanted, err := Parse("sum($calls) as calls")
+	require.NoError(t, err)
+	require.Equal(t, wanted, got)
+
+	got, err = ParseWithVars("where service.name = ${service}", vars, DefaultMaxQueryLen)
+	require.NoError(t, err)
+	wanted, err = Parse("where service.name = 'api'")
+	require.NoError(t, err)
+	require.Equal(t, wanted, got)
+
+	got, err = ParseWithVars("group by ${attr}", vars, DefaultMaxQueryLen)
+	require.NoError(t, err)
+	wanted, err = Parse("group by service.name")
+	require.NoError(t, err)
+	require.Equal(t, wanted, got)
+
+	// Variables in quoted values are not replaced.
+	_, err = ParseWithVars("where service.name = '${service}'", nil, DefaultMaxQueryLen)
+	require.NoError(t, err)
+}
+
+func TestParseUndefinedVar(t *testing.T) {
+	type Test struct {
+		in   string
+		vars map[string]string
+		name string
+		pos  int
+	}
+
+	tests := []Test{
+		{"sum($calls) by ${attr}", nil, "attr", 15},
+		{"sum($calls) by ${attr}", map[string]string{"service": "'api'"}, "attr", 15},
+		{"where service.name = ${service}", map[string]string{"attr": "host"}, "service", 21},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := ParseWithVars(test.in, test.vars, DefaultMaxQueryLen)
+			var varErr *UndefinedVarError
+			require.ErrorAs(t, err, &varErr)
+			require.Equal(t, test.name, varErr.Name)
+			require.Equal(t, test.pos, varErr.Pos)
+			require.Equal(t, fmt.Sprintf("undefined variable ${%s} at position %d",
+				test.name, test.pos), err.Error())
+		})
+	}
+
+	_, err := Parse("sum(${metric}")
+	require.EqualError(t, err, "undefined variable ${metric} at position 4")
+
+	_, err = Parse("sum(${metric)")
+	require.EqualError(t, err, "unterminated variable at position 4")
+
+	_, err = Parse("sum(${a b})")
+	require.EqualError(t, err, `invalid variable "${a b}" at position 4`)
+
+	vars := map[string]string{"a": "${b}", "b": "$calls"}
+	_, err = ParseWithVars("sum(${a})", vars, DefaultMaxQueryLen)
+	require.EqualError(t, err, "variable values can't contain variables")
+}
+
+func TestParseSetVars(t *testing.T) {
+	SetVars(map[string]string{"attr": "service.name"})
+	defer SetVars(nil)
+
+	got, err := Parse("group by ${attr}")
+	require.NoError(t, err)
+	wanted, err := ParseWithVars("group by service.name", nil, DefaultMaxQueryLen)
+	require.NoError(t, err)
+	require.Equal(t, wanted, got)
+
+	_, err = Parse("group by ${host}")
+	require.EqualError(t, err, "undefined variable ${host} at position 9")
+}
+
+func TestIsIdent(t *testing.T) {
+	require.True(t, IsIdent("服务.name"))
+	require.True(t, IsIdent("http.route"))
+	require.False(t, IsIdent("服务 name"))
+	require.False(t, IsIdent(""))
+}
+
+func TestAcquireLexerReset(t *testing.T) {
+	lex := acquireLexer("sum(span.duration) + 1")
+	require.Len(t, lex.tokens, 6)
+	lex.NextToken()
+	releaseLexer(lex)
+
+	require.Equal(t, "", lex.s)
+	require.Empty(t, lex.tokens)
+	require.Equal(t, 0, lex.pos)
+
+	lex = acquireLexer("p50(span.duration)")
+	defer releaseLexer(lex)
+	require.Equal(t, 0, lex.pos)
+	require.Equal(t, "p50", lex.NextToken().Text)
+}
+
+func TestParseConcurrent(t *testing.T) {
+	const query = "sum(span.count) / 60 as per_min"
+	wanted, err := Parse(query)
+	require.NoError(t, err)
+
+	results := make([]any, 8)
+	errs := make([]error, len(results))
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				results[i], errs[i] = Parse(query)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		require.NoError(t, errs[i])
+		require.Equal(t, wanted, results[i])
+	}
+}
+
+const benchQuery = "sum(span.count) / 60 as per_min | p50(span.duration) as p50"
+
+func BenchmarkNewLexer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = newLexer(benchQuery)
+	}
+}
+
+func BenchmarkAcquireLexer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		releaseLexer(acquireLexer(benchQuery))
+	}
+}
+
+// benchLongQuery is a generated expression with hundreds of tokens.
+var benchLongQuery = strings.Repeat("sum(span.count) / 60 + p50(span.duration) * 2 - ", 50) + "1"
+
+func BenchmarkNewLexerLong(b *testing.B) {
+	b.Run("no hint", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			lex := &lexer{
+				tokens: make([]Token, 0, 32),
+			}
+			lex.Reset(benchLongQuery)
+		}
+	})
+
+	b.Run("hint", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = newLexer(benchLongQuery)
+		}
+	})
+}
@@ -1305,6 +1305,25 @@ func (p *queryParser) binaryExpr() (*BinaryExpr, error) {
 
 func (p *queryParser) term() (Expr, error) {
 
+	{
+		var unaryExpr *UnaryExpr
+		_pos1 := p.Pos()
+		{
+			var _err error
+			unaryExpr, _err = p.unaryExpr()
+			if _err != nil && _err != errBacktrack {
+				return nil, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+				goto i0_group_end
+			}
+		}
+		return unaryExpr, nil
+	i0_group_end:
+	}
+
 	{
 		var number *Number
 		_pos1 := p.Pos()
@@ -1317,11 +1336,11 @@ func (p *queryParser) term() (Expr, error) {
 			_match := _err == nil
 			if !_match {
 				p.ResetPos(_pos1)
-				goto i0_group_end
+				goto r1_i0_group_end
 			}
 		}
 		return number, nil
-	i0_group_end:
+	r1_i0_group_end:
 	}
 
 	{
@@ -1336,11 +1355,11 @@ func (p *queryParser) term() (Expr, error) {
 			_match := _err == nil
 			if !_match {
 				p.ResetPos(_pos1)
-				goto r1_i0_group_end
+				goto r2_i0_group_end
 			}
 		}
 		return uniq, nil
-	r1_i0_group_end:
+	r2_i0_group_end:
 	}
 
 	{
@@ -1355,11 +1374,11 @@ func (p *queryParser) term() (Expr, error) {
 			_match := _err == nil
 			if !_match {
 				p.ResetPos(_pos1)
-				goto r2_i0_group_end
+				goto r3_i0_group_end
 			}
 		}
 		return funcCall, nil
-	r2_i0_group_end:
+	r3_i0_group_end:
 	}
 
 	{
@@ -1374,11 +1393,27 @@ func (p *queryParser) term() (Expr, error) {
 			_match := _err == nil
 			if !_match {
 				p.ResetPos(_pos1)
-				goto r3_i0_group_end
+				goto r4_i0_group_end
 			}
 		}
 		return &name, nil
-	r3_i0_group_end:
+	r4_i0_group_end:
+	}
+
+	{
+		var t *Token
+		_pos1 := p.Pos()
+		{
+			_tok := p.NextToken()
+			_match := _tok.ID == VALUE_TOKEN
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r5_i0_group_end
+			}
+			t = _tok
+		}
+		return &StringExpr{Text: t.Text}, nil
+	r5_i0_group_end:
 	}
 
 	var expr Expr
@@ -1411,6 +1446,36 @@ func (p *queryParser) term() (Expr, error) {
 	return ParenExpr{Expr: expr}, nil
 }
 
+func (p *queryParser) unaryExpr() (*UnaryExpr, error) {
+
+	var expr Expr
+	var t *Token
+
+	{
+		_tok := p.NextToken()
+		_match := _tok.Text == "-" || len(_tok.Text) == 3 && (_tok.Text[0] == 'n' || _tok.Text[0] == 'N') && (_tok.Text[1] == 'o' || _tok.Text[1] == 'O') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T')
+		if !_match {
+			return nil, errBacktrack
+		}
+		t = _tok
+	}
+	{
+		var _err error
+		expr, _err = p.term()
+		if _err != nil && _err != errBacktrack {
+			return nil, _err
+		}
+		_match := _err == nil
+		if !_match {
+			return nil, errBacktrack
+		}
+	}
+	return &UnaryExpr{
+		Op:   UnaryOp(strings.ToLower(t.Text)),
+		Expr: expr,
+	}, nil
+}
+
 func (p *queryParser) name() (Name, error) {
 
 	{
@@ -1844,14 +1909,17 @@ func (p *queryParser) funcCall() (*FuncCall, error) {
 		}
 	}
 	{
-		var _err error
-		args, _err = p.args()
-		if _err != nil && _err != errBacktrack {
-			return nil, _err
-		}
-		_match := _err == nil
-		if !_match {
-			return nil, errBacktrack
+		_pos1 := p.Pos()
+		{
+			var _err error
+			args, _err = p.args()
+			if _err != nil && _err != errBacktrack {
+				return nil, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+			}
 		}
 	}
 	{
@@ -15,11 +15,12 @@ func _() {
 	_ = x[NUMBER_TOKEN-4]
 	_ = x[DURATION_TOKEN-5]
 	_ = x[BYTES_TOKEN-6]
+	_ = x[VAR_TOKEN-7]
 }
 
-const _TokenID_name = "EOF_TOKENBYTE_TOKENIDENT_TOKENVALUE_TOKENNUMBER_TOKENDURATION_TOKENBYTES_TOKEN"
+const _TokenID_name = "EOF_TOKENBYTE_TOKENIDENT_TOKENVALUE_TOKENNUMBER_TOKENDURATION_TOKENBYTES_TOKENVAR_TOKEN"
 
-var _TokenID_index = [...]uint8{0, 9, 19, 30, 41, 53, 67, 78}
+var _TokenID_index = [...]uint8{0, 9, 19, 30, 41, 53, 67, 78, 87}
 
 func (i TokenID) String() string {
 	if i < 0 || i >= TokenID(len(_TokenID_index)-1) {
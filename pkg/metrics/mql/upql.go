@@ -2,6 +2,7 @@ package mql
 
 import (
 	"strings"
+	"unicode"
 
 	"github.com/segmentio/encoding/json"
 
@@ -18,9 +19,46 @@ type QueryPart struct {
 	Error    JSONError `json:"error,omitempty"`
 	Disabled bool      `json:"disabled,omitempty"`
 
+	// Pos is the byte offset of the part in the parsed query.
+	Pos int `json:"-"`
+
 	AST any `json:"-"`
 }
 
+// End returns the byte offset right after the part in the parsed query.
+func (part *QueryPart) End() int {
+	return part.Pos + len(part.Query)
+}
+
+// Err returns the error that occurred while parsing the part.
+func (part *QueryPart) Err() error {
+	return part.Error.Wrapped
+}
+
+// IsSelector reports whether the part is a metric expression, e.g. `sum($foo) as bar`.
+func (part *QueryPart) IsSelector() bool {
+	_, ok := part.AST.(*ast.Selector)
+	return ok
+}
+
+// Selector returns the metric expression of the part.
+func (part *QueryPart) Selector() (*ast.Selector, bool) {
+	sel, ok := part.AST.(*ast.Selector)
+	return sel, ok
+}
+
+// Grouping returns the group by clause of the part.
+func (part *QueryPart) Grouping() (*ast.Grouping, bool) {
+	grouping, ok := part.AST.(*ast.Grouping)
+	return grouping, ok
+}
+
+// Where returns the where clause of the part.
+func (part *QueryPart) Where() (*ast.Where, bool) {
+	where, ok := part.AST.(*ast.Where)
+	return where, ok
+}
+
 type ColumnInfo struct{}
 
 type JSONError struct {
@@ -47,7 +85,11 @@ func ParseError(query string) (*ParsedQuery, error) {
 func Parse(query string) *ParsedQuery {
 	parts := make([]*QueryPart, 0)
 
+	var pos int
 	for _, query := range SplitQuery(query) {
+		start := pos + len(query) - len(strings.TrimLeftFunc(query, unicode.IsSpace))
+		pos += len(query) + len(querySep)
+
 		query = strings.TrimSpace(query)
 		if query == "" {
 			continue
@@ -55,6 +97,7 @@ func Parse(query string) *ParsedQuery {
 
 		part := &QueryPart{
 			Query: query,
+			Pos:   start,
 		}
 		parts = append(parts, part)
 
@@ -71,10 +114,12 @@ func Parse(query string) *ParsedQuery {
 	}
 }
 
+const querySep = " | "
+
 func SplitQuery(query string) []string {
-	return strings.Split(query, " | ")
+	return strings.Split(query, querySep)
 }
 
 func JoinQuery(parts []string) string {
-	return strings.Join(parts, " | ")
+	return strings.Join(parts, querySep)
 }
@@ -0,0 +1,45 @@
+package mql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryPart(t *testing.T) {
+	query := "sum($calls) as calls | group by service.name |  where host.name = 'x' | sum("
+	parsed := Parse(query)
+	require.Len(t, parsed.Parts, 4)
+
+	for _, part := range parsed.Parts {
+		require.Equal(t, part.Query, query[part.Pos:part.End()])
+	}
+
+	part := parsed.Parts[0]
+	require.NoError(t, part.Err())
+	require.True(t, part.IsSelector())
+	sel, ok := part.Selector()
+	require.True(t, ok)
+	require.Equal(t, "calls", sel.Expr.Alias)
+	_, ok = part.Grouping()
+	require.False(t, ok)
+
+	part = parsed.Parts[1]
+	require.False(t, part.IsSelector())
+	grouping, ok := part.Grouping()
+	require.True(t, ok)
+	require.Equal(t, []string{"service.name"}, grouping.Names)
+
+	part = parsed.Parts[2]
+	require.Equal(t, 48, part.Pos)
+	where, ok := part.Where()
+	require.True(t, ok)
+	require.Len(t, where.Filters, 1)
+	require.Equal(t, "host.name", where.Filters[0].LHS)
+
+	part = parsed.Parts[3]
+	require.Error(t, part.Err())
+	require.False(t, part.IsSelector())
+	_, ok = part.Selector()
+	require.False(t, ok)
+}
@@ -2,266 +2,3388 @@ package metrics
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/uptrace/go-clickhouse/ch"
 	"github.com/uptrace/go-clickhouse/ch/chschema"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"github.com/uptrace/uptrace/pkg"
+	"github.com/uptrace/uptrace/pkg/attrkey"
 	"github.com/uptrace/uptrace/pkg/bunapp"
 	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/bunotel"
 	"github.com/uptrace/uptrace/pkg/bununit"
 	"github.com/uptrace/uptrace/pkg/metrics/mql"
 	"github.com/uptrace/uptrace/pkg/metrics/mql/ast"
 	"github.com/uptrace/uptrace/pkg/tracing"
 	"github.com/uptrace/uptrace/pkg/tracing/tql"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 )
 
-const spanMetricDur = 1
+const (
+	spanMetricBucketMinute = "minute"
+	spanMetricBucketHour   = "hour"
+)
+
+// spanMetricRelativeToRoot makes the metric value relative to the root span duration.
+const spanMetricRelativeToRoot = "root"
+
+const (
+	spanMetricZeroDurationSkip    = "skip"
+	spanMetricZeroDurationInclude = "include"
+)
+
+// spanMetricTotal is the value of every attr in the rows written by metrics with total.
+const spanMetricTotal = "__total__"
+
+// spanMetricSampleBase is the number of buckets traces are hashed into when sampling.
+const spanMetricSampleBase = 10000
+
+var spanMetricCounter, _ = bunotel.Meter.Int64Counter(
+	"uptrace.span_metrics.views",
+	otelmetric.WithDescription("Number of span metric views created, updated, or failed"),
+)
+
+var spanMetricDuration, _ = bunotel.Meter.Float64Histogram(
+	"uptrace.span_metrics.create_duration",
+	otelmetric.WithDescription("Time spent creating a span metric"),
+	otelmetric.WithUnit("ms"),
+)
+
+const (
+	spanMetricCreated  = "created"
+	spanMetricUpdated  = "updated"
+	spanMetricFailed   = "failed"
+	spanMetricDisabled = "disabled"
+)
 
 func initSpanMetrics(ctx context.Context, app *bunapp.App) error {
 	conf := app.Config()
+	setMaxQueryLen(conf)
+	ast.SetVars(conf.Vars)
+
+	if err := checkSpanMetricCluster(ctx, chDB{db: app.CH}, conf.CHSchema.Cluster); err != nil {
+		return err
+	}
+
+	stats := make(map[string]int)
+
+	var errs []error
 	for i := range conf.MetricsFromSpans {
 		metric := &conf.MetricsFromSpans[i]
 		if metric.Name == "" {
 			return fmt.Errorf("metric name can't be empty")
 		}
-		if err := createSpanMetric(ctx, app, metric); err != nil {
-			return fmt.Errorf("createSpanMetric %q failed: %w", metric.Name, err)
+
+		status, err := createSpanMetricWithStats(ctx, app, metric)
+		stats[status]++
+		if err != nil {
+			errs = append(errs, fmt.Errorf("createSpanMetric %q failed: %w", metric.Name, err))
 		}
 	}
+
+	if len(conf.MetricsFromSpans) > 0 {
+		app.Zap(ctx).Info("created metrics from spans",
+			zap.Int(spanMetricCreated, stats[spanMetricCreated]),
+			zap.Int(spanMetricUpdated, stats[spanMetricUpdated]),
+			zap.Int(spanMetricFailed, stats[spanMetricFailed]),
+			zap.Int(spanMetricDisabled, stats[spanMetricDisabled]))
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkSpanMetricCluster checks that ClickHouse knows the cluster before any view
+// is created ON CLUSTER, because the DDL error for an unknown cluster is hard to read.
+func checkSpanMetricCluster(ctx context.Context, db chRowScanner, cluster string) error {
+	if cluster == "" {
+		return nil
+	}
+
+	b := []byte("SELECT count() FROM system.clusters WHERE cluster = ")
+	b = appendCHEscapedString(b, cluster)
+
+	var n uint64
+	if err := db.scanRow(ctx, string(b), &n); err != nil {
+		return fmt.Errorf("can't check cluster %q: %w", cluster, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("ON CLUSTER '%s' not found in system.clusters", cluster)
+	}
 	return nil
 }
 
-func createSpanMetric(ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric) error {
-	if metric.Instrument == "" {
-		return fmt.Errorf("metric instrument can't be empty")
+// setMaxQueryLen applies max_query_length to the metric query parser.
+// It is called once at startup before any query is parsed.
+func setMaxQueryLen(conf *bunconf.Config) {
+	if conf.MaxQueryLength == 0 {
+		ast.SetMaxQueryLen(ast.DefaultMaxQueryLen)
+	} else {
+		ast.SetMaxQueryLen(conf.MaxQueryLength)
+	}
+}
+
+// createSpanMetricWithStats creates the span metric and records how long it took
+// and whether the view was created, updated, or failed.
+func createSpanMetricWithStats(
+	ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric,
+) (string, error) {
+	startTime := time.Now()
+
+	// The view is looked up once and the result is passed down to createMatView.
+	exists, err := spanMetricViewExists(ctx, app, app.Config().SpanMetricViewName(metric.Name))
+	status := spanMetricCreated
+	if exists {
+		status = spanMetricUpdated
+	}
+	if err == nil {
+		_, err = createSpanMetric(ctx, app, metric, exists)
+	}
+	if err != nil {
+		status = spanMetricFailed
+	} else if !metric.IsEnabled() {
+		status = spanMetricDisabled
+	}
+
+	attrs := otelmetric.WithAttributes(
+		attribute.String("metric", metric.Name),
+		attribute.String("status", status),
+	)
+	spanMetricCounter.Add(ctx, 1, attrs)
+	spanMetricDuration.Record(ctx, float64(time.Since(startTime))/float64(time.Millisecond), attrs)
+
+	return status, err
+}
+
+func spanMetricViewExists(ctx context.Context, app *bunapp.App, viewName string) (bool, error) {
+	var count uint64
+	if err := app.CH.NewSelect().
+		ColumnExpr("count()").
+		TableExpr("system.tables").
+		Where("database = ?", app.CH.Config().Database).
+		Where("name = ?", viewName).
+		Scan(ctx, &count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// createSpanMetric creates the metric metadata and returns the names
+// of the materialized views that write the metric. exists reports whether
+// the view of the metric already exists.
+func createSpanMetric(
+	ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric, exists bool,
+) ([]string, error) {
+	if err := checkSpanMetricRawValue(metric, app.Config()); err != nil {
+		return nil, err
+	}
+
+	metric, err := inferSpanMetricInstrument(metric)
+	if err != nil {
+		return nil, err
+	}
+	metric, err = expandSpanMetricAttrs(ctx, metric, newSpanAttrCatalog(app))
+	if err != nil {
+		return nil, err
+	}
+	metric, dups, err := dedupeSpanMetricAttrs(metric)
+	if err != nil {
+		return nil, err
+	}
+	if len(dups) > 0 {
+		app.Zap(ctx).Warn("ignoring duplicated span metric attrs",
+			zap.String("metric", metric.Name),
+			zap.Strings("attrs", dups))
+	}
+	if metric.SampleRate < 0 || metric.SampleRate > 1 {
+		return nil, fmt.Errorf("metric sample_rate must be between 0 and 1, got %v", metric.SampleRate)
+	}
+	if metric.IsSampled() && Instrument(metric.Instrument) == InstrumentHistogram {
+		app.Zap(ctx).Warn("sampled histograms have less accurate percentiles",
+			zap.String("metric", metric.Name),
+			zap.Float64("sample_rate", metric.SampleRate))
+	}
+
+	exprs, err := compileSpanMetric(metric)
+	if err != nil {
+		return nil, err
+	}
+	if metric.SourceTable != "" {
+		if err := checkSpanMetricSourceTable(
+			ctx, chDB{db: app.CH}, app.CH.Config().Database, metric.SourceTable,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkSpanMetricJoins(exprs, app.Config()); err != nil {
+		return nil, err
+	}
+	if err := checkSpanMetricTargetColumns(
+		ctx, chDB{db: app.CH}, app.CH.Config().Database, metric, exprs,
+	); err != nil {
+		return nil, err
+	}
+
+	for _, warning := range checkSpanMetricAttrKeys(metric) {
+		app.Zap(ctx).Warn(warning, zap.String("metric", metric.Name))
 	}
 
 	if err := createSpanMetricMeta(ctx, app, metric); err != nil {
-		return fmt.Errorf("createSpanMetricMeta failed: %w", err)
+		return nil, fmt.Errorf("createSpanMetricMeta failed: %w", err)
 	}
-	if err := createMatView(ctx, app, metric); err != nil {
-		return fmt.Errorf("createMatView failed: %w", err)
+
+	viewName, err := createMatView(ctx, app, metric, exprs, exists)
+	if err != nil {
+		return nil, fmt.Errorf("createMatView failed: %w", err)
 	}
-	return nil
+	if viewName == "" {
+		return nil, nil
+	}
+	return []string{viewName}, nil
 }
 
-func createSpanMetricMeta(ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric) error {
-	projects := app.Config().Projects
-	for i := range projects {
-		project := &projects[i]
+// inferSpanMetricInstrument returns a copy of the metric with the instrument derived
+// from the top-level function of the value when the instrument is not set.
+// Percentile funcs make a histogram of their argument.
+func inferSpanMetricInstrument(metric *bunconf.SpanMetric) (*bunconf.SpanMetric, error) {
+	if metric.Instrument != "" {
+		return metric, nil
+	}
+	if metric.RawValue != "" {
+		return nil, fmt.Errorf("raw metric value requires the instrument to be set")
+	}
+	if metric.Numerator != "" {
+		inferred := *metric
+		inferred.Instrument = string(InstrumentRatio)
+		return &inferred, nil
+	}
+	if metric.Weight != "" {
+		inferred := *metric
+		inferred.Instrument = string(InstrumentWeightedAvg)
+		return &inferred, nil
+	}
+	if metric.ApdexThreshold != 0 {
+		inferred := *metric
+		inferred.Instrument = string(InstrumentApdex)
+		return &inferred, nil
+	}
+	if metric.RelativeTo != "" {
+		inferred := *metric
+		inferred.Instrument = string(InstrumentHistogram)
+		return &inferred, nil
+	}
+
+	expr, err := parseSpanMetricExpr(metric.Value)
+	if err != nil {
+		return nil, fmt.Errorf("can't infer metric instrument: %w", err)
+	}
+	expr = unwrapParenExpr(expr)
 
-		attrKeys := make([]string, len(metric.Attrs))
-		for i, attr := range metric.Attrs {
-			attrKeys[i], _ = splitNameAlias(attr)
+	var funcName string
+	var args []ast.Expr
+	switch expr := expr.(type) {
+	case *ast.FuncCall:
+		funcName, args = expr.Func, expr.Args
+	case *ast.Name:
+		switch {
+		case expr.Func != "":
+			funcName = expr.Func
+		case cleanSpanAttrKey(expr.Name) == attrkey.SpanCount,
+			cleanSpanAttrKey(expr.Name) == attrkey.SpanErrorCount:
+			funcName = "sum"
 		}
+	}
 
-		if err := UpsertMetric(ctx, app, &Metric{
-			ProjectID:   project.ID,
-			Name:        metric.Name,
-			Description: metric.Description,
-			Unit:        bununit.FromString(metric.Unit),
-			Instrument:  Instrument(metric.Instrument),
-			AttrKeys:    attrKeys,
-		}); err != nil {
-			return err
+	spec, ok := spanMetricFuncs[funcName]
+	if !ok || spec.infer == "" {
+		return nil, fmt.Errorf(
+			"can't infer metric instrument from %q, set the instrument explicitly", metric.Value)
+	}
+
+	inferred := *metric
+	inferred.Instrument = string(spec.infer)
+	if spec.infer == InstrumentHistogram {
+		if funcName == "quantile" && len(args) == 2 {
+			// Histograms store all quantiles, so the level is only validated.
+			if _, err := parseQuantileLevel(args[0]); err != nil {
+				return nil, newCompileError("value", metric.Value, err)
+			}
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			return nil, fmt.Errorf("can't infer histogram value from %q", metric.Value)
 		}
+		inferred.Value = string(args[0].AppendString(nil))
 	}
-	return nil
+	return &inferred, nil
 }
 
-func createMatView(ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric) error {
-	conf := app.Config()
-	viewName := metric.ViewName()
+// spanMetricMaxWildcardAttrs limits the number of attrs a wildcard can expand to.
+const spanMetricMaxWildcardAttrs = 20
 
-	if _, err := app.CH.NewDropView().
-		IfExists().
-		View(viewName).
-		OnCluster(conf.CHSchema.Cluster).
-		Exec(ctx); err != nil {
-		return err
+// spanAttrCatalog returns the attribute keys that wildcard attrs are matched against.
+type spanAttrCatalog func(ctx context.Context) ([]string, error)
+
+func newSpanAttrCatalog(app *bunapp.App) spanAttrCatalog {
+	return func(ctx context.Context) ([]string, error) {
+		keys := make([]string, 0)
+		if err := app.CH.NewSelect().
+			ColumnExpr("groupUniqArrayArray(10000)(s.all_keys)").
+			TableExpr("?DB.spans_index AS s").
+			Where("s.time >= now() - INTERVAL 1 DAY").
+			Scan(ctx, &keys); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+}
+
+// expandSpanMetricAttrs returns a copy of the metric with wildcard attrs like `http.*`
+// replaced by the matching keys from the catalog. The expansion is fixed
+// when the view is created and does not pick up attributes that appear later.
+func expandSpanMetricAttrs(
+	ctx context.Context, metric *bunconf.SpanMetric, catalog spanAttrCatalog,
+) (*bunconf.SpanMetric, error) {
+	if !slices.ContainsFunc(metric.Attrs, isWildcardAttr) {
+		return metric, nil
 	}
 
-	valueExpr, err := compileSpanMetricValue(metric.Value)
+	keys, err := catalog(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("can't select attr keys: %w", err)
 	}
+	slices.Sort(keys)
 
-	q := app.CH.NewCreateView().
-		Materialized().
-		View(viewName).
-		OnCluster(conf.CHSchema.Cluster).
-		ToExpr("?DB.measure_minutes").
-		ColumnExpr("s.project_id").
-		ColumnExpr("? AS metric", metric.Name).
-		ColumnExpr("toStartOfMinute(s.time) AS time").
-		ColumnExpr("? AS instrument", metric.Instrument).
-		TableExpr("?DB.spans_index AS s").
-		GroupExpr("s.project_id, toStartOfMinute(s.time)")
+	attrs := make([]string, 0, len(metric.Attrs))
+	for _, attr := range metric.Attrs {
+		if !isWildcardAttr(attr) {
+			attrs = append(attrs, attr)
+			continue
+		}
 
-	if len(metric.Attrs) > 0 {
-		attrsExpr, aliases := compileSpanMetricAttrs(metric.Attrs)
-		q = q.
-			ColumnExpr("xxHash64(arrayStringConcat([?], '-')) AS attrs_hash", attrsExpr).
-			ColumnExpr("? AS string_keys", ch.Array(aliases)).
-			ColumnExpr("[?] AS string_values", attrsExpr).
-			GroupExpr(string(attrsExpr))
+		prefix := strings.TrimSuffix(attr, "*")
+		var matched int
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) || slices.Contains(attrs, key) {
+				continue
+			}
+			matched++
+			if matched > spanMetricMaxWildcardAttrs {
+				return nil, fmt.Errorf("attr %q matches more than %d keys",
+					attr, spanMetricMaxWildcardAttrs)
+			}
+			attrs = append(attrs, key)
+		}
 	}
 
-	if len(metric.Annotations) > 0 {
-		expr := compileSpanMetricAnnotations(metric.Annotations)
-		q = q.ColumnExpr("toJSONString(map(?)) AS annotations", expr)
+	expanded := *metric
+	expanded.Attrs = attrs
+	return &expanded, nil
+}
+
+// dedupeSpanMetricAttrs returns a copy of the metric without repeated attrs, which are
+// easy to get when the config is merged from several files, and the removed attrs.
+// Attrs stored under the same label with different expressions are an error.
+func dedupeSpanMetricAttrs(
+	metric *bunconf.SpanMetric,
+) (_ *bunconf.SpanMetric, dups []string, _ error) {
+	if len(metric.Attrs) < 2 {
+		return metric, nil, nil
 	}
 
-	if metric.Where != "" {
-		whereExpr, err := compileSpanMetricWhere(metric.Where)
-		if err != nil {
-			return err
+	exprs := make(map[string]string, len(metric.Attrs))
+	attrs := make([]string, 0, len(metric.Attrs))
+	for _, attr := range metric.Attrs {
+		expr, label := splitAttrLabel(strings.TrimSpace(attr))
+		expr = strings.TrimSpace(expr)
+
+		prev, ok := exprs[label]
+		if !ok {
+			exprs[label] = expr
+			attrs = append(attrs, attr)
+			continue
 		}
-		if whereExpr != "" {
-			q = q.Where(string(whereExpr))
+		if prev != expr {
+			return nil, nil, newCompileError("attrs", attr,
+				fmt.Errorf("attr %q is already defined as %q", label, prev))
 		}
+		dups = append(dups, attr)
 	}
 
-	switch Instrument(metric.Instrument) {
-	case InstrumentGauge:
-		q = q.ColumnExpr("? AS value", valueExpr)
-	case InstrumentAdditive:
-		q = q.ColumnExpr("? AS value", valueExpr)
-	case InstrumentCounter:
-		q = q.ColumnExpr("? AS sum", valueExpr)
-	case InstrumentHistogram:
-		q = q.ColumnExpr("count() AS count").
-			ColumnExpr("sum(?) AS sum", valueExpr).
-			ColumnExpr("quantilesBFloat16State(0.5)(toFloat32(?)) AS histogram", valueExpr)
-	default:
-		return fmt.Errorf("unsupported instrument: %q", metric.Instrument)
+	if len(dups) == 0 {
+		return metric, nil, nil
 	}
 
-	if _, err := q.Exec(ctx); err != nil {
-		return err
+	deduped := *metric
+	deduped.Attrs = attrs
+	return &deduped, dups, nil
+}
+
+func isWildcardAttr(attr string) bool {
+	return strings.HasSuffix(attr, ".*")
+}
+
+// spanMetricAttrKeys returns the label names under which the attrs are stored.
+func spanMetricAttrKeys(attrs []string) []string {
+	keys := make([]string, len(attrs))
+	for i, attr := range attrs {
+		_, keys[i] = splitAttrLabel(attr)
+	}
+	return keys
+}
+
+func createSpanMetricMeta(ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric) error {
+	unit, ok := bununit.NormalizeUnit(metric.Unit)
+	if !ok {
+		return fmt.Errorf("unknown metric unit %q, use a unit like milliseconds, bytes, "+
+			"or percents, or an annotation like {request}", metric.Unit)
 	}
 
+	projects := app.Config().Projects
+	for i := range projects {
+		project := &projects[i]
+
+		if err := UpsertMetric(
+			ctx, app, newSpanMetricMeta(app.Config(), metric, project.ID, unit),
+		); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func compileSpanMetricValue(value string) (ch.Safe, error) {
-	query := mql.Parse(value)
-	if len(query.Parts) != 1 {
-		return "", fmt.Errorf("can't parse metric value: %q", value)
+func newSpanMetricMeta(
+	conf *bunconf.Config, metric *bunconf.SpanMetric, projectID uint32, unit string,
+) *Metric {
+	return &Metric{
+		ProjectID:   projectID,
+		Name:        metric.Name,
+		Description: metric.Description,
+		Unit:        unit,
+		Instrument:  Instrument(metric.Instrument),
+		AttrKeys:    spanMetricMetaAttrKeys(metric),
+
+		ValueDescription:  metric.ValueDescription,
+		QuantileAlgorithm: metric.QuantileAlgorithm,
+		ViewName:          conf.SpanMetricViewName(metric.Name),
+		Service:           metric.Service,
+		RootOnly:          metric.RootOnly,
+		SampleRate:        spanMetricMetaSampleRate(metric),
+		BucketBounds:      spanMetricMetaBucketBounds(metric),
 	}
+}
 
-	part := query.Parts[0]
-	sel, ok := part.AST.(*ast.Selector)
-	if !ok {
-		return "", fmt.Errorf("unsupported metric value AST: %T", part.AST)
+func spanMetricMetaAttrKeys(metric *bunconf.SpanMetric) []string {
+	keys := spanMetricAttrKeys(metric.Attrs)
+	if metric.HistogramBuckets != nil {
+		keys = append(keys, spanMetricLe)
 	}
+	return keys
+}
 
-	var b []byte
-	b, err := appendSpanMetricExpr(b, sel.Expr.Expr)
-	if err != nil {
-		return "", err
+func spanMetricMetaBucketBounds(metric *bunconf.SpanMetric) []float64 {
+	if metric.HistogramBuckets == nil {
+		return nil
 	}
+	// The bounds are validated when the metric is compiled.
+	bounds, _ := spanMetricBucketBounds(metric.HistogramBuckets)
+	return bounds
+}
 
-	return ch.Safe(b), nil
+func spanMetricMetaSampleRate(metric *bunconf.SpanMetric) float64 {
+	if rate := metric.ScaleRate(); rate < 1 {
+		return rate
+	}
+	return 0
 }
 
-func appendSpanMetricExpr(b []byte, expr ast.Expr) (_ []byte, err error) {
-	switch expr := expr.(type) {
-	case *ast.Name:
-		b = tracing.AppendCHColumn(b, tql.Name{
-			FuncName: expr.Func,
-			AttrKey:  expr.Name,
-		}, spanMetricDur)
-		return b, nil
-	case *ast.Number:
-		b = append(b, expr.Text...)
-		return b, nil
-	case *ast.ParenExpr:
-		b = append(b, '(')
-		b, err = appendSpanMetricExpr(b, expr.Expr)
+// spanMetricExprs holds the compiled ClickHouse expressions of a span metric.
+type spanMetricExprs struct {
+	timeExpr ch.Safe
+	period   time.Duration
+
+	value       ch.Safe
+	weight      ch.Safe
+	denominator ch.Safe
+	attrs       ch.Safe
+	attrAliases []string
+	annotations ch.Safe
+	where       ch.Safe
+
+	// bucketBounds are the bounds of a fixed-bucket histogram labeled with the le attr.
+	bucketBounds []float64
+	// noQuantiles omits the histogram state when ClickHouse lacks the quantile state func.
+	noQuantiles bool
+	// selfDuration joins the spans with their children to compute span.self_duration.
+	selfDuration bool
+	// traceOffset joins the spans with the trace start time to compute span.trace_offset.
+	traceOffset bool
+	// errorDescendant joins the spans with the ancestors of error spans
+	// to compute span.has_error_descendant.
+	errorDescendant bool
+	// skipZeroDuration ignores spans with zero duration.
+	skipZeroDuration bool
+	// comment is the JSON metadata stored as the COMMENT of the view.
+	comment string
+}
+
+// compileSpanMetric compiles every metric field independently
+// and returns an error that reports all fields that failed to compile.
+func compileSpanMetric(metric *bunconf.SpanMetric) (*spanMetricExprs, error) {
+	exprs := new(spanMetricExprs)
+	var errs []error
+
+	var err error
+	exprs.timeExpr, exprs.period, err = spanMetricBucket(metric)
+	if err != nil {
+		errs = append(errs, err)
+		exprs.period = time.Minute
+	}
+
+	switch {
+	case Instrument(metric.Instrument) == InstrumentRatio:
+		exprs.value, exprs.denominator, err = compileSpanMetricRatio(metric, exprs.period)
+	case Instrument(metric.Instrument) == InstrumentWeightedAvg:
+		exprs.value, exprs.weight, err = compileSpanMetricWeightedAvg(metric, exprs.period)
+	case Instrument(metric.Instrument) == InstrumentApdex:
+		exprs.value, err = compileSpanMetricApdex(metric)
+	case metric.RelativeTo != "":
+		exprs.value, err = compileSpanMetricRelativeValue(metric)
+	case metric.RawValue != "":
+		exprs.value, err = compileSpanMetricRawValue(metric)
+	default:
+		exprs.value, err = compileSpanMetricValue(metric.Value, exprs.period)
+		if err == nil {
+			err = checkSpanMetricFuncInstruments(metric)
+		}
+		if err == nil {
+			err = checkSpanMetricValueType(metric)
+		}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if metric.Denominator != "" && Instrument(metric.Instrument) != InstrumentRatio {
+		errs = append(errs, newCompileError("denominator", metric.Denominator,
+			fmt.Errorf("denominator requires a ratio, got %q", metric.Instrument)))
+	}
+	if metric.Weight != "" && Instrument(metric.Instrument) != InstrumentWeightedAvg {
+		errs = append(errs, newCompileError("weight", metric.Weight,
+			fmt.Errorf("weight requires a weighted_avg, got %q", metric.Instrument)))
+	}
+	if err := validateSpanMetricSourceTable(metric); err != nil {
+		errs = append(errs, err)
+	}
+	if metric.ApdexThreshold != 0 && Instrument(metric.Instrument) != InstrumentApdex {
+		errs = append(errs, newCompileError("apdex_threshold", metric.ApdexThreshold.String(),
+			fmt.Errorf("apdex_threshold requires an apdex, got %q", metric.Instrument)))
+	}
+
+	switch {
+	case metric.Total && len(metric.Attrs) == 0:
+		errs = append(errs, newCompileError("total", "true", errors.New("total requires attrs")))
+	case metric.Total:
+		exprs.attrs, exprs.attrAliases, err = compileSpanMetricTotalAttrs(
+			metric.Attrs, exprs.period)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
 		}
-		b = append(b, ')')
-		return b, nil
-	case *ast.BinaryExpr:
-		b, err = appendSpanMetricExpr(b, expr.LHS)
+	case len(metric.Attrs) > 0:
+		exprs.attrs, exprs.attrAliases, err = compileSpanMetricAttrs(metric.Attrs, exprs.period)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
 		}
+	}
 
-		b = append(b, ' ')
-		b = append(b, expr.Op...)
-		b = append(b, ' ')
+	if metric.HistogramBuckets != nil {
+		if err := compileSpanMetricHistogramBuckets(metric, exprs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := validateSpanMetricOrderBy(metric); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateSpanMetricDeduplicate(metric); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateSpanMetricQuantileAlgorithm(metric); err != nil {
+		errs = append(errs, err)
+	}
 
-		b, err = appendSpanMetricExpr(b, expr.RHS)
+	exprs.skipZeroDuration, err = spanMetricSkipZeroDuration(metric, exprs.value)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(metric.Annotations) > 0 {
+		exprs.annotations, err = compileSpanMetricAnnotations(metric.Annotations, exprs.period)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
 		}
+	}
 
-		return b, nil
-	default:
-		return nil, fmt.Errorf("unsupported span metric expr: %T", expr)
+	if len(metric.Where) > 0 {
+		exprs.where, err = compileSpanMetricWhereList(
+			metric.Where, metric.ThresholdDict, exprs.period)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if metric.Service != "" {
+		exprs.where = andSpanMetricService(exprs.where, metric.Service)
+	}
+	if metric.RootOnly {
+		exprs.where = andSpanMetricRootOnly(exprs.where)
+	}
+
+	selfDuration := string(tracing.CHAttrExpr(attrkey.SpanSelfDuration))
+	traceOffset := string(tracing.CHAttrExpr(attrkey.SpanTraceOffset))
+	errorDescendant := string(tracing.CHAttrExpr(attrkey.SpanHasErrorDescendant))
+	for _, expr := range []ch.Safe{
+		exprs.value, exprs.denominator, exprs.attrs, exprs.annotations, exprs.where,
+	} {
+		if strings.Contains(string(expr), selfDuration) {
+			exprs.selfDuration = true
+		}
+		if strings.Contains(string(expr), traceOffset) {
+			exprs.traceOffset = true
+		}
+		if strings.Contains(string(expr), errorDescendant) {
+			exprs.errorDescendant = true
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
+	return exprs, nil
 }
 
-func compileSpanMetricAttrs(attrs []string) (ch.Safe, []string) {
-	var b []byte
-	aliases := make([]string, len(attrs))
-	for i, attr := range attrs {
-		attr, alias := splitNameAlias(attr)
-		aliases[i] = alias
+// checkSpanMetricAttrKeys returns warnings about where keys that are spelled differently
+// from the attrs that read the same column, or that are not known attributes.
+func checkSpanMetricAttrKeys(metric *bunconf.SpanMetric) []string {
+	if len(metric.Where) == 0 {
+		return nil
+	}
 
-		if i > 0 {
-			b = append(b, ", "...)
+	attrs := make(map[string]string, len(metric.Attrs))
+	for _, attr := range metric.Attrs {
+		key, _ := splitAttrLabel(attr)
+		if strings.Contains(key, "(") {
+			continue
 		}
+		attrs[canonicalAttrKey(key)] = key
+	}
 
-		b = append(b, "toString("...)
-		b = tracing.AppendCHAttrExpr(b, attr)
-		b = append(b, ")"...)
+	var warnings []string
+	for _, key := range spanMetricWhereKeys(metric.Where...) {
+		if attr, ok := attrs[canonicalAttrKey(key)]; ok {
+			if attr != key {
+				warnings = append(warnings, fmt.Sprintf(
+					"where uses %q, but attrs use %q for the same attribute", key, attr))
+			}
+			continue
+		}
+		if strings.HasPrefix(key, ".") || tracing.IsIndexedAttr(key) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf(
+			"where uses %q that is neither an indexed attribute nor one of the metric attrs", key))
 	}
-	return ch.Safe(b), aliases
+	return warnings
 }
 
-func compileSpanMetricAnnotations(attrs []string) ch.Safe {
-	var b []byte
-	for i, attr := range attrs {
-		attr, alias := splitNameAlias(attr)
+// canonicalAttrKey returns the key that differently spelled attr keys have in common,
+// for example, service_name and service.name.
+func canonicalAttrKey(key string) string {
+	key = attrkey.Clean(cleanSpanAttrKey(key))
+	return strings.ReplaceAll(key, "_", ".")
+}
 
-		if i > 0 {
-			b = append(b, ", "...)
+func spanMetricWhereKeys(conds ...string) []string {
+	var keys []string
+	for _, where := range conds {
+		expr, err := tql.ParseWhereExpr(where)
+		if err != nil {
+			continue
 		}
+		_ = expr.Walk(func(filter *tql.Filter) error {
+			if !slices.Contains(keys, filter.LHS.AttrKey) {
+				keys = append(keys, filter.LHS.AttrKey)
+			}
+			return nil
+		})
+	}
+	return keys
+}
 
-		b = chschema.AppendString(b, alias)
-		b = append(b, ", toString(any("...)
-		b = tracing.AppendCHAttrExpr(b, attr)
-		b = append(b, "))"...)
+// validateSpanMetricOrderBy rejects order_by, because metrics are written to the shared
+// measure_minutes table and its sort key can't be changed per metric.
+func validateSpanMetricOrderBy(metric *bunconf.SpanMetric) error {
+	if len(metric.OrderBy) == 0 {
+		return nil
 	}
-	return ch.Safe(b)
+	return newCompileError("order_by", strings.Join(metric.OrderBy, ", "),
+		errors.New("order_by is not supported: metrics are written to measure_minutes"))
+}
+
+// validateSpanMetricDeduplicate rejects deduplicate, because materialized views only see
+// the inserted block and can't tell whether a span was already counted in another block.
+func validateSpanMetricDeduplicate(metric *bunconf.SpanMetric) error {
+	if !metric.Deduplicate {
+		return nil
+	}
+	return newCompileError("deduplicate", "true",
+		errors.New("deduplicate is not supported: spans are counted once per insert"))
 }
 
-func compileSpanMetricWhere(query string) (ch.Safe, error) {
-	if !strings.HasPrefix(query, "where ") {
-		query = "where " + query
+// spanMetricBucket returns the expr that rounds span time down to the metric bucket
+// and the bucket duration.
+func spanMetricBucket(metric *bunconf.SpanMetric) (ch.Safe, time.Duration, error) {
+	var unit string
+	var expr ch.Safe
+	var period time.Duration
+
+	switch metric.BucketUnit {
+	case "", spanMetricBucketMinute:
+		unit, expr, period = spanMetricBucketMinute, "toStartOfMinute(s.time)", time.Minute
+	case spanMetricBucketHour:
+		unit, expr, period = spanMetricBucketHour, "toStartOfHour(s.time)", time.Hour
+	default:
+		return "", 0, fmt.Errorf("unsupported bucket_unit: %q", metric.BucketUnit)
 	}
 
-	parts := tql.Parse(query)
-	if len(parts) != 1 {
-		return "", fmt.Errorf("can't parse metric where: %q", query)
+	if metric.Timezone == "" {
+		return expr, period, nil
 	}
 
-	part := parts[0]
-	ast, ok := part.AST.(*tql.Where)
-	if !ok {
-		return "", fmt.Errorf("can't parse metric where: %q", query)
+	if _, err := time.LoadLocation(metric.Timezone); err != nil {
+		return "", 0, fmt.Errorf("invalid timezone %q: %w", metric.Timezone, err)
+	}
+
+	b := []byte("toStartOfInterval(s.time, INTERVAL 1 ")
+	b = append(b, unit...)
+	b = append(b, ", "...)
+	b = chschema.AppendString(b, metric.Timezone)
+	b = append(b, ')')
+	return ch.Safe(b), period, nil
+}
+
+func createMatView(
+	ctx context.Context,
+	app *bunapp.App,
+	metric *bunconf.SpanMetric,
+	exprs *spanMetricExprs,
+	exists bool,
+) (string, error) {
+	cluster := app.Config().CHSchema.Cluster
+	viewName := app.Config().SpanMetricViewName(metric.Name)
+
+	legacyName, ok := legacySpanMetricView(app.Config(), currentSpanMetrics(app), metric.Name)
+	if ok {
+		if err := dropSpanMetricView(ctx, app.CH, legacyName, cluster); err != nil {
+			return "", fmt.Errorf("can't drop legacy view %q: %w", legacyName, err)
+		}
+	}
+
+	var err error
+	exprs.comment, err = spanMetricViewComment(metric)
+	if err != nil {
+		return "", err
+	}
+
+	// Spans older than the view are only written by populate.
+	createdAt := time.Now()
+
+	swapped, err := execSpanMetricViewWithFallbacks(
+		ctx, app.Zap(ctx), app.CH, metric, viewName, cluster, exprs, exists)
+	if err != nil {
+		return "", err
+	}
+	if !metric.IsEnabled() {
+		return "", nil
+	}
+	if exists && !swapped {
+		app.Zap(ctx).Warn("EXCHANGE TABLES is not supported, "+
+			"the view was dropped and created again and may have missed some spans",
+			zap.String("metric", metric.Name))
 	}
 
-	where, having := tracing.AppendWhereHaving(ast, spanMetricDur)
-	if len(having) > 0 {
-		return "", fmt.Errorf("can't filter by agg columns: %q", having)
+	if metric.Populate {
+		backfill, clamped := clampSpanMetricBackfill(metric, app.Config().MaxBackfill)
+		if clamped {
+			app.Zap(ctx).Warn("span metric backfill exceeds max_backfill and is reduced",
+				zap.String("metric", metric.Name),
+				zap.Duration("backfill", metric.Backfill),
+				zap.Duration("max_backfill", backfill))
+		}
+
+		app.Zap(ctx).Warn("populating span metric from stored spans, "+
+			"this reads the spans_index table and can take a while",
+			zap.String("metric", metric.Name),
+			zap.Duration("backfill", backfill))
+
+		if err := populateSpanMetric(ctx, app.CH, metric, exprs, createdAt, backfill); err != nil {
+			return "", fmt.Errorf("populate failed: %w", err)
+		}
+	}
+
+	return viewName, nil
+}
+
+// legacySpanMetricView returns the view that older versions created for the metric
+// under a name without the hash. The view is kept when another metric now uses the name.
+func legacySpanMetricView(
+	conf *bunconf.Config, metrics []bunconf.SpanMetric, name string,
+) (string, bool) {
+	legacyName := conf.LegacySpanMetricViewName(name)
+	if legacyName == conf.SpanMetricViewName(name) {
+		return "", false
+	}
+	for i := range metrics {
+		if conf.SpanMetricViewName(metrics[i].Name) == legacyName {
+			return "", false
+		}
+	}
+	return legacyName, true
+}
+
+// spanMetricTempViewSuffix is appended to the view name while the updated view is created.
+const spanMetricTempViewSuffix = "_tmp"
+
+type chExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// execSpanMetricViewWithFallbacks creates the view of the metric and retries without
+// the features that older ClickHouse versions don't support.
+func execSpanMetricViewWithFallbacks(
+	ctx context.Context,
+	log otelzap.LoggerWithCtx,
+	db chExecer,
+	metric *bunconf.SpanMetric,
+	viewName string,
+	cluster string,
+	exprs *spanMetricExprs,
+	exists bool,
+) (bool, error) {
+	swapped, err := execSpanMetricView(ctx, db, metric, viewName, cluster, exprs, exists)
+	if err != nil && isSyntaxError(err) {
+		// Older ClickHouse versions don't support view comments.
+		log.Warn("view comments are not supported, "+
+			"the view is created without metadata",
+			zap.String("metric", metric.Name))
+
+		exprs.comment = ""
+		swapped, err = execSpanMetricView(ctx, db, metric, viewName, cluster, exprs, exists)
+	}
+	if err != nil {
+		if !isUnknownFuncError(err) ||
+			Instrument(metric.Instrument) != InstrumentHistogram || exprs.noQuantiles {
+			return false, err
+		}
+
+		// The histogram column type is fixed by the measure_minutes table,
+		// so the only fallback is to write counts and sums without percentiles.
+		_, stateFunc := spanMetricQuantileState(metric)
+		log.Warn(stateFunc+" is not available, "+
+			"histogram is created without percentiles",
+			zap.String("metric", metric.Name))
+
+		exprs.noQuantiles = true
+		return execSpanMetricView(ctx, db, metric, viewName, cluster, exprs, exists)
+	}
+	return swapped, nil
+}
+
+// execSpanMetricView creates the view of the metric. An existing view is replaced
+// by swapping it with a new view so there is no moment without a view. It reports
+// whether the view was swapped; when the database does not support EXCHANGE TABLES,
+// the view is dropped and created again instead.
+func execSpanMetricView(
+	ctx context.Context,
+	db chExecer,
+	metric *bunconf.SpanMetric,
+	viewName string,
+	cluster string,
+	exprs *spanMetricExprs,
+	exists bool,
+) (bool, error) {
+	if exists && metric.IsEnabled() {
+		err := swapSpanMetricView(ctx, db, metric, viewName, cluster, exprs)
+		if err == nil {
+			return true, nil
+		}
+		// Only a failed EXCHANGE falls back to dropping the view. Other errors,
+		// e.g. from creating the new view, leave the existing view in place.
+		var exchangeErr *unsupportedExchangeError
+		if !errors.As(err, &exchangeErr) {
+			return false, err
+		}
+	}
+
+	drop, create, err := buildSpanMetricQueries(metric, viewName, cluster, exprs)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := db.ExecContext(ctx, drop); err != nil {
+		return false, err
+	}
+	if create == "" {
+		return false, nil
+	}
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// swapSpanMetricView creates the new view under a temporary name, exchanges it with
+// the existing view, and drops the old view. Both views write data points between
+// creating the new view and dropping the old one, so spans inserted in that short
+// window are counted twice.
+func swapSpanMetricView(
+	ctx context.Context,
+	db chExecer,
+	metric *bunconf.SpanMetric,
+	viewName string,
+	cluster string,
+	exprs *spanMetricExprs,
+) error {
+	tempName := viewName + spanMetricTempViewSuffix
+
+	dropTemp, err := buildSpanMetricDropQuery(tempName, cluster)
+	if err != nil {
+		return err
+	}
+	create, err := buildSpanMetricCreateQuery(metric, tempName, cluster, exprs)
+	if err != nil {
+		return err
+	}
+
+	// Drop the view left by a failed swap.
+	if _, err := db.ExecContext(ctx, dropTemp); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, buildExchangeQuery(viewName, tempName, cluster)); err != nil {
+		if isUnsupportedExchangeError(err) {
+			err = &unsupportedExchangeError{err: err}
+		}
+		if _, dropErr := db.ExecContext(ctx, dropTemp); dropErr != nil {
+			return errors.Join(err, dropErr)
+		}
+		return err
+	}
+	// The temporary name now belongs to the old view.
+	if _, err := db.ExecContext(ctx, dropTemp); err != nil {
+		return err
+	}
+	return nil
+}
+
+func buildExchangeQuery(table1, table2, cluster string) string {
+	b := []byte("EXCHANGE TABLES ")
+	b = appendSpanMetricViewIdent(b, table1)
+	b = append(b, " AND "...)
+	b = appendSpanMetricViewIdent(b, table2)
+	if cluster != "" {
+		b = append(b, " ON CLUSTER "...)
+		b = chschema.AppendIdent(b, cluster)
+	}
+	return string(b)
+}
+
+const (
+	// chNotImplemented is returned by EXCHANGE TABLES for databases with the Ordinary engine.
+	chNotImplemented = 48
+	// chSyntaxError is returned by ClickHouse versions without EXCHANGE TABLES
+	// or view comments.
+	chSyntaxError = 62
+)
+
+// unsupportedExchangeError is returned by swapSpanMetricView when EXCHANGE TABLES
+// is not supported by the database.
+type unsupportedExchangeError struct {
+	err error
+}
+
+func (e *unsupportedExchangeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unsupportedExchangeError) Unwrap() error {
+	return e.err
+}
+
+func isUnsupportedExchangeError(err error) bool {
+	var cherr *ch.Error
+	return errors.As(err, &cherr) &&
+		(cherr.Code == chNotImplemented || cherr.Code == chSyntaxError)
+}
+
+// spanMetricBackfillChunk is the time range of spans inserted by one populate query.
+const spanMetricBackfillChunk = time.Hour
+
+// clampSpanMetricBackfill returns the backfill period of the metric limited by maxBackfill
+// and reports whether it was reduced. Zero means all stored spans.
+func clampSpanMetricBackfill(
+	metric *bunconf.SpanMetric, maxBackfill time.Duration,
+) (time.Duration, bool) {
+	if maxBackfill <= 0 {
+		return metric.Backfill, false
+	}
+	if metric.Backfill <= 0 || metric.Backfill > maxBackfill {
+		return maxBackfill, true
+	}
+	return metric.Backfill, false
+}
+
+// populateSpanMetric inserts the metric data points for the spans stored during
+// the backfill period before the view was created. The period is inserted in chunks
+// so the inserted chunks are kept when the context is canceled.
+func populateSpanMetric(
+	ctx context.Context,
+	db chExecer,
+	metric *bunconf.SpanMetric,
+	exprs *spanMetricExprs,
+	before time.Time,
+	backfill time.Duration,
+) error {
+	if backfill <= 0 {
+		query, err := buildSpanMetricPopulateQuery(metric, exprs, time.Time{}, before)
+		if err != nil {
+			return err
+		}
+		if query == "" {
+			return nil
+		}
+		_, err = db.ExecContext(ctx, query)
+		return err
+	}
+
+	for from := before.Add(-backfill); from.Before(before); {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("populate stopped before %s: %w", from.UTC(), err)
+		}
+
+		to := from.Add(spanMetricBackfillChunk)
+		if to.After(before) {
+			to = before
+		}
+
+		query, err := buildSpanMetricPopulateQuery(metric, exprs, from, to)
+		if err != nil {
+			return err
+		}
+		if query == "" {
+			return nil
+		}
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+
+		from = to
+	}
+	return nil
+}
+
+// buildSpanMetricPopulateQuery returns the query that inserts the metric data points
+// for the spans stored between from and to. ClickHouse does not support POPULATE
+// for views with a TO table, so the view select is inserted explicitly.
+// A zero from selects all spans before to.
+// The query is empty unless the metric enables populate.
+func buildSpanMetricPopulateQuery(
+	metric *bunconf.SpanMetric, exprs *spanMetricExprs, from, to time.Time,
+) (string, error) {
+	if !metric.Populate || !metric.IsEnabled() {
+		return "", nil
+	}
+
+	q, err := newSpanMetricSelect(metric, exprs)
+	if err != nil {
+		return "", err
+	}
+	if !from.IsZero() {
+		q = q.Where("s.time >= toDateTime(?)", from.Unix())
+	}
+	q = q.Where("s.time < toDateTime(?)", to.Unix())
+
+	b := []byte("INSERT INTO ?DB.measure_minutes (")
+	for i, col := range spanMetricViewColumns(metric, exprs) {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = append(b, col...)
+	}
+	b = append(b, ") "...)
+
+	b, err = appendSpanMetricSelect(b, q)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// spanMetricViewColumns returns the names of the columns selected by newSpanMetricSelect
+// in the same order.
+func spanMetricViewColumns(metric *bunconf.SpanMetric, exprs *spanMetricExprs) []string {
+	cols := []string{"project_id", "metric", "time", "instrument"}
+	if exprs.attrs != "" {
+		cols = append(cols, "attrs_hash", "string_keys", "string_values")
+	}
+	if exprs.annotations != "" {
+		cols = append(cols, "annotations")
+	}
+
+	switch Instrument(metric.Instrument) {
+	case InstrumentGauge, InstrumentAdditive:
+		cols = append(cols, "gauge")
+	case InstrumentCounter:
+		cols = append(cols, "sum")
+	case InstrumentHistogram:
+		cols = append(cols, "count", "sum")
+		if !exprs.noQuantiles {
+			column, _ := spanMetricQuantileState(metric)
+			cols = append(cols, column)
+		}
+	case InstrumentRatio, InstrumentWeightedAvg, InstrumentApdex:
+		cols = append(cols, "count", "sum")
+	}
+	return cols
+}
+
+// chUnknownFunction is the ClickHouse UNKNOWN_FUNCTION error code.
+const chUnknownFunction = 46
+
+func isUnknownFuncError(err error) bool {
+	var cherr *ch.Error
+	return errors.As(err, &cherr) && cherr.Code == chUnknownFunction
+}
+
+func isSyntaxError(err error) bool {
+	var cherr *ch.Error
+	return errors.As(err, &cherr) && cherr.Code == chSyntaxError
+}
+
+// spanMetricViewMeta is stored as the COMMENT of the materialized view, so operators
+// and tooling can map the view back to the metric and its config.
+type spanMetricViewMeta struct {
+	Metric     string `json:"metric"`
+	ConfigHash string `json:"configHash"`
+	Version    string `json:"version"`
+}
+
+func spanMetricViewComment(metric *bunconf.SpanMetric) (string, error) {
+	hash, err := spanMetricHash(metric)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(&spanMetricViewMeta{
+		Metric:     metric.Name,
+		ConfigHash: fmt.Sprintf("%016x", hash),
+		Version:    pkg.Version(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// BuildSpanMetricQueries returns the queries that drop and create the materialized view
+// of the span metric without connecting to ClickHouse. The database is referenced as ?DB.
+// The create query is empty when the metric is disabled.
+func BuildSpanMetricQueries(
+	conf *bunconf.Config, metric *bunconf.SpanMetric,
+) (drop, create string, err error) {
+	metric, err = inferSpanMetricInstrument(metric)
+	if err != nil {
+		return "", "", err
+	}
+	metric, _, err = dedupeSpanMetricAttrs(metric)
+	if err != nil {
+		return "", "", err
+	}
+
+	exprs, err := compileSpanMetric(metric)
+	if err != nil {
+		return "", "", err
+	}
+	return buildSpanMetricQueries(
+		metric, conf.SpanMetricViewName(metric.Name), conf.CHSchema.Cluster, exprs)
+}
+
+func buildSpanMetricQueries(
+	metric *bunconf.SpanMetric, viewName, cluster string, exprs *spanMetricExprs,
+) (drop, create string, err error) {
+	drop, err = buildSpanMetricDropQuery(viewName, cluster)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !metric.IsEnabled() {
+		return drop, "", nil
+	}
+
+	create, err = buildSpanMetricCreateQuery(metric, viewName, cluster, exprs)
+	if err != nil {
+		return "", "", err
+	}
+
+	return drop, create, nil
+}
+
+func buildSpanMetricDropQuery(viewName, cluster string) (string, error) {
+	b := []byte("DROP VIEW IF EXISTS ")
+	b = appendSpanMetricViewIdent(b, viewName)
+	if cluster != "" {
+		b = append(b, " ON CLUSTER "...)
+		b = chschema.AppendIdent(b, cluster)
+	}
+	return string(b), nil
+}
+
+// appendSpanMetricViewIdent appends the view name qualified with ?DB, like the tables
+// the view reads and writes, so the view is created in the same database as them.
+func appendSpanMetricViewIdent(b []byte, viewName string) []byte {
+	b = append(b, "?DB."...)
+	return chschema.AppendIdent(b, viewName)
+}
+
+func buildSpanMetricCreateQuery(
+	metric *bunconf.SpanMetric, viewName, cluster string, exprs *spanMetricExprs,
+) (string, error) {
+	q, err := newSpanMetricSelect(metric, exprs)
+	if err != nil {
+		return "", err
+	}
+
+	b := []byte("CREATE MATERIALIZED VIEW ")
+	b = appendSpanMetricViewIdent(b, viewName)
+	if cluster != "" {
+		b = append(b, " ON CLUSTER "...)
+		b = chschema.AppendIdent(b, cluster)
+	}
+	b = append(b, " TO ?DB.measure_minutes AS "...)
+
+	b, err = appendSpanMetricSelect(b, q)
+	if err != nil {
+		return "", err
+	}
+	if exprs.comment != "" {
+		b = append(b, " COMMENT "...)
+		b = appendCHEscapedString(b, exprs.comment)
+	}
+	return string(b), nil
+}
+
+// appendSpanMetricSelect appends the select of the span metric view. The same select
+// is used by the view, populate, preview, and cardinality queries.
+func appendSpanMetricSelect(b []byte, q *ch.SelectQuery) ([]byte, error) {
+	return q.AppendQuery(chschema.NewFormatter(), b)
+}
+
+// spanMetricSkipZero returns the HAVING condition that skips the zero data points.
+func spanMetricSkipZero(metric *bunconf.SpanMetric) (string, error) {
+	switch Instrument(metric.Instrument) {
+	case InstrumentCounter:
+		return "sum != 0", nil
+	case InstrumentHistogram, InstrumentRatio, InstrumentWeightedAvg, InstrumentApdex:
+		return "count != 0", nil
+	default:
+		return "", fmt.Errorf(
+			"skip_zero requires a counter, histogram, ratio, weighted_avg, or apdex, got %q",
+			metric.Instrument)
+	}
+}
+
+// newSpanMetricSelect returns the select of the span metric view.
+func newSpanMetricSelect(
+	metric *bunconf.SpanMetric, exprs *spanMetricExprs,
+) (*ch.SelectQuery, error) {
+	valueExpr := exprs.value
+
+	q := ch.NewSelectQuery(nil).
+		ColumnExpr("s.project_id").
+		ColumnExpr("? AS metric", metric.Name).
+		ColumnExpr("? AS time", exprs.timeExpr).
+		ColumnExpr("? AS instrument", metric.Instrument).
+		GroupExpr("s.project_id, ?", exprs.timeExpr)
+
+	q = q.TableExpr(spanMetricTableExpr(metric, exprs, true))
+
+	if exprs.attrs != "" {
+		q = q.
+			ColumnExpr("xxHash64(arrayStringConcat([?], '-')) AS attrs_hash", exprs.attrs).
+			ColumnExpr("? AS string_keys", ch.Array(exprs.attrAliases)).
+			ColumnExpr("[?] AS string_values", exprs.attrs).
+			GroupExpr(string(exprs.attrs))
+	}
+
+	if exprs.annotations != "" {
+		q = q.ColumnExpr("toJSONString(map(?)) AS annotations", exprs.annotations)
+	}
+
+	if exprs.where != "" {
+		q = q.Where(string(exprs.where))
+	}
+
+	if exprs.skipZeroDuration {
+		q = q.Where("? > 0", tracing.CHAttrExpr(attrkey.SpanDuration))
+	}
+
+	if metric.IsSampled() {
+		q = q.Where("cityHash64(s.trace_id) % ? < ?",
+			spanMetricSampleBase, uint64(metric.SampleRate*spanMetricSampleBase))
+	}
+
+	if metric.SkipZero {
+		having, err := spanMetricSkipZero(metric)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Having(having)
+	}
+
+	switch Instrument(metric.Instrument) {
+	case InstrumentGauge:
+		q = q.ColumnExpr("? AS gauge", valueExpr)
+	case InstrumentAdditive:
+		q = q.ColumnExpr("? AS gauge", valueExpr)
+	case InstrumentCounter:
+		q = q.ColumnExpr("? AS sum", scaleSpanMetricExpr(valueExpr, metric))
+	case InstrumentHistogram:
+		if len(exprs.bucketBounds) > 0 {
+			// The spans are duplicated for every bound, so each row counts
+			// the values less than or equal to its bound.
+			countExpr := ch.Safe(chschema.AppendQuery(nil, "countIf(? <= le)", valueExpr))
+			sumExpr := ch.Safe(chschema.AppendQuery(nil, "sumIf(?, ? <= le)", valueExpr, valueExpr))
+			q = q.ColumnExpr("toUInt64(?) AS count", scaleSpanMetricExpr(countExpr, metric)).
+				ColumnExpr("? AS sum", scaleSpanMetricExpr(sumExpr, metric))
+			break
+		}
+		sumExpr := ch.Safe(chschema.AppendQuery(nil, "sum(?)", valueExpr))
+		q = q.ColumnExpr("toUInt64(?) AS count", scaleSpanMetricExpr("count()", metric)).
+			ColumnExpr("? AS sum", scaleSpanMetricExpr(sumExpr, metric))
+		if !exprs.noQuantiles {
+			column, stateFunc := spanMetricQuantileState(metric)
+			q = q.ColumnExpr(stateFunc+"(0.5)(toFloat32(?)) AS "+column, valueExpr)
+		}
+	case InstrumentRatio:
+		// The numerator and the denominator are stored separately
+		// and divided only after all rows are summed when querying.
+		countExpr := ch.Safe("count()")
+		if exprs.denominator != "" {
+			countExpr = ch.Safe(chschema.AppendQuery(nil, "countIf(?)", exprs.denominator))
+		}
+		q = q.ColumnExpr("toUInt64(?) AS count", scaleSpanMetricExpr(countExpr, metric)).
+			ColumnExpr("? AS sum", scaleSpanMetricExpr(
+				ch.Safe(chschema.AppendQuery(nil, "countIf(?)", valueExpr)), metric))
+	case InstrumentWeightedAvg:
+		// The reader divides sum by count, so the average is weighted correctly
+		// across time buckets and attrs. The count column is an integer,
+		// so the sum of the weights is rounded.
+		countExpr := ch.Safe("count()")
+		sumExpr := ch.Safe(chschema.AppendQuery(nil, "sum(?)", valueExpr))
+		if exprs.weight != "" {
+			countExpr = ch.Safe(chschema.AppendQuery(nil, "round(sum(?))", exprs.weight))
+			sumExpr = ch.Safe(chschema.AppendQuery(nil, "sum((?) * (?))", valueExpr, exprs.weight))
+		}
+		q = q.ColumnExpr("toUInt64(?) AS count", scaleSpanMetricExpr(countExpr, metric)).
+			ColumnExpr("? AS sum", scaleSpanMetricExpr(sumExpr, metric))
+	case InstrumentApdex:
+		// The score is (satisfied + tolerated / 2) / count. Spans faster than 4T
+		// include the satisfied ones, so the reader divides sum by 2 * count.
+		q = q.ColumnExpr("toUInt64(?) AS count", scaleSpanMetricExpr("count()", metric)).
+			ColumnExpr("? AS sum", scaleSpanMetricExpr(valueExpr, metric))
+	default:
+		return nil, fmt.Errorf("unsupported instrument: %q", metric.Instrument)
+	}
+
+	return q, nil
+}
+
+// spanMetricTableExpr returns the spans the metric reads with the joins required by
+// its exprs. arrayJoin duplicates every span for the total of the attrs
+// and for the bounds of fixed-bucket histograms.
+func spanMetricTableExpr(
+	metric *bunconf.SpanMetric, exprs *spanMetricExprs, arrayJoin bool,
+) string {
+	tableExpr := "?DB.spans_index"
+	if metric.SourceTable != "" {
+		tableExpr = "?DB." + string(chschema.AppendIdent(nil, metric.SourceTable))
+	}
+	tableExpr += " AS s"
+	if exprs.selfDuration {
+		// Children inserted after the parent span are not subtracted.
+		tableExpr = "(SELECT s.*, greatest(s.duration - children.duration, 0) AS self_duration" +
+			" FROM " + tableExpr + " LEFT JOIN (SELECT trace_id, parent_id," +
+			" sum(duration) AS duration FROM ?DB.spans_index" +
+			" WHERE parent_id != 0 AND time >= now() - INTERVAL 1 HOUR" +
+			" GROUP BY trace_id, parent_id) AS children" +
+			" ON children.trace_id = s.trace_id AND children.parent_id = s.id) AS s"
+	}
+	if exprs.traceOffset {
+		// The join only sees the spans stored before the inserted block, so the span
+		// itself is the start of the trace when its trace has no stored spans yet.
+		// spans_index stores time in seconds, so the offset has second resolution.
+		tableExpr = "(SELECT s.*, (toInt64(s.time) - toInt64(if(trace.start_time = toDateTime(0)," +
+			" s.time, least(trace.start_time, s.time)))) * 1000000000 AS trace_offset" +
+			" FROM " + tableExpr + " LEFT JOIN (SELECT trace_id, min(time) AS start_time" +
+			" FROM ?DB.spans_index WHERE time >= now() - INTERVAL 1 HOUR" +
+			" GROUP BY trace_id) AS trace ON trace.trace_id = s.trace_id) AS s"
+	}
+	if exprs.errorDescendant {
+		tableExpr = "(SELECT s.*, has(descendants.error_ancestors, s.id) AS has_error_descendant" +
+			" FROM " + tableExpr + " LEFT JOIN " + spanMetricErrorAncestors() +
+			" AS descendants ON descendants.trace_id = s.trace_id) AS s"
+	}
+	if arrayJoin && metric.Total && exprs.attrs != "" {
+		// Every span is aggregated twice: once by the attrs and once into the total.
+		tableExpr += " ARRAY JOIN [0, 1] AS is_total"
+	}
+	if arrayJoin && len(exprs.bucketBounds) > 0 {
+		tableExpr += " ARRAY JOIN " + spanMetricBucketBoundsArray(exprs.bucketBounds) + " AS le"
+	}
+	if metric.RelativeTo == spanMetricRelativeToRoot {
+		// The inner join drops spans whose root is not inserted yet or has no duration.
+		tableExpr += " INNER JOIN (SELECT trace_id, duration FROM ?DB.spans_index" +
+			" WHERE parent_id = 0 AND duration > 0 AND time >= now() - INTERVAL 1 HOUR" +
+			" LIMIT 1 BY trace_id) AS root ON root.trace_id = s.trace_id"
+	}
+	return tableExpr
+}
+
+// spanMetricErrorDescendantDepth is how many levels above an error span
+// span.has_error_descendant looks for ancestors.
+const spanMetricErrorDescendantDepth = 8
+
+// spanMetricErrorAncestors selects the ids of the ancestors of error spans in every
+// trace with errors. ClickHouse has no recursive queries, so the parents are looked up
+// level by level in the arrays of the trace, up to spanMetricErrorDescendantDepth levels.
+// Only the spans stored during the last hour before the inserted block are seen.
+func spanMetricErrorAncestors() string {
+	b := []byte("(SELECT trace_id, arrayFilter(x -> x != 0, arrayDistinct(arrayConcat(")
+	for i := 1; i <= spanMetricErrorDescendantDepth; i++ {
+		if i > 1 {
+			b = append(b, ", "...)
+		}
+		b = append(b, "level"...)
+		b = strconv.AppendInt(b, int64(i), 10)
+	}
+	b = append(b, "))) AS error_ancestors FROM (SELECT trace_id,"+
+		" groupArray(id) AS ids, groupArray(parent_id) AS parents,"+
+		" arrayFilter((p, c) -> c = 'error' AND p != 0, parents, groupArray(status_code)) AS level1"...)
+	for i := 2; i <= spanMetricErrorDescendantDepth; i++ {
+		b = append(b, ", arrayMap(x -> parents[indexOf(ids, x)], level"...)
+		b = strconv.AppendInt(b, int64(i-1), 10)
+		b = append(b, ") AS level"...)
+		b = strconv.AppendInt(b, int64(i), 10)
+	}
+	b = append(b, " FROM ?DB.spans_index WHERE time >= now() - INTERVAL 1 HOUR"+
+		" GROUP BY trace_id HAVING countIf(status_code = 'error') > 0))"...)
+	return string(b)
+}
+
+// scaleSpanMetricExpr extrapolates a sampled count or sum to the full population.
+func scaleSpanMetricExpr(expr ch.Safe, metric *bunconf.SpanMetric) ch.Safe {
+	rate := metric.ScaleRate()
+	if rate == 1 {
+		return expr
+	}
+	return ch.Safe(chschema.AppendQuery(nil, "(?) / ?", expr, rate))
+}
+
+var spanMetricSourceTableRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateSpanMetricSourceTable(metric *bunconf.SpanMetric) error {
+	if metric.SourceTable != "" && !spanMetricSourceTableRE.MatchString(metric.SourceTable) {
+		return newCompileError("source_table", metric.SourceTable,
+			errors.New("source table must be a table name in the ClickHouse database"))
+	}
+	if metric.SourceSampleRate < 0 || metric.SourceSampleRate > 1 {
+		return newCompileError("source_sample_rate", fmt.Sprint(metric.SourceSampleRate),
+			errors.New("source sample rate must be between 0 and 1"))
+	}
+	if metric.SourceSampleRate != 0 && metric.SourceTable == "" {
+		return newCompileError("source_sample_rate", fmt.Sprint(metric.SourceSampleRate),
+			errors.New("source sample rate requires a source table"))
+	}
+	return nil
+}
+
+// checkSpanMetricSourceTable checks that the source table has all columns of spans_index,
+// because the view can use any of them.
+func checkSpanMetricSourceTable(
+	ctx context.Context, db chRowScanner, database, table string,
+) error {
+	b := []byte("SELECT arrayStringConcat(groupArray(name), ', ') FROM system.columns" +
+		" WHERE database = ")
+	b = appendCHEscapedString(b, database)
+	b = append(b, " AND table = 'spans_index' AND name NOT IN"+
+		" (SELECT name FROM system.columns WHERE database = "...)
+	b = appendCHEscapedString(b, database)
+	b = append(b, " AND table = "...)
+	b = appendCHEscapedString(b, table)
+	b = append(b, ')')
+
+	var missing string
+	if err := db.scanRow(ctx, string(b), &missing); err != nil {
+		return fmt.Errorf("can't check source table %q: %w", table, err)
+	}
+	if missing != "" {
+		return fmt.Errorf("source table %q lacks spans_index columns: %s", table, missing)
+	}
+	return nil
+}
+
+// checkSpanMetricTargetColumns checks that measure_minutes has every column the view
+// of the metric writes, so a schema mismatch is reported before the view is created
+// instead of as a ClickHouse error about a missing column.
+func checkSpanMetricTargetColumns(
+	ctx context.Context,
+	db chRowScanner,
+	database string,
+	metric *bunconf.SpanMetric,
+	exprs *spanMetricExprs,
+) error {
+	b := []byte("SELECT arrayStringConcat(groupArray(name), ',') FROM system.columns" +
+		" WHERE database = ")
+	b = appendCHEscapedString(b, database)
+	b = append(b, " AND table = 'measure_minutes'"...)
+
+	var names string
+	if err := db.scanRow(ctx, string(b), &names); err != nil {
+		return fmt.Errorf("can't check columns of measure_minutes: %w", err)
+	}
+	columns := strings.Split(names, ",")
+
+	var missing []string
+	for _, col := range spanMetricViewColumns(metric, exprs) {
+		if !slices.Contains(columns, col) {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("span metric %q writes columns that measure_minutes lacks: %s",
+			metric.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CompileError is returned when a field of a span metric can't be compiled.
+type CompileError struct {
+	// Field is the config field, for example, value, attrs, annotations, or where.
+	Field string
+	// Expr is the expression that failed to compile.
+	Expr string
+	// Pos is the byte offset of the error in Expr or -1 when it is unknown.
+	Pos int
+	Err error
+}
+
+func newCompileError(field, expr string, err error) *CompileError {
+	pos := -1
+	var syntaxErr *ast.SyntaxError
+	var charErr *ast.InvalidCharError
+	switch {
+	case errors.As(err, &syntaxErr):
+		pos = syntaxErr.Pos
+	case errors.As(err, &charErr):
+		pos = charErr.Pos
+	}
+	return &CompileError{
+		Field: field,
+		Expr:  expr,
+		Pos:   pos,
+		Err:   err,
+	}
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Expr, e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// compileSpanMetricRelativeValue returns the span duration as a fraction of the duration
+// of the span the metric is relative to.
+func compileSpanMetricRelativeValue(metric *bunconf.SpanMetric) (ch.Safe, error) {
+	if metric.RelativeTo != spanMetricRelativeToRoot {
+		return "", newCompileError("relative_to", metric.RelativeTo,
+			errors.New("only root is supported"))
+	}
+	if metric.Value != "" || metric.RawValue != "" {
+		return "", newCompileError("value", metric.Value+metric.RawValue,
+			errors.New("value can't be used together with relative_to"))
+	}
+	if Instrument(metric.Instrument) != InstrumentHistogram {
+		return "", newCompileError("relative_to", metric.RelativeTo,
+			fmt.Errorf("relative_to requires a histogram, got %q", metric.Instrument))
+	}
+	return "s.duration / root.duration", nil
+}
+
+const (
+	// QuantileBFloat16 stores histogram percentiles with quantilesBFloat16,
+	// which is compact but only keeps 8 bits of precision.
+	QuantileBFloat16 = "bfloat16"
+	// QuantileTDigest stores histogram percentiles with quantilesTDigest,
+	// which is more accurate for tail percentiles and takes more space.
+	QuantileTDigest = "tdigest"
+)
+
+func validateSpanMetricQuantileAlgorithm(metric *bunconf.SpanMetric) error {
+	switch metric.QuantileAlgorithm {
+	case "":
+		return nil
+	case QuantileBFloat16, QuantileTDigest:
+	default:
+		return newCompileError("quantile_algorithm", metric.QuantileAlgorithm,
+			fmt.Errorf("must be %s or %s", QuantileBFloat16, QuantileTDigest))
+	}
+	if Instrument(metric.Instrument) != InstrumentHistogram {
+		return newCompileError("quantile_algorithm", metric.QuantileAlgorithm,
+			fmt.Errorf("quantile_algorithm requires a histogram, got %q", metric.Instrument))
+	}
+	return nil
+}
+
+// spanMetricSkipZeroDuration reports whether spans with zero duration are ignored.
+// By default, they are ignored by histograms of span.duration, because incomplete spans
+// with zero duration skew the percentiles.
+func spanMetricSkipZeroDuration(metric *bunconf.SpanMetric, value ch.Safe) (bool, error) {
+	switch metric.ZeroDuration {
+	case spanMetricZeroDurationSkip:
+		return true, nil
+	case spanMetricZeroDurationInclude:
+		return false, nil
+	case "":
+		return Instrument(metric.Instrument) == InstrumentHistogram &&
+			strings.Contains(string(value), string(tracing.CHAttrExpr(attrkey.SpanDuration))), nil
+	default:
+		return false, newCompileError("zero_duration", metric.ZeroDuration,
+			fmt.Errorf("must be %s or %s", spanMetricZeroDurationSkip, spanMetricZeroDurationInclude))
+	}
+}
+
+// spanMetricLe is the attr that labels the bounds of fixed-bucket histograms.
+const spanMetricLe = "le"
+
+// spanMetricMaxBuckets limits how many rows fixed-bucket histograms duplicate every span into.
+const spanMetricMaxBuckets = 64
+
+// compileSpanMetricHistogramBuckets appends the le attr to the attrs of a fixed-bucket
+// histogram. The histogram stores counts per bound instead of the quantile state.
+func compileSpanMetricHistogramBuckets(metric *bunconf.SpanMetric, exprs *spanMetricExprs) error {
+	if Instrument(metric.Instrument) != InstrumentHistogram {
+		return newCompileError("histogram_buckets", "",
+			fmt.Errorf("histogram_buckets requires a histogram, got %q", metric.Instrument))
+	}
+	if slices.Contains(exprs.attrAliases, spanMetricLe) {
+		return newCompileError("histogram_buckets", "",
+			fmt.Errorf("histogram_buckets conflicts with the attr %q", spanMetricLe))
+	}
+
+	bounds, err := spanMetricBucketBounds(metric.HistogramBuckets)
+	if err != nil {
+		return newCompileError("histogram_buckets", "", err)
+	}
+	exprs.bucketBounds = bounds
+	exprs.noQuantiles = true
+
+	if exprs.attrs != "" {
+		exprs.attrs += ", "
+	}
+	exprs.attrs += "if(isInfinite(le), '+Inf', toString(le))"
+	exprs.attrAliases = append(exprs.attrAliases, spanMetricLe)
+	return nil
+}
+
+// spanMetricBucketBounds returns the bounds of fixed histogram buckets.
+// The bounds must be positive and ascending.
+func spanMetricBucketBounds(buckets *bunconf.HistogramBuckets) ([]float64, error) {
+	var bounds []float64
+	var specs int
+
+	if len(buckets.Bounds) > 0 {
+		specs++
+		bounds = buckets.Bounds
+	}
+	if linear := buckets.Linear; linear != nil {
+		specs++
+		if linear.Width <= 0 {
+			return nil, fmt.Errorf("linear width must be positive, got %v", linear.Width)
+		}
+		if linear.Count <= 0 || linear.Count > spanMetricMaxBuckets {
+			return nil, fmt.Errorf("linear count must be between 1 and %d, got %d",
+				spanMetricMaxBuckets, linear.Count)
+		}
+		for i := 0; i < linear.Count; i++ {
+			bounds = append(bounds, linear.Start+float64(i)*linear.Width)
+		}
+	}
+	if exp := buckets.Exponential; exp != nil {
+		specs++
+		if exp.Factor <= 1 {
+			return nil, fmt.Errorf("exponential factor must be greater than 1, got %v", exp.Factor)
+		}
+		if exp.Count <= 0 || exp.Count > spanMetricMaxBuckets {
+			return nil, fmt.Errorf("exponential count must be between 1 and %d, got %d",
+				spanMetricMaxBuckets, exp.Count)
+		}
+		bound := exp.Start
+		for i := 0; i < exp.Count; i++ {
+			bounds = append(bounds, bound)
+			bound *= exp.Factor
+		}
+	}
+
+	switch {
+	case specs == 0:
+		return nil, errors.New("histogram_buckets requires bounds, linear, or exponential")
+	case specs > 1:
+		return nil, errors.New("histogram_buckets accepts only one of bounds, linear, or exponential")
+	case len(bounds) > spanMetricMaxBuckets:
+		return nil, fmt.Errorf("histogram_buckets supports up to %d bounds, got %d",
+			spanMetricMaxBuckets, len(bounds))
+	}
+
+	for i, bound := range bounds {
+		if !(bound > 0) || math.IsInf(bound, 0) {
+			return nil, fmt.Errorf("bucket bounds must be positive, got %v", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return nil, errors.New("bucket bounds must be ascending")
+		}
+	}
+	return bounds, nil
+}
+
+// spanMetricBucketBoundsArray returns the ClickHouse array of the bounds with
+// the +Inf bound that counts all values.
+func spanMetricBucketBoundsArray(bounds []float64) string {
+	b := []byte("[")
+	for _, bound := range bounds {
+		b = strconv.AppendFloat(b, bound, 'f', -1, 64)
+		b = append(b, ", "...)
+	}
+	b = append(b, "inf]"...)
+	return string(b)
+}
+
+// spanMetricQuantileState returns the measure_minutes column that stores histogram
+// percentiles for the quantile algorithm of the metric and the func that writes it.
+// The state has no precision parameter: ClickHouse tdigest uses a fixed compression,
+// and the column type fixes the state parameters to the 0.5 level.
+func spanMetricQuantileState(metric *bunconf.SpanMetric) (column, stateFunc string) {
+	if metric.QuantileAlgorithm == QuantileTDigest {
+		return "tdigest", "quantilesTDigestState"
+	}
+	return "histogram", "quantilesBFloat16State"
+}
+
+// compileSpanMetricRatio compiles the where conditions of the spans counted
+// in the numerator and the optional denominator of a ratio metric.
+func compileSpanMetricRatio(
+	metric *bunconf.SpanMetric, period time.Duration,
+) (numerator, denominator ch.Safe, _ error) {
+	if metric.Numerator == "" {
+		return "", "", newCompileError("numerator", "", errors.New("ratio requires a numerator"))
+	}
+	if metric.Value != "" || metric.RawValue != "" {
+		return "", "", newCompileError("value", metric.Value+metric.RawValue,
+			errors.New("ratio uses numerator instead of value"))
+	}
+
+	var errs []error
+
+	numerator, err := compileSpanMetricRatioCond("numerator", metric.Numerator, metric, period)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if metric.Denominator != "" {
+		denominator, err = compileSpanMetricRatioCond(
+			"denominator", metric.Denominator, metric, period)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return "", "", errors.Join(errs...)
+	}
+	return numerator, denominator, nil
+}
+
+func compileSpanMetricRatioCond(
+	field, cond string, metric *bunconf.SpanMetric, period time.Duration,
+) (ch.Safe, error) {
+	where, err := compileSpanMetricWhere(cond, metric.ThresholdDict, period)
+	if err != nil {
+		var compileErr *CompileError
+		if errors.As(err, &compileErr) {
+			compileErr.Field = field
+		}
+		return "", err
+	}
+	return where, nil
+}
+
+// compileSpanMetricApdex returns the number of satisfied spans plus the number
+// of satisfied and tolerated spans.
+func compileSpanMetricApdex(metric *bunconf.SpanMetric) (ch.Safe, error) {
+	if metric.ApdexThreshold <= 0 {
+		return "", newCompileError("apdex_threshold", metric.ApdexThreshold.String(),
+			errors.New("apdex requires a positive apdex_threshold"))
+	}
+	if metric.Value != "" || metric.RawValue != "" {
+		return "", newCompileError("value", metric.Value+metric.RawValue,
+			errors.New("apdex uses span.duration instead of value"))
+	}
+
+	duration := tracing.CHAttrExpr(attrkey.SpanDuration)
+	threshold := metric.ApdexThreshold.Nanoseconds()
+	return ch.Safe(chschema.AppendQuery(nil, "countIf(? <= ?) + countIf(? <= ?)",
+		duration, threshold, duration, 4*threshold)), nil
+}
+
+// compileSpanMetricWeightedAvg compiles the value and the optional weight of
+// a weighted_avg metric. Both are evaluated for each span, so they can't use aggregates.
+func compileSpanMetricWeightedAvg(
+	metric *bunconf.SpanMetric, period time.Duration,
+) (value, weight ch.Safe, err error) {
+	if metric.RawValue != "" {
+		return "", "", newCompileError("value", metric.RawValue,
+			errors.New("weighted_avg does not support raw values"))
+	}
+	if metric.Value == "" {
+		return "", "", newCompileError("value", "", errors.New("weighted_avg requires a value"))
+	}
+
+	value, err = compileSpanMetricPerSpanExpr("value", metric.Value, period)
+	if err != nil {
+		return "", "", err
+	}
+	if metric.Weight != "" {
+		weight, err = compileSpanMetricPerSpanExpr("weight", metric.Weight, period)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return value, weight, nil
+}
+
+func compileSpanMetricPerSpanExpr(
+	field, value string, period time.Duration,
+) (ch.Safe, error) {
+	expr, err := parseSpanMetricExpr(value)
+	if err != nil {
+		return "", newCompileError(field, value, err)
+	}
+	if fn, ok := findSpanMetricFunc(expr, spanMetricAggFuncs()...); ok {
+		return "", newCompileError(field, value,
+			fmt.Errorf("weighted_avg aggregates values itself and does not support %s", fn))
+	}
+
+	b, err := appendSpanMetricExpr(nil, expr, period)
+	if err != nil {
+		return "", newCompileError(field, value, err)
+	}
+	return ch.Safe(b), nil
+}
+
+// errRawMetricExprNotAllowed is returned for raw metric values unless
+// allow_raw_metric_expr is enabled.
+var errRawMetricExprNotAllowed = errors.New(
+	"raw metric values are disabled, set allow_raw_metric_expr to enable them")
+
+// errSelfDurationNotAllowed is returned for metrics that use span.self_duration
+// unless allow_self_duration is enabled.
+var errSelfDurationNotAllowed = errors.New(
+	"span.self_duration is disabled, set allow_self_duration to enable it")
+
+// errTraceOffsetNotAllowed is returned for metrics that use span.trace_offset
+// unless allow_trace_offset is enabled.
+var errTraceOffsetNotAllowed = errors.New(
+	"span.trace_offset is disabled, set allow_trace_offset to enable it")
+
+// errErrorDescendantNotAllowed is returned for metrics that use span.has_error_descendant
+// unless allow_error_descendant is enabled.
+var errErrorDescendantNotAllowed = errors.New(
+	"span.has_error_descendant is disabled, set allow_error_descendant to enable it")
+
+// checkSpanMetricJoins checks that the expensive joins used by the metric are allowed.
+func checkSpanMetricJoins(exprs *spanMetricExprs, conf *bunconf.Config) error {
+	if exprs.selfDuration && !conf.AllowSelfDuration {
+		return errSelfDurationNotAllowed
+	}
+	if exprs.traceOffset && !conf.AllowTraceOffset {
+		return errTraceOffsetNotAllowed
+	}
+	if exprs.errorDescendant && !conf.AllowErrorDescendant {
+		return errErrorDescendantNotAllowed
+	}
+	return nil
+}
+
+func checkSpanMetricRawValue(metric *bunconf.SpanMetric, conf *bunconf.Config) error {
+	if metric.RawValue != "" && !conf.AllowRawMetricExpr {
+		return errRawMetricExprNotAllowed
+	}
+	return nil
+}
+
+// compileSpanMetricRawValue returns the raw ClickHouse expression as is.
+// The expression is not validated and is only checked by ClickHouse when the view is created.
+func compileSpanMetricRawValue(metric *bunconf.SpanMetric) (ch.Safe, error) {
+	if metric.Value != "" {
+		return "", newCompileError("value", metric.Value,
+			errors.New("value can't be used together with a raw value"))
+	}
+	return ch.Safe(metric.RawValue), nil
+}
+
+func compileSpanMetricValue(value string, period time.Duration) (ch.Safe, error) {
+	expr, err := parseSpanMetricExpr(value)
+	if err != nil {
+		return "", newCompileError("value", value, err)
+	}
+
+	b, err := appendSpanMetricExpr(nil, expr, period)
+	if err != nil {
+		return "", newCompileError("value", value, err)
+	}
+
+	return ch.Safe(b), nil
+}
+
+// parseSpanMetricExpr parses a span metric value. The value may start with let bindings
+// separated with semicolons, for example, `let d = .duration / 1000; d * d`.
+// Bindings are inlined into the statements that follow them.
+func parseSpanMetricExpr(value string) (ast.Expr, error) {
+	// Statements are parsed one by one, so the whole value is checked here.
+	if err := ast.CheckQueryLen(value, ast.MaxQueryLen()); err != nil {
+		return nil, err
+	}
+
+	stmts := splitSpanMetricStatements(value)
+	if len(stmts) == 1 {
+		return parseSpanMetricStatement(value, nil)
+	}
+
+	bindings := make(map[string]ast.Expr, len(stmts)-1)
+	for _, stmt := range stmts[:len(stmts)-1] {
+		name, exprStr, ok := parseSpanMetricLet(stmt)
+		if !ok {
+			return nil, fmt.Errorf("statement %q: only let bindings can precede the metric value", stmt)
+		}
+		if _, ok := bindings[name]; ok {
+			return nil, fmt.Errorf("let %s: binding is already defined", name)
+		}
+
+		expr, err := parseSpanMetricStatement(exprStr, bindings)
+		if err != nil {
+			return nil, fmt.Errorf("let %s: %w", name, err)
+		}
+		bindings[name] = expr
+	}
+
+	body := stmts[len(stmts)-1]
+	if _, _, ok := parseSpanMetricLet(body); ok || body == "" {
+		return nil, fmt.Errorf("metric value must end with an expression, got %q", body)
+	}
+	return parseSpanMetricStatement(body, bindings)
+}
+
+func parseSpanMetricStatement(value string, bindings map[string]ast.Expr) (ast.Expr, error) {
+	query := mql.Parse(value)
+	if len(query.Parts) != 1 {
+		return nil, fmt.Errorf("can't parse metric value: %q", value)
+	}
+
+	part := query.Parts[0]
+	if err := part.Err(); err != nil {
+		return nil, err
+	}
+
+	sel, ok := part.Selector()
+	if !ok {
+		return nil, fmt.Errorf("unsupported metric value AST: %T", part.AST)
+	}
+	if len(bindings) == 0 {
+		return sel.Expr.Expr, nil
+	}
+	return inlineSpanMetricBindings(sel.Expr.Expr, bindings)
+}
+
+// splitSpanMetricStatements splits the value on semicolons outside of quoted strings.
+func splitSpanMetricStatements(value string) []string {
+	var stmts []string
+	var quote byte
+	var start int
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ';':
+			stmts = append(stmts, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(stmts, strings.TrimSpace(value[start:]))
+}
+
+// parseSpanMetricLet parses `let name = expr`.
+func parseSpanMetricLet(stmt string) (name, expr string, ok bool) {
+	const prefix = "let "
+	if !strings.HasPrefix(stmt, prefix) {
+		return "", "", false
+	}
+	name, expr, ok = strings.Cut(stmt[len(prefix):], "=")
+	if !ok {
+		return "", "", false
+	}
+	name = strings.TrimSpace(name)
+	if !isSpanMetricBindingName(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(expr), true
+}
+
+// isSpanMetricBindingName reports whether the name is a plain identifier, so bindings
+// can't shadow attrs like http.status_code.
+func isSpanMetricBindingName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func inlineSpanMetricBindings(expr ast.Expr, bindings map[string]ast.Expr) (ast.Expr, error) {
+	switch expr := expr.(type) {
+	case *ast.Name:
+		bound, ok := bindings[expr.Name]
+		if !ok {
+			return expr, nil
+		}
+		if len(expr.Filters) > 0 {
+			return nil, fmt.Errorf("let %s: bindings don't support filters", expr.Name)
+		}
+		if expr.Func != "" {
+			return &ast.FuncCall{Func: expr.Func, Args: []ast.Expr{bound}}, nil
+		}
+		if _, ok := bound.(*ast.BinaryExpr); ok {
+			return ast.ParenExpr{Expr: bound}, nil
+		}
+		return bound, nil
+	case *ast.FuncCall:
+		fn := &ast.FuncCall{Func: expr.Func, Args: make([]ast.Expr, len(expr.Args))}
+		for i, arg := range expr.Args {
+			arg, err := inlineSpanMetricBindings(arg, bindings)
+			if err != nil {
+				return nil, err
+			}
+			fn.Args[i] = arg
+		}
+		return fn, nil
+	case ast.ParenExpr:
+		inner, err := inlineSpanMetricBindings(expr.Expr, bindings)
+		if err != nil {
+			return nil, err
+		}
+		return ast.ParenExpr{Expr: inner}, nil
+	case *ast.UnaryExpr:
+		inner, err := inlineSpanMetricBindings(expr.Expr, bindings)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.UnaryExpr{Op: expr.Op, Expr: inner}, nil
+	case *ast.BinaryExpr:
+		lhs, err := inlineSpanMetricBindings(expr.LHS, bindings)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := inlineSpanMetricBindings(expr.RHS, bindings)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.BinaryExpr{Op: expr.Op, LHS: lhs, RHS: rhs, JoinOn: expr.JoinOn}, nil
+	default:
+		return expr, nil
+	}
+}
+
+func appendSpanMetricExpr(b []byte, expr ast.Expr, period time.Duration) (_ []byte, err error) {
+	switch expr := expr.(type) {
+	case *ast.Name:
+		if key, ok := tracing.ResourceAttrKey(expr.Name); ok && expr.Func == "" {
+			// Resource attrs used as values are numbers stored as strings,
+			// for example, resource.process.cpu.utilization.
+			b = append(b, "toFloat64OrDefault("...)
+			b = tracing.AppendCHAttrExpr(b, key)
+			return append(b, ')'), nil
+		}
+		b = tracing.AppendCHColumn(b, tql.Name{
+			FuncName: expr.Func,
+			AttrKey:  cleanSpanAttrKey(expr.Name),
+		}, period)
+		return b, nil
+	case *ast.FuncCall:
+		spec, ok := spanMetricFuncs[expr.Func]
+		if !ok {
+			return nil, fmt.Errorf("unsupported span metric func: %s", expr.Func)
+		}
+		if len(expr.Args) < spec.MinArgs || (spec.MaxArgs >= 0 && len(expr.Args) > spec.MaxArgs) {
+			return nil, fmt.Errorf("%s: unexpected number of args: %d", expr.Func, len(expr.Args))
+		}
+
+		switch expr.Func {
+		case "toNumber", "coalesce", "ifNull":
+			return appendSpanMetricToNumber(b, expr)
+		}
+		if unit, ok := spanMetricUnitCastFuncs[expr.Func]; ok {
+			return appendSpanMetricUnitCast(b, expr, unit)
+		}
+		if fn, ok := spanMetricTimeFuncs[expr.Func]; ok {
+			return appendSpanMetricTimeFunc(b, fn, expr.Args[0], period)
+		}
+		if expr.Func == "eventCount" {
+			return appendSpanMetricEventCount(b, expr)
+		}
+		if isJSONExtractFunc(expr.Func) {
+			return appendSpanMetricJSONExtract(b, expr)
+		}
+		if expr.Func == "count" && len(expr.Args) == 0 {
+			b = append(b, "count()"...)
+			return b, nil
+		}
+		if expr.Func == "quantile" && len(expr.Args) == 2 {
+			return appendSpanMetricQuantile(b, expr)
+		}
+		if len(expr.Args) == 1 {
+			switch arg := expr.Args[0].(type) {
+			case *ast.Name:
+				if len(arg.Filters) == 0 {
+					b = tracing.AppendCHColumn(b, tql.Name{
+						FuncName: expr.Func,
+						AttrKey:  cleanSpanAttrKey(arg.Name),
+					}, period)
+					return b, nil
+				}
+			case *ast.FuncCall:
+				switch expr.Func {
+				case "sum", "avg", "min", "max":
+					b = append(b, expr.Func...)
+					b = append(b, '(')
+					b, err = appendSpanMetricExpr(b, arg, period)
+					if err != nil {
+						return nil, err
+					}
+					b = append(b, ')')
+					return b, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unsupported span metric func: %s", expr.Func)
+	case *ast.Number:
+		b = append(b, expr.Text...)
+		return b, nil
+	case ast.ParenExpr:
+		b = append(b, '(')
+		b, err = appendSpanMetricExpr(b, expr.Expr, period)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, ')')
+		return b, nil
+	case *ast.UnaryExpr:
+		switch expr.Op {
+		case ast.UnaryNot:
+			b = append(b, "NOT ("...)
+		case ast.UnaryMinus:
+			b = append(b, "-("...)
+		default:
+			return nil, fmt.Errorf("unsupported unary op: %q", expr.Op)
+		}
+		b, err = appendSpanMetricExpr(b, unwrapParenExpr(expr.Expr), period)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, ')')
+		return b, nil
+	case *ast.BinaryExpr:
+		b, err = appendSpanMetricExpr(b, expr.LHS, period)
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, ' ')
+		b = append(b, expr.Op...)
+		b = append(b, ' ')
+
+		b, err = appendSpanMetricExpr(b, expr.RHS, period)
+		if err != nil {
+			return nil, err
+		}
+
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported span metric expr: %T", expr)
+	}
+}
+
+// FuncSpec describes a function supported in span metric values.
+type FuncSpec struct {
+	Name string `json:"name"`
+	// MinArgs and MaxArgs limit the number of args. MaxArgs is -1 when unlimited.
+	MinArgs int `json:"minArgs"`
+	MaxArgs int `json:"maxArgs"`
+	// Instruments lists the instruments the function can be used with.
+	Instruments []Instrument `json:"instruments"`
+
+	// infer is the instrument inferred when the func is the top-level value func.
+	infer Instrument
+}
+
+var (
+	aggInstruments = []Instrument{InstrumentCounter, InstrumentGauge, InstrumentAdditive}
+	allInstruments = []Instrument{
+		InstrumentCounter, InstrumentGauge, InstrumentAdditive, InstrumentHistogram,
+	}
+	pctInstruments   = []Instrument{InstrumentHistogram, InstrumentGauge}
+	gaugeInstruments = []Instrument{InstrumentGauge, InstrumentAdditive}
+	countInstruments = []Instrument{InstrumentCounter}
+)
+
+// spanMetricFuncs is used by the compiler to check funcs and infer instruments.
+var spanMetricFuncs = newFuncSpecMap([]FuncSpec{
+	{Name: "count", MinArgs: 0, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentCounter},
+	{Name: "sum", MinArgs: 1, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentCounter},
+	{Name: "avg", MinArgs: 1, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentGauge},
+	{Name: "min", MinArgs: 1, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentGauge},
+	{Name: "max", MinArgs: 1, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentGauge},
+	{Name: "any", MinArgs: 1, MaxArgs: 1, Instruments: aggInstruments, infer: InstrumentGauge},
+	{Name: "first", MinArgs: 1, MaxArgs: 1, Instruments: gaugeInstruments, infer: InstrumentGauge},
+	{Name: "last", MinArgs: 1, MaxArgs: 1, Instruments: gaugeInstruments, infer: InstrumentGauge},
+	{Name: "eventCount", MinArgs: 1, MaxArgs: 1, Instruments: countInstruments, infer: InstrumentCounter},
+	{Name: "p50", MinArgs: 1, MaxArgs: 1, Instruments: pctInstruments, infer: InstrumentHistogram},
+	{Name: "p75", MinArgs: 1, MaxArgs: 1, Instruments: pctInstruments, infer: InstrumentHistogram},
+	{Name: "p90", MinArgs: 1, MaxArgs: 1, Instruments: pctInstruments, infer: InstrumentHistogram},
+	{Name: "p99", MinArgs: 1, MaxArgs: 1, Instruments: pctInstruments, infer: InstrumentHistogram},
+	{Name: "quantile", MinArgs: 1, MaxArgs: 2, Instruments: pctInstruments, infer: InstrumentHistogram},
+	{Name: "toNumber", MinArgs: 1, MaxArgs: 2, Instruments: allInstruments},
+	{Name: "coalesce", MinArgs: 2, MaxArgs: 2, Instruments: allInstruments},
+	{Name: "ifNull", MinArgs: 2, MaxArgs: 2, Instruments: allInstruments},
+	{Name: "ms", MinArgs: 1, MaxArgs: 1, Instruments: allInstruments},
+	{Name: "sec", MinArgs: 1, MaxArgs: 1, Instruments: allInstruments},
+	{Name: "JSONExtractFloat", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+	{Name: "JSONExtractInt", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+	{Name: "JSONExtractUInt", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+	{Name: "JSONExtractBool", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+	{Name: "JSONExtractString", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+	{Name: "JSONExtractRaw", MinArgs: 2, MaxArgs: -1, Instruments: allInstruments},
+})
+
+func newFuncSpecMap(specs []FuncSpec) map[string]FuncSpec {
+	m := make(map[string]FuncSpec, len(specs))
+	for _, spec := range specs {
+		m[spec.Name] = spec
+	}
+	return m
+}
+
+// SupportedMetricFuncs returns the funcs that can be used in span metric values
+// sorted by name.
+func SupportedMetricFuncs() []FuncSpec {
+	specs := make([]FuncSpec, 0, len(spanMetricFuncs))
+	for _, spec := range spanMetricFuncs {
+		spec.Instruments = slices.Clone(spec.Instruments)
+		specs = append(specs, spec)
+	}
+	slices.SortFunc(specs, func(a, b FuncSpec) bool {
+		return a.Name < b.Name
+	})
+	return specs
+}
+
+// spanMetricUnitCastFuncs maps funcs that convert durations to the unit.
+var spanMetricUnitCastFuncs = map[string]string{
+	"ms":  bununit.Milliseconds,
+	"sec": bununit.Seconds,
+}
+
+// appendSpanMetricUnitCast converts the attr from the unit it is stored in to the unit,
+// e.g. ms(span.duration) divides the duration in nanoseconds by 1000000.
+func appendSpanMetricUnitCast(b []byte, fn *ast.FuncCall, unit string) ([]byte, error) {
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 {
+		return nil, fmt.Errorf("%s expects an attribute, got %s", fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	key := cleanSpanAttrKey(name.Name)
+	storedUnit := tracing.AttrUnit(key)
+	factor, err := bununit.ConvertValue(1, storedUnit, unit)
+	if err != nil || storedUnit == "" {
+		return nil, fmt.Errorf("%s expects a duration, got %s", fn.Func, name.Name)
+	}
+
+	b = append(b, '(')
+	b = tracing.AppendCHAttrExpr(b, key)
+	if factor < 1 {
+		// Divide by the number of stored units in the unit to avoid rounding errors.
+		divisor, _ := bununit.ConvertValue(1, unit, storedUnit)
+		b = append(b, " / "...)
+		b = strconv.AppendFloat(b, divisor, 'f', -1, 64)
+	} else {
+		b = append(b, " * "...)
+		b = strconv.AppendFloat(b, factor, 'f', -1, 64)
+	}
+	b = append(b, ')')
+	return b, nil
+}
+
+// spanMetricTimeFuncs maps funcs that pick a value by span time to ClickHouse funcs.
+var spanMetricTimeFuncs = map[string]string{
+	"first": "argMin",
+	"last":  "argMax",
+}
+
+// appendSpanMetricTimeFunc appends the value of the earliest or the latest span.
+func appendSpanMetricTimeFunc(
+	b []byte, fn string, arg ast.Expr, period time.Duration,
+) (_ []byte, err error) {
+	b = append(b, fn...)
+	b = append(b, '(')
+	switch arg := unwrapParenExpr(arg).(type) {
+	case *ast.Name:
+		if arg.Func != "" || len(arg.Filters) > 0 {
+			return nil, fmt.Errorf("unsupported %s arg: %s", fn, arg.AppendString(nil))
+		}
+		b = append(b, "toFloat64OrDefault("...)
+		b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(arg.Name))
+		b = append(b, ')')
+	default:
+		b, err = appendSpanMetricExpr(b, arg, period)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b = append(b, ", s.time)"...)
+	return b, nil
+}
+
+// appendSpanMetricEventCount appends the number of span events with the name.
+// Events are stored in spans_index next to spans, so no join is needed.
+func appendSpanMetricEventCount(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	name, ok := fn.Args[0].(*ast.StringExpr)
+	if !ok || name.Text == "" {
+		return nil, fmt.Errorf("%s expects an event name string, got %s",
+			fn.Func, fn.Args[0].AppendString(nil))
+	}
+	b = append(b, "countIf(s.event_name = "...)
+	b = chschema.AppendString(b, name.Text)
+	b = append(b, ')')
+	return b, nil
+}
+
+// spanMetricAggFuncs returns the names of the funcs that aggregate spans.
+func spanMetricAggFuncs() []string {
+	var names []string
+	for name, spec := range spanMetricFuncs {
+		if spec.infer != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// strictSpanMetricFuncs are only allowed with the instruments listed in spanMetricFuncs:
+// first and last keep a single value per data point and eventCount counts events.
+var strictSpanMetricFuncs = []string{"first", "last", "eventCount"}
+
+// checkSpanMetricFuncInstruments checks that strict funcs are used with a supported instrument.
+func checkSpanMetricFuncInstruments(metric *bunconf.SpanMetric) error {
+	if metric.Value == "" || metric.RawValue != "" {
+		return nil
+	}
+	expr, err := parseSpanMetricExpr(metric.Value)
+	if err != nil {
+		return nil
+	}
+
+	fn, ok := findSpanMetricFunc(expr, strictSpanMetricFuncs...)
+	if !ok {
+		return nil
+	}
+	spec := spanMetricFuncs[fn]
+	if slices.Contains(spec.Instruments, Instrument(metric.Instrument)) {
+		return nil
+	}
+	return newCompileError("value", metric.Value,
+		fmt.Errorf("%s requires one of %v instruments, got %q", fn, spec.Instruments, metric.Instrument))
+}
+
+// findSpanMetricFunc returns the first func call in the expr with one of the names.
+func findSpanMetricFunc(expr ast.Expr, names ...string) (string, bool) {
+	switch expr := expr.(type) {
+	case *ast.FuncCall:
+		if slices.Contains(names, expr.Func) {
+			return expr.Func, true
+		}
+		for _, arg := range expr.Args {
+			if fn, ok := findSpanMetricFunc(arg, names...); ok {
+				return fn, true
+			}
+		}
+	case *ast.Name:
+		if slices.Contains(names, expr.Func) {
+			return expr.Func, true
+		}
+	case ast.ParenExpr:
+		return findSpanMetricFunc(expr.Expr, names...)
+	case *ast.UnaryExpr:
+		return findSpanMetricFunc(expr.Expr, names...)
+	case *ast.BinaryExpr:
+		if fn, ok := findSpanMetricFunc(expr.LHS, names...); ok {
+			return fn, true
+		}
+		return findSpanMetricFunc(expr.RHS, names...)
+	}
+	return "", false
+}
+
+// checkSpanMetricValueType rejects values that use string attrs as numbers,
+// for example, sum(service.name), because the values would silently become zeros.
+func checkSpanMetricValueType(metric *bunconf.SpanMetric) error {
+	if metric.Value == "" || metric.RawValue != "" {
+		return nil
+	}
+	expr, err := parseSpanMetricExpr(metric.Value)
+	if err != nil {
+		return nil
+	}
+
+	if name, ok := findSpanMetricStringAttr(expr, true); ok {
+		return newCompileError("value", metric.Value,
+			fmt.Errorf("%s is a string attribute and can't be used as a number", name))
+	}
+	return nil
+}
+
+// findSpanMetricStringAttr returns the first attr with the string type that is used
+// as a number, i.e. as the value itself, in arithmetic, or in a numeric func.
+// Attrs without a known type are allowed.
+func findSpanMetricStringAttr(expr ast.Expr, numeric bool) (string, bool) {
+	switch expr := expr.(type) {
+	case *ast.Name:
+		if expr.Func != "" {
+			numeric = tql.IsNumFunc(expr.Func)
+		}
+		if !numeric {
+			return "", false
+		}
+		typ, ok := tracing.LookupAttrType(nil, 0, cleanSpanAttrKey(expr.Name))
+		return expr.Name, ok && typ == tracing.AttrTypeString
+	case *ast.FuncCall:
+		if !tql.IsNumFunc(expr.Func) {
+			return "", false
+		}
+		for _, arg := range expr.Args {
+			if name, ok := findSpanMetricStringAttr(arg, true); ok {
+				return name, true
+			}
+		}
+	case ast.ParenExpr:
+		return findSpanMetricStringAttr(expr.Expr, numeric)
+	case *ast.UnaryExpr:
+		return findSpanMetricStringAttr(expr.Expr, numeric && expr.Op == ast.UnaryMinus)
+	case *ast.BinaryExpr:
+		switch expr.Op {
+		case "+", "-", "*", "/", "%":
+		default:
+			numeric = false
+		}
+		if name, ok := findSpanMetricStringAttr(expr.LHS, numeric); ok {
+			return name, true
+		}
+		return findSpanMetricStringAttr(expr.RHS, numeric)
+	}
+	return "", false
+}
+
+func isJSONExtractFunc(name string) bool {
+	switch name {
+	case "JSONExtractFloat", "JSONExtractInt", "JSONExtractUInt",
+		"JSONExtractBool", "JSONExtractString", "JSONExtractRaw":
+		return true
+	default:
+		return false
+	}
+}
+
+// appendSpanMetricJSONExtract extracts a field from a JSON attribute,
+// e.g. JSONExtractFloat(span.payload, 'latency').
+func appendSpanMetricJSONExtract(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	if len(fn.Args) < 2 {
+		return nil, fmt.Errorf("%s expects an attribute and a field path", fn.Func)
+	}
+
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 {
+		return nil, fmt.Errorf("%s expects an attribute, got %s",
+			fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	b = append(b, fn.Func...)
+	b = append(b, '(')
+	b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(name.Name))
+
+	for _, arg := range fn.Args[1:] {
+		b = append(b, ", "...)
+		switch arg := arg.(type) {
+		case *ast.StringExpr:
+			b = chschema.AppendString(b, arg.Text)
+		case *ast.Number:
+			b = append(b, arg.Text...)
+		default:
+			return nil, fmt.Errorf("%s field path must be a string or an index, got %s",
+				fn.Func, arg.AppendString(nil))
+		}
+	}
+
+	b = append(b, ')')
+	return b, nil
+}
+
+func unwrapParenExpr(expr ast.Expr) ast.Expr {
+	if paren, ok := expr.(ast.ParenExpr); ok {
+		return unwrapParenExpr(paren.Expr)
+	}
+	return expr
+}
+
+// appendSpanMetricToNumber converts a string attribute to a number.
+// Unparseable values become NULL unless a default is given, e.g. toNumber(attr, 0).
+func appendSpanMetricToNumber(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	if len(fn.Args) == 0 || len(fn.Args) > 2 {
+		return nil, fmt.Errorf("%s expects an attribute and an optional default", fn.Func)
+	}
+
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 {
+		return nil, fmt.Errorf("%s expects an attribute, got %s", fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	var def *ast.Number
+	if len(fn.Args) == 2 {
+		def, ok = fn.Args[1].(*ast.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s default must be a number, got %s",
+				fn.Func, fn.Args[1].AppendString(nil))
+		}
+		// coalesce(attr, 0) and ifNull(attr, 0) are the same as toNumber(attr, 0).
+		if fn.Func == "coalesce" {
+			b = append(b, "coalesce("...)
+		} else {
+			b = append(b, "ifNull("...)
+		}
+	}
+
+	b = append(b, "toFloat64OrNull(toString("...)
+	b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(name.Name))
+	b = append(b, "))"...)
+
+	if def != nil {
+		b = append(b, ", "...)
+		b = append(b, def.Text...)
+		b = append(b, ')')
+	}
+	return b, nil
+}
+
+// compileSpanMetricAttrs compiles attrs that are either attribute names
+// or value expressions, for example, `tenant=JSONExtractString(span.payload, 'tenant')`.
+func compileSpanMetricAttrs(attrs []string, period time.Duration) (ch.Safe, []string, error) {
+	var b []byte
+	aliases := make([]string, len(attrs))
+	for i, attr := range attrs {
+		attr, alias := splitAttrLabel(attr)
+		aliases[i] = alias
+
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+
+		fn, inner, normalize := parseSpanMetricNormalizeAttr(attr)
+		if normalize {
+			b = append(b, fn...)
+			b = append(b, '(')
+			attr = cleanSpanAttrKey(inner)
+		}
+
+		inner, maxLen, truncate, err := parseSpanMetricTruncateAttr(attr)
+		if err != nil {
+			return "", nil, newCompileError("attrs", attr, err)
+		}
+		if truncate {
+			b = append(b, "substring("...)
+			attr = inner
+		}
+
+		b = append(b, "toString("...)
+		b, err = appendSpanMetricAttr(b, attr, period)
+		if err != nil {
+			return "", nil, newCompileError("attrs", attr, err)
+		}
+		b = append(b, ")"...)
+
+		if truncate {
+			b = append(b, ", 1, "...)
+			b = strconv.AppendInt(b, int64(maxLen), 10)
+			b = append(b, ')')
+		}
+		if normalize {
+			b = append(b, ')')
+		}
+	}
+	return ch.Safe(b), aliases, nil
+}
+
+// compileSpanMetricTotalAttrs compiles the attrs so they are replaced with __total__
+// in the rows that are duplicated by the ARRAY JOIN of the view.
+func compileSpanMetricTotalAttrs(
+	attrs []string, period time.Duration,
+) (ch.Safe, []string, error) {
+	var b []byte
+	aliases := make([]string, len(attrs))
+	for i, attr := range attrs {
+		expr, alias, err := compileSpanMetricAttrs([]string{attr}, period)
+		if err != nil {
+			return "", nil, err
+		}
+		aliases[i] = alias[0]
+
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = chschema.AppendQuery(b, "if(is_total, ?, ?)", spanMetricTotal, expr)
+	}
+	return ch.Safe(b), aliases, nil
+}
+
+func appendSpanMetricAttr(b []byte, attr string, period time.Duration) ([]byte, error) {
+	if key, bounds, ok, err := parseSpanMetricBucketAttr(attr); ok {
+		if err != nil {
+			return nil, err
+		}
+		return appendSpanMetricBucketAttr(b, key, bounds), nil
+	}
+	if strings.Contains(attr, "(") {
+		expr, err := parseSpanMetricExpr(attr)
+		if err != nil {
+			return nil, err
+		}
+		if fn, ok := expr.(*ast.FuncCall); ok {
+			switch {
+			case spanMetricCalendarFuncs[fn.Func]:
+				return appendSpanMetricCalendarAttr(b, fn)
+			case fn.Func == "regexpExtract":
+				return appendSpanMetricRegexpExtract(b, fn)
+			case fn.Func == "pathSegment":
+				return appendSpanMetricPathSegment(b, fn)
+			case fn.Func == "concat":
+				return appendSpanMetricConcatAttr(b, fn, period)
+			}
+		}
+		return appendSpanMetricExpr(b, expr, period)
+	}
+	key := cleanSpanAttrKey(attr)
+	switch key {
+	case attrkey.SpanStatusClass:
+		return tracing.AppendCHColumn(b, tql.Name{AttrKey: key}, period), nil
+	case attrkey.SpanKind:
+		return appendSpanMetricKindAttr(b), nil
+	}
+	return tracing.AppendCHAttrExpr(b, key), nil
+}
+
+// spanMetricKinds are the span kinds stored as is by span.kind attrs.
+var spanMetricKinds = []string{
+	tracing.ServerSpanKind,
+	tracing.ClientSpanKind,
+	tracing.ProducerSpanKind,
+	tracing.ConsumerSpanKind,
+}
+
+// appendSpanMetricKindAttr appends the span kind label. Empty and unknown kinds,
+// e.g. from ingesters that don't normalize the kind, are labeled internal
+// like OTLP spans with an unspecified kind.
+func appendSpanMetricKindAttr(b []byte) []byte {
+	kind := tracing.CHAttrExpr(attrkey.SpanKind)
+	return chschema.AppendQuery(b, "if(? IN ?, ?, ?)",
+		kind, ch.In(spanMetricKinds), kind, tracing.InternalSpanKind)
+}
+
+// spanMetricCalendarFuncs are the funcs that derive attrs from the span time,
+// for example, `hour = toHour(span.time)`.
+var spanMetricCalendarFuncs = map[string]bool{
+	"toHour":       true,
+	"toDayOfWeek":  true,
+	"toDayOfMonth": true,
+	"toMonth":      true,
+}
+
+// appendSpanMetricCalendarAttr appends a calendar func of the span time with
+// an optional time zone, e.g. toHour(span.time, 'Europe/Berlin').
+func appendSpanMetricCalendarAttr(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	if len(fn.Args) < 1 || len(fn.Args) > 2 {
+		return nil, fmt.Errorf("%s: unexpected number of args: %d", fn.Func, len(fn.Args))
+	}
+
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 ||
+		cleanSpanAttrKey(name.Name) != attrkey.SpanTime {
+		return nil, fmt.Errorf("%s expects span.time, got %s", fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	b = append(b, fn.Func...)
+	b = append(b, "(s.time"...)
+	if len(fn.Args) == 2 {
+		tz, ok := fn.Args[1].(*ast.StringExpr)
+		if !ok {
+			return nil, fmt.Errorf("%s time zone must be a string, got %s",
+				fn.Func, fn.Args[1].AppendString(nil))
+		}
+		if _, err := time.LoadLocation(tz.Text); err != nil {
+			return nil, fmt.Errorf("%s: invalid time zone %q", fn.Func, tz.Text)
+		}
+		b = append(b, ", "...)
+		b = chschema.AppendString(b, tz.Text)
+	}
+	b = append(b, ')')
+	return b, nil
+}
+
+// appendSpanMetricPathSegment appends the nth (1-based) segment of a URL path,
+// for example, `resource = pathSegment(http.target, 2)` is users for /api/users/42.
+// The query string and empty segments are ignored, and out of range segments are empty.
+func appendSpanMetricPathSegment(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	if len(fn.Args) != 2 {
+		return nil, fmt.Errorf("%s: unexpected number of args: %d", fn.Func, len(fn.Args))
+	}
+
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 {
+		return nil, fmt.Errorf("%s expects an attribute, got %s",
+			fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	num, ok := fn.Args[1].(*ast.Number)
+	var index int
+	var err error
+	if ok {
+		index, err = strconv.Atoi(num.Text)
+	}
+	if !ok || err != nil || index < 1 {
+		return nil, fmt.Errorf("%s index must be a positive integer, got %s",
+			fn.Func, fn.Args[1].AppendString(nil))
+	}
+
+	// ClickHouse returns an empty string for array indexes out of range.
+	b = append(b, "arrayElement(arrayFilter(x -> x != '', "...)
+	b = append(b, "splitByChar('/', splitByChar('?', toString("...)
+	b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(name.Name))
+	b = append(b, "))[1])), "...)
+	b = strconv.AppendInt(b, int64(index), 10)
+	b = append(b, ')')
+	return b, nil
+}
+
+// appendSpanMetricConcatAttr appends a label that combines attrs and string separators,
+// for example, `svc_env = concat(service.name, ':', deployment.environment)`.
+// The combined value is a single label, so it is hashed like any other attr.
+func appendSpanMetricConcatAttr(
+	b []byte, fn *ast.FuncCall, period time.Duration,
+) ([]byte, error) {
+	if len(fn.Args) < 2 {
+		return nil, fmt.Errorf("%s: unexpected number of args: %d", fn.Func, len(fn.Args))
+	}
+
+	var numAttr int
+	b = append(b, "concat("...)
+	for i, arg := range fn.Args {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+
+		switch arg := arg.(type) {
+		case *ast.StringExpr:
+			b = chschema.AppendString(b, arg.Text)
+		case *ast.Name:
+			if arg.Func != "" || len(arg.Filters) > 0 {
+				return nil, fmt.Errorf("%s expects attributes and strings, got %s",
+					fn.Func, arg.AppendString(nil))
+			}
+			numAttr++
+
+			var err error
+			b = append(b, "toString("...)
+			b, err = appendSpanMetricAttr(b, arg.Name, period)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, ')')
+		default:
+			return nil, fmt.Errorf("%s expects attributes and strings, got %s",
+				fn.Func, arg.AppendString(nil))
+		}
+	}
+	b = append(b, ')')
+
+	if numAttr == 0 {
+		return nil, fmt.Errorf("%s expects at least one attribute", fn.Func)
+	}
+	return b, nil
+}
+
+// appendSpanMetricRegexpExtract appends a capture group of a regexp applied to the attr,
+// for example, `operation = regexpExtract(span.name, '^db\.(\w+)', 1)`.
+// Values that don't match the regexp produce an empty label.
+func appendSpanMetricRegexpExtract(b []byte, fn *ast.FuncCall) ([]byte, error) {
+	if len(fn.Args) < 2 || len(fn.Args) > 3 {
+		return nil, fmt.Errorf("%s: unexpected number of args: %d", fn.Func, len(fn.Args))
+	}
+
+	name, ok := fn.Args[0].(*ast.Name)
+	if !ok || name.Func != "" || len(name.Filters) > 0 {
+		return nil, fmt.Errorf("%s expects an attribute, got %s",
+			fn.Func, fn.Args[0].AppendString(nil))
+	}
+
+	pattern, ok := fn.Args[1].(*ast.StringExpr)
+	if !ok {
+		return nil, fmt.Errorf("%s pattern must be a string, got %s",
+			fn.Func, fn.Args[1].AppendString(nil))
+	}
+	re, err := regexp.Compile(pattern.Text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern: %w", fn.Func, err)
+	}
+
+	index := 1
+	if len(fn.Args) == 3 {
+		num, ok := fn.Args[2].(*ast.Number)
+		if ok {
+			index, err = strconv.Atoi(num.Text)
+		}
+		if !ok || err != nil || index < 0 {
+			return nil, fmt.Errorf("%s group index must be a non-negative integer, got %s",
+				fn.Func, fn.Args[2].AppendString(nil))
+		}
+	}
+	if index > re.NumSubexp() {
+		return nil, fmt.Errorf("%s: pattern has %d capture groups, got index %d",
+			fn.Func, re.NumSubexp(), index)
+	}
+
+	b = append(b, "regexpExtract(toString("...)
+	b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(name.Name))
+	b = append(b, "), "...)
+	b = appendCHEscapedString(b, pattern.Text)
+	b = append(b, ", "...)
+	b = strconv.AppendInt(b, int64(index), 10)
+	b = append(b, ')')
+	return b, nil
+}
+
+// appendSpanMetricQuantile compiles `quantile(0.95, attr)` like the pN funcs.
+func appendSpanMetricQuantile(b []byte, expr *ast.FuncCall) ([]byte, error) {
+	level, err := parseQuantileLevel(expr.Args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	arg, ok := expr.Args[1].(*ast.Name)
+	if !ok || arg.Func != "" || len(arg.Filters) > 0 {
+		return nil, fmt.Errorf("quantile: the second arg must be an attr")
+	}
+
+	return chschema.AppendQuery(b, "quantileTDigest(?)(toFloat64OrDefault(?))",
+		level, tracing.CHAttrExpr(cleanSpanAttrKey(arg.Name))), nil
+}
+
+// parseQuantileLevel parses the quantile level, which must be between 0 and 1.
+func parseQuantileLevel(arg ast.Expr) (float64, error) {
+	num, ok := arg.(*ast.Number)
+	if !ok {
+		return 0, fmt.Errorf("quantile: the level must be a number, got %q", arg.AppendString(nil))
+	}
+
+	level, err := strconv.ParseFloat(num.Text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("quantile: can't parse level %q: %w", num.Text, err)
+	}
+	if level > 0 && level < 1 {
+		return level, nil
+	}
+	if level > 1 && level < 100 {
+		return 0, fmt.Errorf("quantile level must be between 0 and 1, got %s (use %s instead)",
+			num.Text, strconv.FormatFloat(level/100, 'g', 10, 64))
+	}
+	return 0, fmt.Errorf("quantile level must be between 0 and 1, got %s", num.Text)
+}
+
+// appendCHEscapedString appends a string literal that keeps backslashes, e.g. in regexps.
+// chschema.AppendString only escapes quotes, and ClickHouse drops the backslash in \w.
+func appendCHEscapedString(b []byte, s string) []byte {
+	b = append(b, '\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '\\':
+			b = append(b, '\\', c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '\'')
+}
+
+// spanMetricNormalizeFuncs maps attr normalization funcs to ClickHouse funcs.
+var spanMetricNormalizeFuncs = map[string]string{
+	"lower": "lowerUTF8",
+	"upper": "upperUTF8",
+	"trim":  "trimBoth",
+}
+
+var spanMetricNormalizeRE = regexp.MustCompile(`^(lower|upper|trim)\(\s*(.+?)\s*\)$`)
+
+// parseSpanMetricNormalizeAttr parses `lower(attr)`, `upper(attr)`, and `trim(attr)`
+// and returns the ClickHouse func and the attr it normalizes.
+func parseSpanMetricNormalizeAttr(attr string) (fn, inner string, ok bool) {
+	m := spanMetricNormalizeRE.FindStringSubmatch(attr)
+	if m == nil {
+		return "", "", false
+	}
+	return spanMetricNormalizeFuncs[m[1]], m[2], true
+}
+
+var spanMetricTruncateRE = regexp.MustCompile(`^truncate\(\s*(.+?)\s*,\s*(\S+)\s*\)$`)
+
+// parseSpanMetricTruncateAttr parses `truncate(attr, maxLen)` that caps the length
+// of the attr value in bytes, for example, to store long SQL queries and URLs.
+func parseSpanMetricTruncateAttr(attr string) (inner string, maxLen int, ok bool, err error) {
+	m := spanMetricTruncateRE.FindStringSubmatch(attr)
+	if m == nil {
+		return "", 0, false, nil
+	}
+
+	maxLen, err = strconv.Atoi(m[2])
+	if err != nil || maxLen <= 0 {
+		return "", 0, true, fmt.Errorf("truncate length must be a positive integer, got %q", m[2])
+	}
+	return m[1], maxLen, true, nil
+}
+
+// SpanMetricExemplar is the annotation that stores the id of the slowest trace
+// in each data point so the data point can be linked to a trace.
+const SpanMetricExemplar = "exemplar"
+
+var spanMetricBucketRE = regexp.MustCompile(`^bucket\(\s*([^,\s]+)\s*,\s*\[(.*)\]\s*\)$`)
+
+// parseSpanMetricBucketAttr parses `bucket(attr.key, [bound1, bound2, ...])`
+// that groups a numeric attribute into ranges. The bounds must be ascending.
+func parseSpanMetricBucketAttr(attr string) (key string, bounds []float64, ok bool, err error) {
+	m := spanMetricBucketRE.FindStringSubmatch(attr)
+	if m == nil {
+		return "", nil, false, nil
+	}
+
+	for _, s := range strings.Split(m[2], ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return "", nil, true, fmt.Errorf("invalid bucket bound %q", s)
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return "", nil, true, fmt.Errorf("bucket bounds must be ascending")
+		}
+		bounds = append(bounds, bound)
+	}
+	return cleanSpanAttrKey(m[1]), bounds, true, nil
+}
+
+// appendSpanMetricBucketAttr appends an expression that returns the label of the range
+// the attribute value falls into. Ranges include the lower bound, values above
+// the last bound fall into the overflow range, and non-numeric values produce
+// an empty label.
+func appendSpanMetricBucketAttr(b []byte, key string, bounds []float64) []byte {
+	value := chschema.AppendQuery(nil, "toFloat64OrNull(toString(?))",
+		ch.Safe(tracing.AppendCHAttrExpr(nil, key)))
+
+	b = append(b, "multiIf(isNull("...)
+	b = append(b, value...)
+	b = append(b, "), ''"...)
+
+	var prev string
+	for i, bound := range bounds {
+		curr := strconv.FormatFloat(bound, 'f', -1, 64)
+
+		b = append(b, ", "...)
+		b = append(b, value...)
+		b = append(b, " < "...)
+		b = append(b, curr...)
+		b = append(b, ", "...)
+		if i == 0 {
+			b = chschema.AppendString(b, "<"+curr)
+		} else {
+			b = chschema.AppendString(b, prev+"-"+curr)
+		}
+		prev = curr
+	}
+
+	b = append(b, ", "...)
+	b = chschema.AppendString(b, ">="+prev)
+	b = append(b, ")"...)
+	return b
+}
+
+// compileSpanMetricAnnotations compiles annotations that are either attribute names,
+// for example, `display.name` or `display.name as name`, or key:expression pairs,
+// for example, `endpoint: any(http.route)`.
+func compileSpanMetricAnnotations(annotations []string, period time.Duration) (ch.Safe, error) {
+	var b []byte
+	for i, annotation := range annotations {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+
+		if annotation == SpanMetricExemplar {
+			b = chschema.AppendString(b, SpanMetricExemplar)
+			b = append(b, ", toString(argMax(s.trace_id, s.duration))"...)
+			continue
+		}
+
+		key, exprStr, ok := splitAnnotationExpr(annotation)
+		if !ok {
+			attr, alias := splitNameAlias(annotation)
+
+			b = chschema.AppendString(b, alias)
+			b = append(b, ", coalesce(toString(any("...)
+			b = tracing.AppendCHAttrExpr(b, cleanSpanAttrKey(attr))
+			b = append(b, ")), '')"...)
+			continue
+		}
+
+		expr, err := parseSpanMetricExpr(exprStr)
+		if err != nil {
+			return "", newCompileError("annotations", exprStr, err)
+		}
+		if name, ok := expr.(*ast.Name); ok && name.Func == "" {
+			expr = &ast.FuncCall{Func: "any", Args: []ast.Expr{name}}
+		}
+
+		b = chschema.AppendString(b, key)
+		b = append(b, ", coalesce(toString("...)
+		b, err = appendSpanMetricExpr(b, expr, period)
+		if err != nil {
+			return "", newCompileError("annotations", exprStr, err)
+		}
+		b = append(b, "), '')"...)
+	}
+	return ch.Safe(b), nil
+}
+
+func splitAnnotationExpr(s string) (key, expr string, ok bool) {
+	key, expr, ok = strings.Cut(s, ":")
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(key), strings.TrimSpace(expr), true
+}
+
+// spanMetricThreshold is the where value replaced with the per-service threshold
+// looked up in the metric threshold dictionary.
+const spanMetricThreshold = "$threshold"
+
+// compileSpanMetricWhereList compiles each condition and joins them with AND.
+// Conditions that use OR are parenthesized so they don't change the precedence.
+func compileSpanMetricWhereList(
+	conds []string, thresholdDict string, period time.Duration,
+) (ch.Safe, error) {
+	var b []byte
+	var errs []error
+
+	for _, cond := range conds {
+		if strings.TrimSpace(cond) == "" {
+			continue
+		}
+
+		where, err := compileSpanMetricWhere(cond, thresholdDict, period)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(b) > 0 {
+			b = append(b, " AND "...)
+		}
+		if len(conds) > 1 && strings.Contains(string(where), " OR ") {
+			b = append(b, '(')
+			b = append(b, where...)
+			b = append(b, ')')
+		} else {
+			b = append(b, where...)
+		}
+	}
+
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+	if len(b) == 0 {
+		// Dropping every condition would create a view without a filter.
+		return "", newCompileError("where", strings.Join(conds, "; "),
+			fmt.Errorf("all %d where conditions are empty, remove where to match all spans",
+				len(conds)))
+	}
+	return ch.Safe(b), nil
+}
+
+// andSpanMetricService ANDs the service.name filter with the compiled where.
+func andSpanMetricService(where ch.Safe, service string) ch.Safe {
+	b := tracing.AppendCHAttrExpr(nil, attrkey.ServiceName)
+	b = append(b, " = "...)
+	b = appendCHEscapedString(b, service)
+
+	if where == "" {
+		return ch.Safe(b)
+	}
+
+	b = append(b, " AND "...)
+	if strings.Contains(string(where), " OR ") {
+		b = append(b, '(')
+		b = append(b, where...)
+		b = append(b, ')')
+	} else {
+		b = append(b, where...)
+	}
+	return ch.Safe(b)
+}
+
+// andSpanMetricRootOnly ANDs the root span filter with the compiled where.
+func andSpanMetricRootOnly(where ch.Safe) ch.Safe {
+	b := tracing.AppendCHColumn(nil, tql.Name{AttrKey: attrkey.SpanIsRoot}, 0)
+
+	if where == "" {
+		return ch.Safe(b)
+	}
+
+	b = append(b, " AND "...)
+	if strings.Contains(string(where), " OR ") {
+		b = append(b, '(')
+		b = append(b, where...)
+		b = append(b, ')')
+	} else {
+		b = append(b, where...)
+	}
+	return ch.Safe(b)
+}
+
+func compileSpanMetricWhere(query, thresholdDict string, period time.Duration) (ch.Safe, error) {
+	expr, err := tql.ParseWhereExpr(query)
+	if err != nil {
+		return "", newCompileError("where", query, err)
+	}
+
+	if err := expr.Walk(func(filter *tql.Filter) error {
+		filter.LHS.AttrKey = cleanSpanAttrKey(filter.LHS.AttrKey)
+		if tracing.IsAggColumn(filter.LHS) {
+			return fmt.Errorf("can't filter by agg column %q", filter.LHS.String())
+		}
+
+		value, ok := filter.RHS.(tql.StringValue)
+		if !ok {
+			return nil
+		}
+
+		switch {
+		case value.Ident && value.Text == spanMetricThreshold:
+			if thresholdDict == "" {
+				return fmt.Errorf("%s requires threshold_dict", spanMetricThreshold)
+			}
+			filter.RHS = tracing.RawValue(chschema.AppendQuery(nil,
+				"dictGet(?, 'threshold', s.service_name)", thresholdDict))
+		case value.Ident && strings.HasPrefix(value.Text, "span.") && isSpanCompareOp(filter.Op):
+			filter.RHS = tracing.AttrRef{Name: tql.Name{AttrKey: spanAttrRefKey(value.Text)}}
+		}
+		return nil
+	}); err != nil {
+		return "", newCompileError("where", query, err)
+	}
+
+	return ch.Safe(appendSpanMetricWhereExpr(nil, expr, period)), nil
+}
+
+// appendSpanMetricWhereExpr compiles the where expression tree recursively.
+// OR groups nested in AND groups are parenthesized to keep the grouping.
+func appendSpanMetricWhereExpr(b []byte, expr *tql.WhereExpr, period time.Duration) []byte {
+	if expr.Filter != nil {
+		switch expr.Filter.Op {
+		case tql.FilterExists, tql.FilterNotExists:
+			return appendSpanMetricExists(b, expr.Filter)
+		}
+		return append(b, tracing.AppendFilter(*expr.Filter, period)...)
+	}
+
+	for i, child := range expr.Exprs {
+		if i > 0 {
+			b = append(b, ' ')
+			b = append(b, expr.Op...)
+			b = append(b, ' ')
+		}
+
+		if child.Filter == nil && child.Op == tql.BoolOr && expr.Op == tql.BoolAnd {
+			b = append(b, '(')
+			b = appendSpanMetricWhereExpr(b, child, period)
+			b = append(b, ')')
+		} else {
+			b = appendSpanMetricWhereExpr(b, child, period)
+		}
+	}
+	return b
+}
+
+// appendSpanMetricExists checks whether the span has the attr. Attrs stored in columns
+// are empty when the span does not have them, and the other attrs are looked up
+// in attr_keys so an empty value is not confused with a missing attr.
+// Built-in span fields and trace.sampled always exist.
+func appendSpanMetricExists(b []byte, filter *tql.Filter) []byte {
+	key := filter.LHS.AttrKey
+	exists := filter.Op == tql.FilterExists
+
+	switch {
+	case strings.HasPrefix(key, "."), key == attrkey.TraceSampled:
+		if exists {
+			return append(b, '1')
+		}
+		return append(b, '0')
+	case tracing.IsIndexedAttr(key):
+		b = tracing.AppendCHAttrExpr(b, key)
+		if exists {
+			return append(b, " != ''"...)
+		}
+		return append(b, " = ''"...)
+	default:
+		if !exists {
+			b = append(b, "NOT "...)
+		}
+		return chschema.AppendQuery(b, "has(s.attr_keys, ?)", key)
+	}
+}
+
+func isSpanCompareOp(op tql.FilterOp) bool {
+	switch op {
+	case tql.FilterEqual, tql.FilterNotEqual, "<", "<=", ">", ">=":
+		return true
+	default:
+		return false
+	}
+}
+
+// spanAttrRefKey resolves `span.<key>` used as a where value to a built-in span field
+// if there is one and to a span attribute otherwise.
+func spanAttrRefKey(ref string) string {
+	key := cleanSpanAttrKey(ref)
+	if spanFields[key] {
+		return key
+	}
+	return strings.TrimPrefix(key, ".")
+}
+
+var spanFields = map[string]bool{
+	attrkey.SpanSystem:          true,
+	attrkey.SpanGroupID:         true,
+	attrkey.SpanID:              true,
+	attrkey.SpanParentID:        true,
+	attrkey.SpanTraceID:         true,
+	attrkey.SpanName:            true,
+	attrkey.SpanEventName:       true,
+	attrkey.SpanKind:            true,
+	attrkey.SpanTime:            true,
+	attrkey.SpanDuration:        true,
+	attrkey.SpanStatusCode:      true,
+	attrkey.SpanStatusMessage:   true,
+	attrkey.SpanLinkCount:       true,
+	attrkey.SpanEventCount:      true,
+	attrkey.SpanEventErrorCount: true,
+	attrkey.SpanEventLogCount:   true,
+}
+
+func cleanSpanAttrKey(key string) string {
+	if strings.HasPrefix(key, "span.") {
+		return strings.TrimPrefix(key, "span")
+	}
+	if key, ok := tracing.ResourceAttrKey(key); ok {
+		// Resource attrs are stored together with span attrs.
+		return key
+	}
+	if key == attrkey.LogBody {
+		// Log bodies are stored as log messages.
+		return attrkey.LogMessage
+	}
+	return key
+}
+
+// splitAttrLabel splits an attr entry into the source attr key and the label,
+// accepting both `label=attr.key` and `attr.key as label`.
+func splitAttrLabel(s string) (key, label string) {
+	if label, key, ok := strings.Cut(s, "="); ok {
+		label, key = strings.TrimSpace(label), strings.TrimSpace(key)
+		if ast.IsIdent(label) {
+			return cleanSpanAttrKey(key), label
+		}
+	}
+
+	key, label = splitNameAlias(s)
+	if key == label {
+		// Normalized and truncated attrs are labeled with the attr they wrap.
+		if _, inner, ok := parseSpanMetricNormalizeAttr(label); ok {
+			label = inner
+		}
+		if inner, _, ok, _ := parseSpanMetricTruncateAttr(label); ok {
+			label = inner
+		}
 	}
-	return ch.Safe(where), nil
+	return key, label
 }
 
 func splitNameAlias(s string) (string, string) {
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+// chRowScanner runs a query that returns a single row.
+type chRowScanner interface {
+	scanRow(ctx context.Context, query string, dest ...any) error
+}
+
+type chDB struct {
+	db *ch.DB
+}
+
+var _ chRowScanner = chDB{}
+
+func (db chDB) scanRow(ctx context.Context, query string, dest ...any) error {
+	return db.db.NewRaw(query).Scan(ctx, dest...)
+}
+
+// EstimateCardinality returns the estimated number of distinct series the span metric
+// would write, using the spans received during the lookback period.
+func EstimateCardinality(
+	ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric, lookback time.Duration,
+) (uint64, error) {
+	metric, exprs, err := prepareSpanMetric(ctx, app, metric)
+	if err != nil {
+		return 0, err
+	}
+	return estimateSpanMetricCardinality(ctx, chDB{db: app.CH}, metric, exprs, lookback)
+}
+
+func estimateSpanMetricCardinality(
+	ctx context.Context,
+	db chRowScanner,
+	metric *bunconf.SpanMetric,
+	exprs *spanMetricExprs,
+	lookback time.Duration,
+) (uint64, error) {
+	if exprs.attrs == "" {
+		// Metrics without attrs have a single series.
+		return 1, nil
+	}
+
+	query, err := buildSpanMetricCardinalityQuery(metric, exprs, lookback)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	if err := db.scanRow(ctx, query, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// buildSpanMetricCardinalityQuery counts distinct attrs_hash values produced by
+// the select of the span metric view.
+func buildSpanMetricCardinalityQuery(
+	metric *bunconf.SpanMetric, exprs *spanMetricExprs, lookback time.Duration,
+) (string, error) {
+	if lookback <= 0 {
+		return "", fmt.Errorf("cardinality lookback must be positive, got %s", lookback)
+	}
+
+	q, err := newSpanMetricSelect(metric, exprs)
+	if err != nil {
+		return "", err
+	}
+	q = q.Where("s.time >= now() - toIntervalSecond(?)", int64(lookback.Seconds()))
+
+	b := []byte("SELECT uniq(attrs_hash) FROM (")
+	b, err = appendSpanMetricSelect(b, q)
+	if err != nil {
+		return "", err
+	}
+	b = append(b, ')')
+	return string(b), nil
+}
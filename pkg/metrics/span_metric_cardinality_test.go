@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+type fakeRowScanner struct {
+	query string
+	count uint64
+}
+
+func (db *fakeRowScanner) scanRow(ctx context.Context, query string, dest ...any) error {
+	db.query = query
+	*dest[0].(*uint64) = db.count
+	return nil
+}
+
+func TestEstimateSpanMetricCardinality(t *testing.T) {
+	ctx := context.Background()
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"service.name", "truncate(http.route, 64)"},
+		Where:      []string{".kind = 'server'"},
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	db := &fakeRowScanner{count: 42}
+	n, err := estimateSpanMetricCardinality(ctx, db, metric, exprs, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), n)
+
+	require.Contains(t, db.query, "SELECT uniq(attrs_hash) FROM (SELECT s.project_id, ")
+	require.Contains(t, db.query,
+		"xxHash64(arrayStringConcat(["+string(exprs.attrs)+"], '-')) AS attrs_hash")
+	require.Contains(t, db.query, `s."kind" = 'server'`)
+	require.Contains(t, db.query, "s.time >= now() - toIntervalSecond(3600)")
+	require.NotContains(t, db.query, "CREATE")
+
+	_, err = estimateSpanMetricCardinality(ctx, db, metric, exprs, 0)
+	require.Error(t, err)
+
+	metric.Attrs = nil
+	exprs, err = compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	db = new(fakeRowScanner)
+	n, err = estimateSpanMetricCardinality(ctx, db, metric, exprs, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	require.Empty(t, db.query)
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/metrics/mql/ast"
+	"github.com/uptrace/uptrace/pkg/tracing/tql"
+)
+
+// SpanMetricDependencies returns the sorted span attribute keys that the value, attrs,
+// annotations, and where of the metric read, so it is known which metrics break
+// when an attribute is no longer emitted. Built-in span fields have the span prefix
+// removed, for example, .duration.
+func SpanMetricDependencies(metric *bunconf.SpanMetric) ([]string, error) {
+	deps := make(map[string]struct{})
+
+	if metric.Value != "" {
+		expr, err := parseSpanMetricExpr(metric.Value)
+		if err != nil {
+			return nil, newCompileError("value", metric.Value, err)
+		}
+		walkSpanMetricNames(expr, deps)
+	}
+
+	for _, attr := range metric.Attrs {
+		if err := addSpanMetricAttrDeps(deps, attr); err != nil {
+			return nil, newCompileError("attrs", attr, err)
+		}
+	}
+
+	for _, annotation := range metric.Annotations {
+		if annotation == SpanMetricExemplar {
+			continue
+		}
+
+		_, exprStr, ok := splitAnnotationExpr(annotation)
+		if !ok {
+			attr, _ := splitNameAlias(annotation)
+			deps[cleanSpanAttrKey(attr)] = struct{}{}
+			continue
+		}
+
+		expr, err := parseSpanMetricExpr(exprStr)
+		if err != nil {
+			return nil, newCompileError("annotations", exprStr, err)
+		}
+		walkSpanMetricNames(expr, deps)
+	}
+
+	for _, where := range metric.Where {
+		expr, err := tql.ParseWhereExpr(where)
+		if err != nil {
+			return nil, newCompileError("where", where, err)
+		}
+		_ = expr.Walk(func(filter *tql.Filter) error {
+			deps[cleanSpanAttrKey(filter.LHS.AttrKey)] = struct{}{}
+			return nil
+		})
+	}
+
+	keys := make([]string, 0, len(deps))
+	for key := range deps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func addSpanMetricAttrDeps(deps map[string]struct{}, attr string) error {
+	attr, _ = splitAttrLabel(attr)
+
+	if key, _, ok, err := parseSpanMetricBucketAttr(attr); ok {
+		if err != nil {
+			return err
+		}
+		deps[key] = struct{}{}
+		return nil
+	}
+	if _, inner, ok := parseSpanMetricNormalizeAttr(attr); ok {
+		attr = cleanSpanAttrKey(inner)
+	}
+	inner, _, ok, err := parseSpanMetricTruncateAttr(attr)
+	if err != nil {
+		return err
+	}
+	if ok {
+		attr = inner
+	}
+
+	if !strings.Contains(attr, "(") {
+		deps[cleanSpanAttrKey(attr)] = struct{}{}
+		return nil
+	}
+
+	expr, err := parseSpanMetricExpr(attr)
+	if err != nil {
+		return err
+	}
+	walkSpanMetricNames(expr, deps)
+	return nil
+}
+
+// walkSpanMetricNames adds the attr keys of the names in the expr to deps.
+func walkSpanMetricNames(expr ast.Expr, deps map[string]struct{}) {
+	switch expr := expr.(type) {
+	case *ast.Name:
+		deps[cleanSpanAttrKey(expr.Name)] = struct{}{}
+	case *ast.FuncCall:
+		for _, arg := range expr.Args {
+			walkSpanMetricNames(arg, deps)
+		}
+	case ast.ParenExpr:
+		walkSpanMetricNames(expr.Expr, deps)
+	case *ast.UnaryExpr:
+		walkSpanMetricNames(expr.Expr, deps)
+	case *ast.BinaryExpr:
+		walkSpanMetricNames(expr.LHS, deps)
+		walkSpanMetricNames(expr.RHS, deps)
+	}
+}
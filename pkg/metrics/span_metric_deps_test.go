@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+func TestSpanMetricDependencies(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "histogram",
+		Value:      "let d = span.duration / 1000; p50(d) + sum(http.request_content_length)",
+		Attrs: []string{
+			"service.name",
+			"route = truncate(http.route, 32)",
+			"lower(span.name)",
+			"status = bucket(http.response.status_code, [300, 400, 500])",
+			"concat(host.name, deployment.environment) as host",
+			"hour = toHour(span.time)",
+		},
+		Annotations: []string{
+			SpanMetricExemplar,
+			"db.system as db",
+			"user: any(enduser.id)",
+		},
+		Where: []string{
+			"span.kind = 'server'",
+			"exists(http.method) or messaging.system = 'kafka'",
+		},
+	}
+
+	deps, err := SpanMetricDependencies(metric)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		".duration",
+		".kind",
+		".name",
+		".time",
+		"db.system",
+		"deployment.environment",
+		"enduser.id",
+		"host.name",
+		"http.method",
+		"http.request_content_length",
+		"http.response.status_code",
+		"http.route",
+		"messaging.system",
+		"service.name",
+	}, deps)
+
+	deps, err = SpanMetricDependencies(&bunconf.SpanMetric{
+		Name:  "test",
+		Value: "count()",
+	})
+	require.NoError(t, err)
+	require.Empty(t, deps)
+
+	_, err = SpanMetricDependencies(&bunconf.SpanMetric{
+		Name:  "test",
+		Value: "count()",
+		Where: []string{"span.kind ="},
+	})
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "where", compileErr.Field)
+}
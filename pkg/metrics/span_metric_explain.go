@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/go-clickhouse/ch/chschema"
+	"github.com/uptrace/uptrace/pkg/attrkey"
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/tracing"
+)
+
+// ExplainSpanMetric returns the query that selects the spans the metric aggregated into
+// the bucket starting at tm with the attrs, so the value can be checked span by span.
+// Attrs that are missing or set to __total__ match any value.
+func ExplainSpanMetric(
+	ctx context.Context,
+	app *bunapp.App,
+	metricName string,
+	tm time.Time,
+	attrs map[string]string,
+) (string, error) {
+	metrics := currentSpanMetrics(app)
+
+	var metric *bunconf.SpanMetric
+	for i := range metrics {
+		if metrics[i].Name == metricName {
+			metric = &metrics[i]
+			break
+		}
+	}
+	if metric == nil {
+		return "", fmt.Errorf("span metric %q not found", metricName)
+	}
+
+	metric, exprs, err := prepareSpanMetric(ctx, app, metric)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := buildSpanMetricExplainQuery(metric, exprs, tm, attrs)
+	if err != nil {
+		return "", err
+	}
+	return app.CH.FormatQuery(query), nil
+}
+
+// buildSpanMetricExplainQuery selects the spans of a single data point using
+// the same table, where, and attrs as the span metric view, but without aggregation.
+func buildSpanMetricExplainQuery(
+	metric *bunconf.SpanMetric,
+	exprs *spanMetricExprs,
+	tm time.Time,
+	attrs map[string]string,
+) (string, error) {
+	if tm.IsZero() {
+		return "", fmt.Errorf("explain requires the time of the bucket")
+	}
+
+	q := ch.NewSelectQuery(nil).
+		TableExpr(spanMetricTableExpr(metric, exprs, false)).
+		ColumnExpr("s.project_id").
+		ColumnExpr("s.trace_id").
+		ColumnExpr("s.id").
+		ColumnExpr("s.time").
+		ColumnExpr("?", tracing.CHAttrExpr(attrkey.SpanName)).
+		ColumnExpr("?", tracing.CHAttrExpr(attrkey.SpanDuration)).
+		// The bucket expr keeps the time zone of the metric, and the range uses the index.
+		Where("? = toDateTime(?)", exprs.timeExpr, tm.Unix()).
+		Where("s.time >= toDateTime(?)", tm.Unix()).
+		Where("s.time < toDateTime(?)", tm.Add(exprs.period).Unix()).
+		OrderExpr("s.time ASC")
+
+	matched := make(map[string]bool, len(attrs))
+	for _, attr := range metric.Attrs {
+		expr, aliases, err := compileSpanMetricAttrs([]string{attr}, exprs.period)
+		if err != nil {
+			return "", err
+		}
+		alias := aliases[0]
+
+		q = q.ColumnExpr("? AS ?", expr, ch.Ident(alias))
+
+		value, ok := attrs[alias]
+		if !ok {
+			continue
+		}
+		matched[alias] = true
+		if value == spanMetricTotal {
+			continue
+		}
+		q = q.Where("? = ?", expr, value)
+	}
+	for key := range attrs {
+		if !matched[key] {
+			return "", fmt.Errorf("span metric %q does not have attr %q", metric.Name, key)
+		}
+	}
+
+	if exprs.where != "" {
+		q = q.Where(string(exprs.where))
+	}
+	if exprs.skipZeroDuration {
+		q = q.Where("? > 0", tracing.CHAttrExpr(attrkey.SpanDuration))
+	}
+	if metric.IsSampled() {
+		q = q.Where("cityHash64(s.trace_id) % ? < ?",
+			spanMetricSampleBase, uint64(metric.SampleRate*spanMetricSampleBase))
+	}
+
+	b, err := q.AppendQuery(chschema.NewFormatter(), nil)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
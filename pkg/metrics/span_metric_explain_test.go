@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+func TestBuildSpanMetricExplainQuery(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "http.server.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs:      []string{"http.route", "service.name"},
+		Where:      []string{"span.kind = 'server'"},
+		SampleRate: 0.5,
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	tm := time.Date(2023, 10, 1, 12, 30, 0, 0, time.UTC)
+	query, err := buildSpanMetricExplainQuery(metric, exprs, tm, map[string]string{
+		"http.route":   "/api/users",
+		"service.name": "__total__",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "SELECT s.project_id, s.trace_id, s.id, s.time, s.\"name\", s.\"duration\", "+
+		"toString(s.attr_values[indexOf(s.attr_keys, 'http.route')]) AS \"http.route\", "+
+		"toString(s.\"service_name\") AS \"service.name\" "+
+		"FROM ?DB.spans_index AS s "+
+		"WHERE (toStartOfMinute(s.time) = toDateTime(1696163400)) "+
+		"AND (s.time >= toDateTime(1696163400)) AND (s.time < toDateTime(1696163460)) "+
+		"AND (toString(s.attr_values[indexOf(s.attr_keys, 'http.route')]) = '/api/users') "+
+		"AND (s.\"kind\" = 'server') "+
+		"AND (cityHash64(s.trace_id) % 10000 < 5000) "+
+		"ORDER BY s.time ASC", query)
+	require.NotContains(t, query, "count()")
+
+	_, err = buildSpanMetricExplainQuery(metric, exprs, tm, map[string]string{"host.name": "a"})
+	require.EqualError(t, err, `span metric "http.server.requests" does not have attr "host.name"`)
+
+	_, err = buildSpanMetricExplainQuery(metric, exprs, time.Time{}, nil)
+	require.Error(t, err)
+
+	metric.BucketUnit = "hour"
+	metric.Total = true
+	exprs, err = compileSpanMetric(metric)
+	require.NoError(t, err)
+	query, err = buildSpanMetricExplainQuery(metric, exprs, tm, nil)
+	require.NoError(t, err)
+	require.Contains(t, query, "(s.time < toDateTime(1696167000))")
+	require.NotContains(t, query, "ARRAY JOIN")
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+// spanMetricPreviewLimit is the max number of rows returned by PreviewSpanMetric.
+const spanMetricPreviewLimit = 1000
+
+// SpanMetricRow is a data point that a span metric view would write.
+type SpanMetricRow struct {
+	Time  time.Time `json:"time"`
+	Attrs AttrMap   `json:"attrs" ch:"-"`
+
+	// Value is set for gauges.
+	Value float64 `json:"value"`
+	// Sum is set for counters, histograms, and ratios.
+	Sum float64 `json:"sum"`
+	// Count is set for histograms and ratios.
+	Count uint64 `json:"count"`
+	// P50 is set for histograms.
+	P50 float64 `json:"p50"`
+
+	Annotations string `json:"annotations"`
+
+	StringKeys   []string `json:"-"`
+	StringValues []string `json:"-"`
+}
+
+// PreviewSpanMetric runs the query of the span metric view over the spans received
+// during the lookback period and returns the most recent rows without creating the view.
+func PreviewSpanMetric(
+	ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric, lookback time.Duration,
+) ([]SpanMetricRow, error) {
+	metric, exprs, err := prepareSpanMetric(ctx, app, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildSpanMetricPreviewQuery(metric, exprs, lookback)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []SpanMetricRow
+	if err := app.CH.NewRaw(query).Scan(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		row.Attrs = make(AttrMap, len(row.StringKeys))
+		for j, key := range row.StringKeys {
+			if j < len(row.StringValues) {
+				row.Attrs[key] = row.StringValues[j]
+			}
+		}
+	}
+	return rows, nil
+}
+
+// prepareSpanMetric checks and compiles the metric the same way as when the view is created.
+func prepareSpanMetric(
+	ctx context.Context, app *bunapp.App, metric *bunconf.SpanMetric,
+) (*bunconf.SpanMetric, *spanMetricExprs, error) {
+	if err := checkSpanMetricRawValue(metric, app.Config()); err != nil {
+		return nil, nil, err
+	}
+
+	metric, err := inferSpanMetricInstrument(metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	metric, err = expandSpanMetricAttrs(ctx, metric, newSpanAttrCatalog(app))
+	if err != nil {
+		return nil, nil, err
+	}
+	metric, _, err = dedupeSpanMetricAttrs(metric)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exprs, err := compileSpanMetric(metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSpanMetricJoins(exprs, app.Config()); err != nil {
+		return nil, nil, err
+	}
+	return metric, exprs, nil
+}
+
+// buildSpanMetricPreviewQuery wraps the select of the span metric view into a query
+// that returns the same columns for every instrument.
+func buildSpanMetricPreviewQuery(
+	metric *bunconf.SpanMetric, exprs *spanMetricExprs, lookback time.Duration,
+) (string, error) {
+	if lookback <= 0 {
+		return "", fmt.Errorf("preview lookback must be positive, got %s", lookback)
+	}
+
+	q, err := newSpanMetricSelect(metric, exprs)
+	if err != nil {
+		return "", err
+	}
+	q = q.Where("s.time >= now() - toIntervalSecond(?)", int64(lookback.Seconds()))
+
+	b := []byte("SELECT time")
+	if exprs.attrs != "" {
+		b = append(b, ", string_keys, string_values"...)
+	}
+	if exprs.annotations != "" {
+		b = append(b, ", annotations"...)
+	}
+
+	switch Instrument(metric.Instrument) {
+	case InstrumentGauge, InstrumentAdditive:
+		b = append(b, ", gauge AS value"...)
+	case InstrumentCounter:
+		b = append(b, ", sum"...)
+	case InstrumentRatio, InstrumentWeightedAvg, InstrumentApdex:
+		b = append(b, ", count, sum"...)
+	case InstrumentHistogram:
+		b = append(b, ", count, sum"...)
+		if !exprs.noQuantiles {
+			column, _ := spanMetricQuantileState(metric)
+			b = append(b, ", finalizeAggregation("...)
+			b = append(b, column...)
+			b = append(b, ")[1] AS p50"...)
+		}
+	}
+
+	b = append(b, " FROM ("...)
+	b, err = appendSpanMetricSelect(b, q)
+	if err != nil {
+		return "", err
+	}
+	b = append(b, ") ORDER BY time DESC LIMIT "...)
+	b = strconv.AppendInt(b, spanMetricPreviewLimit, 10)
+
+	return string(b), nil
+}
@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+func TestBuildSpanMetricPreviewQuery(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "histogram",
+		Value:      ".duration",
+		Attrs:      []string{"service.name"},
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	query, err := buildSpanMetricPreviewQuery(metric, exprs, 15*time.Minute)
+	require.NoError(t, err)
+	require.Contains(t, query, "SELECT time, string_keys, string_values, count, sum, "+
+		"finalizeAggregation(histogram)[1] AS p50 FROM (SELECT s.project_id, ")
+	require.Contains(t, query, "s.time >= now() - toIntervalSecond(900)")
+	require.NotContains(t, query, "CREATE")
+	require.Contains(t, query, ") ORDER BY time DESC LIMIT 1000")
+
+	_, err = buildSpanMetricPreviewQuery(metric, exprs, 0)
+	require.Error(t, err)
+}
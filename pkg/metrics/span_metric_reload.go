@@ -0,0 +1,311 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"go.uber.org/zap"
+)
+
+// SpanMetricReloadSummary describes the actions taken by a span metrics reload.
+type SpanMetricReloadSummary struct {
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Dropped   []string `json:"dropped"`
+	Unchanged []string `json:"unchanged"`
+	Failed    []string `json:"failed"`
+}
+
+// spanMetrics are the metrics_from_spans of the last reload. The config is read once
+// on startup, so the span metric jobs and handlers read the metrics from here instead.
+var spanMetrics spanMetricList
+
+type spanMetricList struct {
+	mu       sync.RWMutex
+	metrics  []bunconf.SpanMetric
+	reloaded bool
+}
+
+func (l *spanMetricList) store(metrics []bunconf.SpanMetric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.metrics = metrics
+	l.reloaded = true
+}
+
+func (l *spanMetricList) load() ([]bunconf.SpanMetric, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.metrics, l.reloaded
+}
+
+// currentSpanMetrics returns metrics_from_spans as of the last reload. The returned
+// slice is shared and must not be modified.
+func currentSpanMetrics(app *bunapp.App) []bunconf.SpanMetric {
+	if metrics, ok := spanMetrics.load(); ok {
+		return metrics
+	}
+	return app.Config().MetricsFromSpans
+}
+
+// SpanMetricReloader re-reads metrics_from_spans from the config file and applies
+// the difference with the currently installed span metrics.
+type SpanMetricReloader struct {
+	app *bunapp.App
+
+	mu      sync.Mutex
+	metrics []bunconf.SpanMetric
+}
+
+func NewSpanMetricReloader(app *bunapp.App) *SpanMetricReloader {
+	return &SpanMetricReloader{
+		app:     app,
+		metrics: app.Config().MetricsFromSpans,
+	}
+}
+
+// Reload reads the config file and creates, updates, and drops span metrics so they
+// match the config. Only metrics_from_spans is reloaded; other options keep
+// the values they had on startup.
+func (r *SpanMetricReloader) Reload(ctx context.Context) (*SpanMetricReloadSummary, error) {
+	conf := r.app.Config()
+
+	newConf, err := bunconf.ReadConfig(conf.Path, conf.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	plan, err := planSpanMetricReload(r.metrics, newConf.MetricsFromSpans)
+	if err != nil {
+		return nil, err
+	}
+	// Published before the views are synced, because creating a view checks
+	// whether another metric uses the legacy view name.
+	spanMetrics.store(newConf.MetricsFromSpans)
+
+	summary, err := applySpanMetricReload(ctx, &appSpanMetricSyncer{app: r.app}, plan)
+	r.metrics = reloadedSpanMetrics(r.metrics, newConf.MetricsFromSpans, summary.Failed)
+	return summary, err
+}
+
+// reloadedSpanMetrics returns the metrics that are installed after a reload so the failed
+// actions are retried on the next reload.
+func reloadedSpanMetrics(
+	oldMetrics, newMetrics []bunconf.SpanMetric, failed []string,
+) []bunconf.SpanMetric {
+	if len(failed) == 0 {
+		return newMetrics
+	}
+
+	failedSet := listToSet(failed)
+	metrics := make([]bunconf.SpanMetric, 0, len(newMetrics))
+	seen := make(map[string]bool, len(newMetrics))
+
+	for i := range newMetrics {
+		seen[newMetrics[i].Name] = true
+		// Forget failed creates and updates so they are applied again.
+		if _, ok := failedSet[newMetrics[i].Name]; !ok {
+			metrics = append(metrics, newMetrics[i])
+		}
+	}
+	for i := range oldMetrics {
+		// Keep failed drops so they are dropped again.
+		if seen[oldMetrics[i].Name] {
+			continue
+		}
+		if _, ok := failedSet[oldMetrics[i].Name]; ok {
+			metrics = append(metrics, oldMetrics[i])
+		}
+	}
+
+	return metrics
+}
+
+// watchSIGHUP reloads span metrics every time the process receives SIGHUP.
+func (r *SpanMetricReloader) watchSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	r.app.WaitGroup().Add(1)
+	go func() {
+		defer r.app.WaitGroup().Done()
+		defer signal.Stop(ch)
+
+		ctx := r.app.Context()
+
+		for {
+			select {
+			case <-r.app.Done():
+				return
+			case <-ch:
+			}
+
+			summary, err := r.Reload(ctx)
+			if err != nil {
+				r.app.Zap(ctx).Error("reloading metrics from spans failed", zap.Error(err))
+			}
+			if summary != nil {
+				r.app.Zap(ctx).Info("reloaded metrics from spans",
+					zap.Strings(spanMetricCreated, summary.Created),
+					zap.Strings(spanMetricUpdated, summary.Updated),
+					zap.Strings("dropped", summary.Dropped),
+					zap.Int("unchanged", len(summary.Unchanged)),
+					zap.Strings(spanMetricFailed, summary.Failed))
+			}
+		}
+	}()
+}
+
+//------------------------------------------------------------------------------
+
+type spanMetricReloadPlan struct {
+	create    []*bunconf.SpanMetric
+	update    []*bunconf.SpanMetric
+	drop      []*bunconf.SpanMetric
+	unchanged []string
+}
+
+// planSpanMetricReload compares old and new metrics by name and by the hash
+// of their definitions.
+func planSpanMetricReload(
+	oldMetrics, newMetrics []bunconf.SpanMetric,
+) (*spanMetricReloadPlan, error) {
+	oldHashes := make(map[string]uint64, len(oldMetrics))
+	for i := range oldMetrics {
+		hash, err := spanMetricHash(&oldMetrics[i])
+		if err != nil {
+			return nil, err
+		}
+		oldHashes[oldMetrics[i].Name] = hash
+	}
+
+	plan := new(spanMetricReloadPlan)
+	seen := make(map[string]bool, len(newMetrics))
+
+	for i := range newMetrics {
+		metric := &newMetrics[i]
+		if metric.Name == "" {
+			return nil, fmt.Errorf("metric name can't be empty")
+		}
+		if seen[metric.Name] {
+			return nil, fmt.Errorf("duplicated span metric %q", metric.Name)
+		}
+		seen[metric.Name] = true
+
+		oldHash, ok := oldHashes[metric.Name]
+		if !ok {
+			plan.create = append(plan.create, metric)
+			continue
+		}
+
+		hash, err := spanMetricHash(metric)
+		if err != nil {
+			return nil, err
+		}
+		if hash == oldHash {
+			plan.unchanged = append(plan.unchanged, metric.Name)
+		} else {
+			plan.update = append(plan.update, metric)
+		}
+	}
+
+	for i := range oldMetrics {
+		metric := &oldMetrics[i]
+		if !seen[metric.Name] {
+			plan.drop = append(plan.drop, metric)
+		}
+	}
+
+	return plan, nil
+}
+
+func spanMetricHash(metric *bunconf.SpanMetric) (uint64, error) {
+	b, err := json.Marshal(metric)
+	if err != nil {
+		return 0, err
+	}
+	return xxhash.Sum64(b), nil
+}
+
+type spanMetricSyncer interface {
+	upsert(ctx context.Context, metric *bunconf.SpanMetric) error
+	drop(ctx context.Context, metric *bunconf.SpanMetric) error
+}
+
+func applySpanMetricReload(
+	ctx context.Context, syncer spanMetricSyncer, plan *spanMetricReloadPlan,
+) (*SpanMetricReloadSummary, error) {
+	summary := &SpanMetricReloadSummary{
+		Unchanged: plan.unchanged,
+	}
+	var errs []error
+
+	for _, metric := range plan.create {
+		if err := syncer.upsert(ctx, metric); err != nil {
+			summary.Failed = append(summary.Failed, metric.Name)
+			errs = append(errs, fmt.Errorf("createSpanMetric %q failed: %w", metric.Name, err))
+			continue
+		}
+		summary.Created = append(summary.Created, metric.Name)
+	}
+
+	for _, metric := range plan.update {
+		if err := syncer.upsert(ctx, metric); err != nil {
+			summary.Failed = append(summary.Failed, metric.Name)
+			errs = append(errs, fmt.Errorf("updateSpanMetric %q failed: %w", metric.Name, err))
+			continue
+		}
+		summary.Updated = append(summary.Updated, metric.Name)
+	}
+
+	for _, metric := range plan.drop {
+		if err := syncer.drop(ctx, metric); err != nil {
+			summary.Failed = append(summary.Failed, metric.Name)
+			errs = append(errs, fmt.Errorf("dropSpanMetric %q failed: %w", metric.Name, err))
+			continue
+		}
+		summary.Dropped = append(summary.Dropped, metric.Name)
+	}
+
+	return summary, errors.Join(errs...)
+}
+
+type appSpanMetricSyncer struct {
+	app *bunapp.App
+}
+
+var _ spanMetricSyncer = (*appSpanMetricSyncer)(nil)
+
+func (s *appSpanMetricSyncer) upsert(ctx context.Context, metric *bunconf.SpanMetric) error {
+	_, err := createSpanMetricWithStats(ctx, s.app, metric)
+	return err
+}
+
+func (s *appSpanMetricSyncer) drop(ctx context.Context, metric *bunconf.SpanMetric) error {
+	conf := s.app.Config()
+	return dropSpanMetricView(
+		ctx, s.app.CH, conf.SpanMetricViewName(metric.Name), conf.CHSchema.Cluster)
+}
+
+// dropSpanMetricView drops the view and keeps the metric data and metadata
+// so the metric stays queryable until the data expires.
+func dropSpanMetricView(ctx context.Context, db chExecer, viewName, cluster string) error {
+	query, err := buildSpanMetricDropQuery(viewName, cluster)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, query)
+	return err
+}
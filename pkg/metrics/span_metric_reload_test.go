@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+type fakeSpanMetricSyncer struct {
+	db        *recordingExecer
+	upserted  []string
+	upsertErr map[string]error
+}
+
+var _ spanMetricSyncer = (*fakeSpanMetricSyncer)(nil)
+
+func (s *fakeSpanMetricSyncer) upsert(ctx context.Context, metric *bunconf.SpanMetric) error {
+	if err := s.upsertErr[metric.Name]; err != nil {
+		return err
+	}
+	s.upserted = append(s.upserted, metric.Name)
+	return nil
+}
+
+func (s *fakeSpanMetricSyncer) drop(ctx context.Context, metric *bunconf.SpanMetric) error {
+	return dropSpanMetricView(ctx, s.db, bunconf.SpanMetricViewName("", metric.Name), "")
+}
+
+func TestSpanMetricReload(t *testing.T) {
+	ctx := context.Background()
+
+	oldMetrics := []bunconf.SpanMetric{
+		{Name: "kept", Instrument: "counter", Value: "1"},
+		{Name: "changed", Instrument: "counter", Value: "1"},
+		{Name: "removed", Instrument: "counter", Value: "1"},
+	}
+	newMetrics := []bunconf.SpanMetric{
+		{Name: "kept", Instrument: "counter", Value: "1"},
+		{Name: "changed", Instrument: "counter", Value: "1", Where: []string{".is_root"}},
+		{Name: "added", Instrument: "gauge", Value: ".duration"},
+	}
+
+	plan, err := planSpanMetricReload(oldMetrics, newMetrics)
+	require.NoError(t, err)
+
+	syncer := &fakeSpanMetricSyncer{db: new(recordingExecer)}
+	summary, err := applySpanMetricReload(ctx, syncer, plan)
+	require.NoError(t, err)
+
+	require.Equal(t, &SpanMetricReloadSummary{
+		Created:   []string{"added"},
+		Updated:   []string{"changed"},
+		Dropped:   []string{"removed"},
+		Unchanged: []string{"kept"},
+	}, summary)
+	require.Equal(t, []string{"added", "changed"}, syncer.upserted)
+	require.Equal(t, []string{
+		`DROP VIEW IF EXISTS ?DB."metrics_removed_mv"`,
+	}, syncer.db.queries)
+
+	metrics := reloadedSpanMetrics(oldMetrics, newMetrics, summary.Failed)
+	require.Equal(t, newMetrics, metrics)
+
+	plan, err = planSpanMetricReload(metrics, newMetrics)
+	require.NoError(t, err)
+	require.Empty(t, plan.create)
+	require.Empty(t, plan.update)
+	require.Empty(t, plan.drop)
+	require.Equal(t, []string{"kept", "changed", "added"}, plan.unchanged)
+}
+
+func TestSpanMetricReloadFailed(t *testing.T) {
+	ctx := context.Background()
+
+	oldMetrics := []bunconf.SpanMetric{
+		{Name: "removed", Instrument: "counter", Value: "1"},
+	}
+	newMetrics := []bunconf.SpanMetric{
+		{Name: "added", Instrument: "counter", Value: "1"},
+	}
+
+	plan, err := planSpanMetricReload(oldMetrics, newMetrics)
+	require.NoError(t, err)
+
+	syncer := &fakeSpanMetricSyncer{
+		db: &recordingExecer{
+			errs: map[string]error{"DROP": errors.New("timeout")},
+		},
+		upsertErr: map[string]error{"added": errors.New("invalid")},
+	}
+	summary, err := applySpanMetricReload(ctx, syncer, plan)
+	require.Error(t, err)
+	require.Equal(t, []string{"added", "removed"}, summary.Failed)
+
+	// Failed actions are retried on the next reload.
+	metrics := reloadedSpanMetrics(oldMetrics, newMetrics, summary.Failed)
+	plan, err = planSpanMetricReload(metrics, newMetrics)
+	require.NoError(t, err)
+	require.Len(t, plan.create, 1)
+	require.Equal(t, "added", plan.create[0].Name)
+	require.Len(t, plan.drop, 1)
+	require.Equal(t, "removed", plan.drop[0].Name)
+}
+
+func TestPlanSpanMetricReloadDuplicate(t *testing.T) {
+	_, err := planSpanMetricReload(nil, []bunconf.SpanMetric{
+		{Name: "dup", Instrument: "counter", Value: "1"},
+		{Name: "dup", Instrument: "counter", Value: "1"},
+	})
+	require.Error(t, err)
+}
+
+func TestSpanMetricList(t *testing.T) {
+	var list spanMetricList
+
+	_, ok := list.load()
+	require.False(t, ok)
+
+	metrics := []bunconf.SpanMetric{{Name: "added", Instrument: "gauge", Value: ".duration"}}
+	list.store(metrics)
+
+	got, ok := list.load()
+	require.True(t, ok)
+	require.Equal(t, metrics, got)
+
+	// An empty reload removes all metrics instead of falling back to the config.
+	list.store(nil)
+	got, ok = list.load()
+	require.True(t, ok)
+	require.Empty(t, got)
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/bunotel"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"go.uber.org/zap"
+)
+
+// spanMetricStaleness describes how long ago a span metric view last wrote data.
+type spanMetricStaleness struct {
+	Metric string
+	View   string
+	// LastTime is the start of the latest stored bucket or zero when
+	// the metric has no data in the lookback period.
+	LastTime  time.Time
+	Staleness time.Duration
+	Stale     bool
+}
+
+// initSpanMetricStaleness reports the staleness of every enabled span metric
+// as the uptrace.span_metrics.staleness gauge when span_metric_stale_after is set.
+func initSpanMetricStaleness(app *bunapp.App) error {
+	staleAfter := app.Config().SpanMetricStaleAfter
+	if staleAfter <= 0 {
+		return nil
+	}
+
+	gauge, err := bunotel.Meter.Float64ObservableGauge("uptrace.span_metrics.staleness",
+		otelmetric.WithDescription("Time since the latest bucket written by a span metric"),
+		otelmetric.WithUnit("s"),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = bunotel.Meter.RegisterCallback(
+		func(ctx context.Context, o otelmetric.Observer) error {
+			items, err := checkSpanMetricStaleness(ctx, chDB{db: app.CH}, app.Config(),
+				currentSpanMetrics(app), staleAfter, time.Now())
+			if err != nil {
+				app.Zap(ctx).Error("checkSpanMetricStaleness failed", zap.Error(err))
+			}
+			for _, item := range items {
+				o.ObserveFloat64(gauge, item.Staleness.Seconds(), otelmetric.WithAttributes(
+					attribute.String("metric", item.Metric),
+					attribute.String("view", item.View),
+					attribute.Bool("stale", item.Stale),
+				))
+			}
+			return nil
+		},
+		gauge,
+	)
+	return err
+}
+
+// checkSpanMetricStaleness returns the staleness of the enabled metrics. Metrics without
+// data in the lookback period, which is twice staleAfter, are stale for the whole lookback.
+func checkSpanMetricStaleness(
+	ctx context.Context,
+	db chRowScanner,
+	conf *bunconf.Config,
+	metrics []bunconf.SpanMetric,
+	staleAfter time.Duration,
+	now time.Time,
+) ([]spanMetricStaleness, error) {
+	lookback := 2 * staleAfter
+
+	items := make([]spanMetricStaleness, 0, len(metrics))
+	for i := range metrics {
+		metric := &metrics[i]
+		if !metric.IsEnabled() {
+			continue
+		}
+
+		var unix uint64
+		if err := db.scanRow(
+			ctx, buildSpanMetricLastTimeQuery(metric.Name, lookback), &unix,
+		); err != nil {
+			return items, fmt.Errorf("can't select the last time of %q: %w", metric.Name, err)
+		}
+
+		item := spanMetricStaleness{
+			Metric:    metric.Name,
+			View:      conf.SpanMetricViewName(metric.Name),
+			Staleness: lookback,
+		}
+		if unix > 0 {
+			item.LastTime = time.Unix(int64(unix), 0)
+			item.Staleness = now.Sub(item.LastTime)
+		}
+		item.Stale = item.Staleness > staleAfter
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// buildSpanMetricLastTimeQuery selects the start of the latest bucket of the metric
+// as a Unix timestamp, or 0 when there is no data in the lookback period.
+func buildSpanMetricLastTimeQuery(name string, lookback time.Duration) string {
+	b := []byte("SELECT toUInt64(toUnixTimestamp(max(time))) FROM ?DB.measure_minutes" +
+		" WHERE metric = ")
+	b = appendCHEscapedString(b, name)
+	b = append(b, " AND time >= now() - toIntervalSecond("...)
+	b = strconv.AppendInt(b, int64(lookback.Seconds()), 10)
+	b = append(b, ')')
+	return string(b)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+)
+
+// fakeLastTimeScanner returns the last time of the metric whose name is in the query.
+type fakeLastTimeScanner struct {
+	queries []string
+	times   map[string]time.Time
+}
+
+func (db *fakeLastTimeScanner) scanRow(ctx context.Context, query string, dest ...any) error {
+	db.queries = append(db.queries, query)
+	for name, tm := range db.times {
+		if strings.Contains(query, "'"+name+"'") {
+			*dest[0].(*uint64) = uint64(tm.Unix())
+			return nil
+		}
+	}
+	*dest[0].(*uint64) = 0
+	return nil
+}
+
+func TestCheckSpanMetricStaleness(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 10, 20, 12, 0, 0, 0, time.UTC)
+	disabled := false
+
+	metrics := []bunconf.SpanMetric{
+		{Name: "fresh"},
+		{Name: "stalled"},
+		{Name: "empty"},
+		{Name: "disabled", Enabled: &disabled},
+	}
+	db := &fakeLastTimeScanner{
+		times: map[string]time.Time{
+			"fresh":   now.Add(-2 * time.Minute),
+			"stalled": now.Add(-time.Hour),
+		},
+	}
+
+	items, err := checkSpanMetricStaleness(
+		ctx, db, new(bunconf.Config), metrics, 10*time.Minute, now)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	require.Len(t, db.queries, 3)
+	require.Equal(t, "SELECT toUInt64(toUnixTimestamp(max(time))) FROM ?DB.measure_minutes "+
+		"WHERE metric = 'fresh' AND time >= now() - toIntervalSecond(1200)", db.queries[0])
+
+	require.Equal(t, "fresh", items[0].Metric)
+	require.Equal(t, "metrics_fresh_mv", items[0].View)
+	require.Equal(t, 2*time.Minute, items[0].Staleness)
+	require.False(t, items[0].Stale)
+
+	require.Equal(t, "stalled", items[1].Metric)
+	require.True(t, now.Add(-time.Hour).Equal(items[1].LastTime))
+	require.Equal(t, time.Hour, items[1].Staleness)
+	require.True(t, items[1].Stale)
+
+	// Metrics without data in the lookback period are stale for the whole lookback.
+	require.Equal(t, "empty", items[2].Metric)
+	require.True(t, items[2].LastTime.IsZero())
+	require.Equal(t, 20*time.Minute, items[2].Staleness)
+	require.True(t, items[2].Stale)
+}
@@ -0,0 +1,2652 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/go-clickhouse/ch/chschema"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"github.com/uptrace/uptrace/pkg"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"github.com/uptrace/uptrace/pkg/metrics/mql/ast"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCompileSpanMetricWhere(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{".duration between 100ms and 500ms", `s."duration" BETWEEN 100000000 AND 500000000`},
+		{"span.duration between 1s and 2s", `s."duration" BETWEEN 1000000000 AND 2000000000`},
+		{".duration between 100 and 100", `s."duration" BETWEEN 100 AND 100`},
+		{".duration not between 100ms and 500ms", `s."duration" NOT BETWEEN 100000000 AND 500000000`},
+		{
+			".duration between 1ms and 2ms and .status_code = 'error'",
+			`s."duration" BETWEEN 1000000 AND 2000000 AND s."status_code" = 'error'`,
+		},
+		{"span.kind = 'server'", `s."kind" = 'server'`},
+		{"span.is_root = true", `(s.parent_id = 0) = true`},
+		{"服务.name = 'api'", `s.attr_values[indexOf(s.attr_keys, '服务.name')] = 'api'`},
+		{"span.is_root = false and span.kind = 'consumer'", `(s.parent_id = 0) = false AND s."kind" = 'consumer'`},
+		{
+			"trace.sampled = true",
+			`(NOT has(s.attr_keys, 'sampling.priority') OR ` +
+				`toFloat64OrZero(s.attr_values[indexOf(s.attr_keys, 'sampling.priority')]) > 0) = true`,
+		},
+		{
+			"trace.sampled = FALSE and span.kind = 'server'",
+			`(NOT has(s.attr_keys, 'sampling.priority') OR ` +
+				`toFloat64OrZero(s.attr_values[indexOf(s.attr_keys, 'sampling.priority')]) > 0) = false ` +
+				`AND s."kind" = 'server'`,
+		},
+		{"exists(trace.sampled)", `1`},
+		{"span.name in ('GET /health')", `s."name" IN ('GET /health')`},
+		{
+			"span.name not in ('GET /health', 'GET /ready')",
+			`NOT s."name" IN ('GET /health', 'GET /ready')`,
+		},
+		{
+			"span.name NOT IN ('GET /health') and span.kind in ('server', 'consumer')",
+			`NOT s."name" IN ('GET /health') AND s."kind" IN ('server', 'consumer')`,
+		},
+		{
+			"http.route like '/api/%'",
+			`s.attr_values[indexOf(s.attr_keys, 'http.route')] LIKE '/api/%'`,
+		},
+		{
+			"http.route not like '/api/%.json'",
+			`s.attr_values[indexOf(s.attr_keys, 'http.route')] NOT LIKE '/api/%.json'`,
+		},
+		{
+			`match(http.route, '^/api/v\d+\.json$') and span.kind = 'server'`,
+			`match(s.attr_values[indexOf(s.attr_keys, 'http.route')], '^/api/v\\d+\\.json$') ` +
+				`AND s."kind" = 'server'`,
+		},
+		{`span.name ~ "^GET /"`, `match(s."name", '^GET /')`},
+		{`MATCH(span.name, '^GET /(a|b),c$')`, `match(s."name", '^GET /(a|b),c$')`},
+		{`span.name = 'match(foo, "bar")'`, `s."name" = 'match(foo, "bar")'`},
+		{
+			`span.name = 'match(foo, "bar")' or match(span.kind, 'server')`,
+			`s."name" = 'match(foo, "bar")' OR match(s."kind", 'server')`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricWhere(test.in, "", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+}
+
+func TestCompileSpanMetricReportsAllErrors(t *testing.T) {
+	_, err := compileSpanMetric(&bunconf.SpanMetric{
+		Name:        "test",
+		Instrument:  "counter",
+		Value:       "sum(.count",
+		Attrs:       []string{".system"},
+		Annotations: []string{"endpoint: any(http.route"},
+		Where:       []string{".duration >"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid value")
+	require.Contains(t, err.Error(), "invalid annotations")
+	require.Contains(t, err.Error(), "invalid where")
+}
+
+func TestCompileSpanMetricWhereList(t *testing.T) {
+	single, err := compileSpanMetricWhere(
+		".kind = 'server' and http.route like '/api/%'", "", time.Minute)
+	require.NoError(t, err)
+
+	list, err := compileSpanMetricWhereList(
+		[]string{".kind = 'server'", "http.route like '/api/%'"}, "", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, single, list)
+
+	list, err = compileSpanMetricWhereList(
+		[]string{".kind = 'server' or .kind = 'consumer'", ".is_root = true"}, "", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`(s."kind" = 'server' OR s."kind" = 'consumer') AND (s.parent_id = 0) = true`, string(list))
+
+	_, err = compileSpanMetricWhereList([]string{".duration >", ".kind ="}, "", time.Minute)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Contains(t, err.Error(), `".duration >"`)
+	require.Contains(t, err.Error(), `".kind ="`)
+
+	var metric bunconf.SpanMetric
+	require.NoError(t, yaml.Unmarshal([]byte(`where: span.kind = 'server'`), &metric))
+	require.Equal(t, []string{"span.kind = 'server'"}, metric.Where)
+
+	metric = bunconf.SpanMetric{}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+where:
+  - span.kind = 'server'
+  - span.is_root = true
+`), &metric))
+	require.Equal(t, []string{"span.kind = 'server'", "span.is_root = true"}, metric.Where)
+}
+
+func TestCompileSpanMetricWhereEmpty(t *testing.T) {
+	// An empty where is intentional and matches all spans.
+	for _, in := range []string{`where: ""`, `where: "  "`, `where: []`, `where:`} {
+		var metric bunconf.SpanMetric
+		require.NoError(t, yaml.Unmarshal([]byte(in), &metric), in)
+		require.Empty(t, metric.Where, in)
+
+		metric.Name = "test"
+		metric.Instrument = "counter"
+		metric.Value = "count()"
+		exprs, err := compileSpanMetric(&metric)
+		require.NoError(t, err, in)
+		require.Empty(t, exprs.where, in)
+	}
+
+	// Blank conditions are skipped as long as some condition is left.
+	list, err := compileSpanMetricWhereList([]string{"", ".kind = 'server'"}, "", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `s."kind" = 'server'`, string(list))
+
+	var metric bunconf.SpanMetric
+	require.NoError(t, yaml.Unmarshal([]byte(`
+where:
+  - ""
+  - " "
+`), &metric))
+	metric.Name = "test"
+	metric.Instrument = "counter"
+	metric.Value = "count()"
+	_, err = compileSpanMetric(&metric)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "where", compileErr.Field)
+	require.Contains(t, err.Error(), "all 2 where conditions are empty")
+}
+
+func TestCompileSpanMetricWhereExists(t *testing.T) {
+	type Test struct {
+		where    string
+		expected string
+	}
+
+	tests := []Test{
+		{"exists(http.route)", `has(s.attr_keys, 'http.route')`},
+		{"not exists(http.route)", `NOT has(s.attr_keys, 'http.route')`},
+		{"http.route exists", `has(s.attr_keys, 'http.route')`},
+		{"exists(service.name)", `s."service_name" != ''`},
+		{"not exists(db.system)", `s."db_system" = ''`},
+		{"exists(span.name)", `1`},
+		{"not exists(span.name)", `0`},
+		{"NOT EXISTS(http.route)", `NOT has(s.attr_keys, 'http.route')`},
+		{"span.name = 'exists(foo)'", `s."name" = 'exists(foo)'`},
+		{
+			"span.name = 'not exists(foo)' and exists(http.route)",
+			`s."name" = 'not exists(foo)' AND has(s.attr_keys, 'http.route')`,
+		},
+		{
+			"span.kind = 'server' and (exists(http.route) or not exists(db.system))",
+			`s."kind" = 'server' AND (has(s.attr_keys, 'http.route') OR s."db_system" = '')`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			where, err := compileSpanMetricWhere(test.where, "", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, string(where))
+		})
+	}
+}
+
+func TestCompileSpanMetricWhereGroups(t *testing.T) {
+	type Test struct {
+		where    string
+		expected string
+	}
+
+	tests := []Test{
+		{
+			".duration > 1 and (.kind = 'server' or .kind = 'consumer')",
+			`s."duration" > 1 AND (s."kind" = 'server' OR s."kind" = 'consumer')`,
+		},
+		{
+			"(.duration > 1 and .kind = 'server') or .kind = 'consumer'",
+			`s."duration" > 1 AND s."kind" = 'server' OR s."kind" = 'consumer'`,
+		},
+		{
+			".duration > 1 and .kind = 'server' or .kind = 'consumer'",
+			`s."duration" > 1 AND s."kind" = 'server' OR s."kind" = 'consumer'`,
+		},
+		{
+			"(.kind = 'server' or .kind = 'consumer') and (.system = 'http' or .system = 'rpc')",
+			`(s."kind" = 'server' OR s."kind" = 'consumer') AND ` +
+				`(s."system" = 'http' OR s."system" = 'rpc')`,
+		},
+		{
+			".duration > 1 and (.kind = 'server' or (.kind = 'client' and .system in ('http', 'rpc')))",
+			`s."duration" > 1 AND (s."kind" = 'server' OR ` +
+				`s."kind" = 'client' AND s."system" IN ('http', 'rpc'))`,
+		},
+		{
+			"((.duration > 1))",
+			`s."duration" > 1`,
+		},
+		{
+			"where .duration > 1 and ({.kind,.system} = 'x')",
+			`s."duration" > 1 AND (s."kind" = 'x' OR s."system" = 'x')`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			where, err := compileSpanMetricWhere(test.where, "", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, string(where))
+		})
+	}
+
+	for _, where := range []string{
+		".duration > 1 and (.kind = 'server'",
+		".duration > 1 and .kind = 'server')",
+		"()",
+	} {
+		_, err := compileSpanMetricWhere(where, "", time.Minute)
+		require.Error(t, err, where)
+	}
+}
+
+func TestCompileSpanMetricError(t *testing.T) {
+	_, err := compileSpanMetricValue("sum(.count) +", time.Minute)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "value", compileErr.Field)
+	require.Equal(t, "sum(.count) +", compileErr.Expr)
+	require.Equal(t, "sum(.count", compileErr.Expr[:compileErr.Pos])
+
+	_, _, err = compileSpanMetricAttrs([]string{"toNumber()"}, time.Minute)
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "attrs", compileErr.Field)
+	require.Equal(t, "toNumber()", compileErr.Expr)
+
+	_, err = compileSpanMetricWhere(".duration > $threshold", "", time.Minute)
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "where", compileErr.Field)
+	require.Equal(t, -1, compileErr.Pos)
+
+	_, err = compileSpanMetricValue("sum(span.@duration)", time.Minute)
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, 9, compileErr.Pos)
+	require.Equal(t, `invalid value "sum(span.@duration)": `+
+		`unexpected character '@' at position 9`, err.Error())
+}
+
+func TestSpanMetricViewBucket(t *testing.T) {
+	type Test struct {
+		bucket   string
+		timezone string
+		wanted   string
+	}
+
+	tests := []Test{
+		{"", "", "toStartOfMinute(s.time)"},
+		{"minute", "", "toStartOfMinute(s.time)"},
+		{"hour", "", "toStartOfHour(s.time)"},
+		{"", "Asia/Kolkata", "toStartOfInterval(s.time, INTERVAL 1 minute, 'Asia/Kolkata')"},
+		{"hour", "America/New_York", "toStartOfInterval(s.time, INTERVAL 1 hour, 'America/New_York')"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric := &bunconf.SpanMetric{
+				Name:       "uptrace.tracing.spans",
+				Instrument: "counter",
+				Value:      ".count",
+				BucketUnit: test.bucket,
+				Timezone:   test.timezone,
+			}
+			query := renderSpanMetricView(t, metric)
+			require.Contains(t, query, test.wanted+" AS time")
+			require.Contains(t, query, "GROUP BY s.project_id, "+test.wanted)
+		})
+	}
+
+	_, err := compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "counter",
+		Value:      ".count",
+		BucketUnit: "day",
+	})
+	require.Error(t, err)
+
+	_, err = compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "counter",
+		Value:      ".count",
+		Timezone:   "America/Nowhere",
+	})
+	require.Error(t, err)
+}
+
+func renderSpanMetricView(t *testing.T, metric *bunconf.SpanMetric) string {
+	_, create, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+	require.NoError(t, err)
+
+	fmter := chschema.NewFormatter().WithNamedArg("DB", ch.Safe("uptrace"))
+	return fmter.FormatQuery(create)
+}
+
+func TestSpanMetricViewQuantileAlgorithm(t *testing.T) {
+	type Test struct {
+		algo   string
+		column string
+		state  string
+	}
+
+	tests := []Test{
+		{"", "histogram", `quantilesBFloat16State(0.5)(toFloat32(s."duration")) AS histogram`},
+		{QuantileBFloat16, "histogram", `quantilesBFloat16State(0.5)(toFloat32(s."duration")) AS histogram`},
+		{QuantileTDigest, "tdigest", `quantilesTDigestState(0.5)(toFloat32(s."duration")) AS tdigest`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric := &bunconf.SpanMetric{
+				Name:              "uptrace.tracing.spans",
+				Instrument:        "histogram",
+				Value:             ".duration",
+				QuantileAlgorithm: test.algo,
+			}
+			query := renderSpanMetricView(t, metric)
+			require.Contains(t, query, test.state)
+
+			exprs, err := compileSpanMetric(metric)
+			require.NoError(t, err)
+			require.Equal(t, []string{"project_id", "metric", "time", "instrument",
+				"count", "sum", test.column}, spanMetricViewColumns(metric, exprs))
+
+			preview, err := buildSpanMetricPreviewQuery(metric, exprs, time.Minute)
+			require.NoError(t, err)
+			require.Contains(t, preview, "finalizeAggregation("+test.column+")[1] AS p50")
+		})
+	}
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "a", Instrument: "histogram", Value: ".duration", QuantileAlgorithm: "buckets"},
+		{Name: "b", Instrument: "counter", Value: ".count", QuantileAlgorithm: QuantileTDigest},
+	} {
+		_, err := compileSpanMetric(metric)
+		var compileErr *CompileError
+		require.ErrorAs(t, err, &compileErr, metric.Name)
+		require.Equal(t, "quantile_algorithm", compileErr.Field)
+	}
+}
+
+func TestValidateSpanMetricDeduplicate(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+	}
+	require.NoError(t, validateSpanMetricDeduplicate(metric))
+
+	metric.Deduplicate = true
+	_, err := compileSpanMetric(metric)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "deduplicate", compileErr.Field)
+	require.ErrorContains(t, err, "deduplicate is not supported")
+}
+
+func TestCompileSpanMetricToNumber(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{
+			"toNumber(http.response.body.size)",
+			`toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'http.response.body.size')]))`,
+		},
+		{
+			"toNumber(http.response.body.size, 0)",
+			`ifNull(toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'http.response.body.size')])), 0)`,
+		},
+		{
+			"sum(toNumber(http.response.body.size, 0))",
+			`sum(ifNull(toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'http.response.body.size')])), 0))`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.in, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+
+	for _, in := range []string{"toNumber(1)", "toNumber(http.route, foo)"} {
+		_, err := compileSpanMetricValue(in, time.Minute)
+		require.Error(t, err, "in=%q", in)
+	}
+}
+
+func TestCompileSpanMetricCoalesce(t *testing.T) {
+	const attr = `toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'db.rows')]))`
+
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{"coalesce(db.rows, 0)", `coalesce(` + attr + `, 0)`},
+		{"ifNull(db.rows, 1.5)", `ifNull(` + attr + `, 1.5)`},
+		{"sum(coalesce(db.rows, 0))", `sum(coalesce(` + attr + `, 0))`},
+		{"coalesce(db.rows, 0) * 2", `coalesce(` + attr + `, 0) * 2`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.in, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:       "db.rows",
+		Instrument: "histogram",
+		Value:      "coalesce(db.rows, 0)",
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `sum(coalesce(`+attr+`, 0)) AS sum`)
+	require.Contains(t, query, `(toFloat32(coalesce(`+attr+`, 0))) AS histogram`)
+
+	for _, in := range []string{
+		"coalesce(db.rows)",
+		"coalesce(db.rows, 0, 1)",
+		"coalesce(db.rows, foo)",
+		"ifNull(1, 0)",
+	} {
+		_, err := compileSpanMetricValue(in, time.Minute)
+		require.Error(t, err, "in=%q", in)
+	}
+}
+
+func TestSpanMetricViewCount(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "http.server.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Where:      []string{"http.route = '/api/users' and span.kind = 'server'"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "count() AS sum")
+	require.Contains(t, query,
+		`WHERE (s.attr_values[indexOf(s.attr_keys, 'http.route')] = '/api/users' AND s."kind" = 'server')`)
+}
+
+func TestSpanMetricAttrLabels(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "http.server.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs:      []string{"status=http.response.status_code", "service.name", "host.name as host"},
+	}
+
+	require.Equal(t, []string{"status", "service.name", "host"}, spanMetricAttrKeys(metric.Attrs))
+
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "['status', 'service.name', 'host'] AS string_keys")
+	require.Contains(t, query,
+		"GROUP BY s.project_id, toStartOfMinute(s.time), "+
+			"toString(s.attr_values[indexOf(s.attr_keys, 'http.response.status_code')]), "+
+			`toString(s."service_name"), toString(s."host_name")`)
+}
+
+func TestCompileSpanMetricWhereThreshold(t *testing.T) {
+	got, err := compileSpanMetricWhere(".duration > $threshold", "p95_thresholds", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`s."duration" > dictGet('p95_thresholds', 'threshold', s.service_name)`, string(got))
+
+	_, err = compileSpanMetricWhere(".duration > $threshold", "", time.Minute)
+	require.Error(t, err)
+
+	got, err = compileSpanMetricWhere("span.name = '$threshold'", "", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `s."name" = '$threshold'`, string(got))
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestBuildSpanMetricQueries(t *testing.T) {
+	type Test struct {
+		name   string
+		metric bunconf.SpanMetric
+	}
+
+	tests := []Test{
+		{"gauge", bunconf.SpanMetric{
+			Name:       "uptrace.tracing.gauge",
+			Instrument: "gauge",
+			Value:      "max(.duration)",
+		}},
+		{"gauge_full", bunconf.SpanMetric{
+			Name:        "uptrace.tracing.gauge",
+			Instrument:  "gauge",
+			Value:       "max(.duration)",
+			Attrs:       []string{".system", "service.name"},
+			Annotations: []string{"display.name"},
+			Where:       []string{".kind = 'server'"},
+		}},
+		{"counter", bunconf.SpanMetric{
+			Name:       "uptrace.tracing.requests",
+			Instrument: "counter",
+			Value:      ".count",
+		}},
+		{"counter_full", bunconf.SpanMetric{
+			Name:        "uptrace.tracing.requests",
+			Instrument:  "counter",
+			Value:       ".count",
+			Attrs:       []string{"status=http.response.status_code", "host.name"},
+			Annotations: []string{"endpoint: any(http.route)"},
+			Where:       []string{".is_root = true"},
+		}},
+		{"histogram", bunconf.SpanMetric{
+			Name:       "uptrace.tracing.spans",
+			Instrument: "histogram",
+			Value:      ".duration / 1000",
+		}},
+		{"histogram_full", bunconf.SpanMetric{
+			Name:        "uptrace.tracing.spans",
+			Instrument:  "histogram",
+			Value:       ".duration / 1000",
+			Attrs:       []string{".system", ".group_id", "service.name", ".status_code"},
+			Annotations: []string{"display.name", "p50: p50(.duration)"},
+			Where:       []string{".duration > 10ms"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drop, create, err := BuildSpanMetricQueries(new(bunconf.Config), &test.metric)
+			require.NoError(t, err)
+
+			got := drop + ";\n\n" + create + ";\n"
+			path := filepath.Join("testdata", "span_metric", test.name+".sql")
+
+			if *updateGolden {
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				require.NoError(t, os.WriteFile(path, []byte(got), 0o644))
+			}
+
+			wanted, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, string(wanted), got)
+		})
+	}
+}
+
+func TestCompileSpanMetricWhereDuration(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{"span.duration > 500", `s."duration" > 500`},
+		{"span.duration > 500ns", `s."duration" > 500`},
+		{"span.duration > 500us", `s."duration" > 500000`},
+		{"span.duration > 500µs", `s."duration" > 500000`},
+		{"span.duration > 100ms", `s."duration" > 100000000`},
+		{"span.duration > 1.5ms", `s."duration" > 1500000`},
+		{"span.duration >= 2s", `s."duration" >= 2000000000`},
+		{"span.duration < 1m", `s."duration" < 60000000000`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricWhere(test.in, "", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+}
+
+func TestBuildSpanMetricQueriesDisabled(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+	}
+
+	enabled := false
+	metric.Enabled = &enabled
+
+	drop, create, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+	require.NoError(t, err)
+	require.Equal(t, `DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_requests_mv"`, drop)
+	require.Empty(t, create)
+
+	enabled = true
+
+	drop2, create, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+	require.NoError(t, err)
+	require.Equal(t, drop, drop2)
+	require.Contains(t, create, `CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv"`)
+}
+
+type recordingExecer struct {
+	queries []string
+	errs    map[string]error // query prefix => error
+}
+
+func (db *recordingExecer) ExecContext(
+	ctx context.Context, query string, args ...any,
+) (sql.Result, error) {
+	db.queries = append(db.queries, query)
+	for prefix, err := range db.errs {
+		if strings.HasPrefix(query, prefix) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// commentRejectingExecer fails queries with view comments like older ClickHouse versions.
+type commentRejectingExecer struct {
+	recordingExecer
+}
+
+func (db *commentRejectingExecer) ExecContext(
+	ctx context.Context, query string, args ...any,
+) (sql.Result, error) {
+	if strings.Contains(query, " COMMENT ") {
+		db.queries = append(db.queries, query)
+		return nil, &ch.Error{Code: chSyntaxError}
+	}
+	return db.recordingExecer.ExecContext(ctx, query, args...)
+}
+
+func TestLegacySpanMetricView(t *testing.T) {
+	conf := &bunconf.Config{
+		MetricsFromSpans: []bunconf.SpanMetric{
+			{Name: "http.server.duration"},
+			{Name: "http_server_duration"},
+			{Name: "db_calls"},
+		},
+	}
+
+	_, ok := legacySpanMetricView(conf, conf.MetricsFromSpans, "http.server.duration")
+	require.False(t, ok)
+
+	// The legacy name of http_server_duration is used by http.server.duration now.
+	_, ok = legacySpanMetricView(conf, conf.MetricsFromSpans, "http_server_duration")
+	require.False(t, ok)
+
+	viewName, ok := legacySpanMetricView(conf, conf.MetricsFromSpans, "db_calls")
+	require.True(t, ok)
+	require.Equal(t, "metrics_db_calls_mv", viewName)
+	require.NotEqual(t, viewName, conf.SpanMetricViewName("db_calls"))
+}
+
+func TestCheckSpanMetricCluster(t *testing.T) {
+	ctx := context.Background()
+
+	db := new(fakeRowScanner)
+	require.NoError(t, checkSpanMetricCluster(ctx, db, ""))
+	require.Empty(t, db.query)
+
+	db = &fakeRowScanner{count: 3}
+	require.NoError(t, checkSpanMetricCluster(ctx, db, "uptrace1"))
+	require.Equal(t,
+		"SELECT count() FROM system.clusters WHERE cluster = 'uptrace1'", db.query)
+
+	db = &fakeRowScanner{count: 0}
+	err := checkSpanMetricCluster(ctx, db, "missing")
+	require.EqualError(t, err, "ON CLUSTER 'missing' not found in system.clusters")
+}
+
+func TestSpanMetricViewComment(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	_, create, err := buildSpanMetricQueries(metric, "metrics_mv", "", exprs)
+	require.NoError(t, err)
+	require.NotContains(t, create, " COMMENT ")
+
+	exprs.comment, err = spanMetricViewComment(metric)
+	require.NoError(t, err)
+	_, create, err = buildSpanMetricQueries(metric, "metrics_mv", "", exprs)
+	require.NoError(t, err)
+
+	i := strings.LastIndex(create, " COMMENT '")
+	require.NotEqual(t, -1, i, create)
+	require.True(t, strings.HasSuffix(create, "'"), create)
+	comment := create[i+len(" COMMENT '") : len(create)-1]
+
+	var meta spanMetricViewMeta
+	require.NoError(t, json.Unmarshal([]byte(comment), &meta))
+	require.Equal(t, "uptrace.tracing.requests", meta.Metric)
+	require.Equal(t, pkg.Version(), meta.Version)
+
+	hash, err := spanMetricHash(metric)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%016x", hash), meta.ConfigHash)
+}
+
+func TestBuildSpanMetricQueriesViewNameTemplate(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+	}
+	conf := &bunconf.Config{ViewNameTemplate: "um_{name}_mv"}
+
+	drop, create, err := BuildSpanMetricQueries(conf, metric)
+	require.NoError(t, err)
+	require.Equal(t, `DROP VIEW IF EXISTS ?DB."um_uptrace_tracing_requests_mv"`, drop)
+	require.True(t, strings.HasPrefix(create,
+		`CREATE MATERIALIZED VIEW ?DB."um_uptrace_tracing_requests_mv" TO `), create)
+}
+
+func TestBuildSpanMetricQueriesReservedWords(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "table",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"index", "select = span.name"},
+	}
+	conf := &bunconf.Config{ViewNameTemplate: "{name}"}
+
+	drop, create, err := BuildSpanMetricQueries(conf, metric)
+	require.NoError(t, err)
+	require.Equal(t, `DROP VIEW IF EXISTS ?DB."table"`, drop)
+	require.True(t, strings.HasPrefix(create, `CREATE MATERIALIZED VIEW ?DB."table" TO `), create)
+	require.Contains(t, create, `'table' AS metric`)
+	require.Contains(t, create, `['index', 'select'] AS string_keys`)
+	require.Contains(t, create, `toString(s.attr_values[indexOf(s.attr_keys, 'index')])`)
+	require.Contains(t, create, `toString(s."name")`)
+
+	require.Equal(t, `EXCHANGE TABLES ?DB."table" AND ?DB."table_tmp"`,
+		buildExchangeQuery("table", "table"+spanMetricTempViewSuffix, ""))
+}
+
+func TestExecSpanMetricView(t *testing.T) {
+	ctx := context.Background()
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	viewName := bunconf.SpanMetricViewName("", metric.Name)
+
+	const (
+		drop     = `DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_requests_mv"`
+		dropTemp = `DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_requests_mv_tmp"`
+		exchange = `EXCHANGE TABLES ?DB."metrics_uptrace_tracing_requests_mv" ` +
+			`AND ?DB."metrics_uptrace_tracing_requests_mv_tmp"`
+	)
+
+	t.Run("create", func(t *testing.T) {
+		db := new(recordingExecer)
+		swapped, err := execSpanMetricView(ctx, db, metric, viewName, "", exprs, false)
+		require.NoError(t, err)
+		require.False(t, swapped)
+		require.Len(t, db.queries, 2)
+		require.Equal(t, drop, db.queries[0])
+		require.Contains(t, db.queries[1],
+			`CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv" `)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		db := new(recordingExecer)
+		swapped, err := execSpanMetricView(ctx, db, metric, viewName, "", exprs, true)
+		require.NoError(t, err)
+		require.True(t, swapped)
+		require.Len(t, db.queries, 4)
+		require.Equal(t, dropTemp, db.queries[0])
+		require.Contains(t, db.queries[1],
+			`CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv_tmp" `)
+		require.Equal(t, exchange, db.queries[2])
+		require.Equal(t, dropTemp, db.queries[3])
+		for _, query := range db.queries {
+			require.NotEqual(t, drop, query)
+		}
+	})
+
+	t.Run("update without exchange", func(t *testing.T) {
+		db := &recordingExecer{
+			errs: map[string]error{"EXCHANGE": &ch.Error{Code: chNotImplemented}},
+		}
+		swapped, err := execSpanMetricView(ctx, db, metric, viewName, "", exprs, true)
+		require.NoError(t, err)
+		require.False(t, swapped)
+		require.Equal(t, exchange, db.queries[2])
+		require.Equal(t, dropTemp, db.queries[3])
+		require.Equal(t, drop, db.queries[4])
+		require.Contains(t, db.queries[5],
+			`CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv" `)
+	})
+
+	t.Run("update with failed create", func(t *testing.T) {
+		createErr := &ch.Error{Code: chSyntaxError}
+		db := &recordingExecer{
+			errs: map[string]error{"CREATE MATERIALIZED VIEW": createErr},
+		}
+		_, err := execSpanMetricView(ctx, db, metric, viewName, "", exprs, true)
+		require.ErrorIs(t, err, createErr)
+		require.Len(t, db.queries, 2)
+		for _, query := range db.queries {
+			require.NotEqual(t, drop, query)
+		}
+	})
+
+	t.Run("update without comments", func(t *testing.T) {
+		db := &commentRejectingExecer{}
+		exprs := *exprs
+		exprs.comment = `{"metric":"uptrace.tracing.requests"}`
+		swapped, err := execSpanMetricViewWithFallbacks(
+			ctx, otelzap.New(zap.NewNop()).Ctx(ctx), db, metric, viewName, "", &exprs, true)
+		require.NoError(t, err)
+		require.True(t, swapped)
+		for _, query := range db.queries {
+			require.NotEqual(t, drop, query)
+		}
+		require.Equal(t, exchange, db.queries[len(db.queries)-2])
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		db := new(recordingExecer)
+		_, err := execSpanMetricView(ctx, db, metric, viewName, "main", exprs, true)
+		require.NoError(t, err)
+		require.Equal(t, exchange+` ON CLUSTER "main"`, db.queries[2])
+	})
+}
+
+func TestValidateSpanMetricOrderBy(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:  "test",
+		Value: "count()",
+		Attrs: []string{"status=http.response.status_code"},
+	}
+	require.NoError(t, validateSpanMetricOrderBy(metric))
+
+	metric.OrderBy = []string{"project_id", "time", "status"}
+	_, err := compileSpanMetric(metric)
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "order_by", compileErr.Field)
+	require.ErrorContains(t, err, "order_by is not supported")
+}
+
+func TestCompileSpanMetricUnary(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{"-span.duration", `-(s."duration")`},
+		{"-.duration / 1000", `-(s."duration") / 1000`},
+		{"not (span.duration > 100)", `NOT (s."duration" > 100)`},
+		{"NOT (.duration > 1 and .duration < 10)", `NOT (s."duration" > 1 and s."duration" < 10)`},
+		{"(.duration + 1) * 2", `(s."duration" + 1) * 2`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.in, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+}
+
+func TestCompileSpanMetricJSONExtract(t *testing.T) {
+	got, err := compileSpanMetricValue("sum(JSONExtractFloat(app.payload, 'latency'))", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`sum(JSONExtractFloat(s.attr_values[indexOf(s.attr_keys, 'app.payload')], 'latency'))`, string(got))
+
+	got, err = compileSpanMetricValue("JSONExtractInt(app.payload, 'db', 'rows')", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`JSONExtractInt(s.attr_values[indexOf(s.attr_keys, 'app.payload')], 'db', 'rows')`, string(got))
+
+	attrs, aliases, err := compileSpanMetricAttrs(
+		[]string{"tenant=JSONExtractString(app.payload, 'tenant')"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant"}, aliases)
+	require.Equal(t,
+		`toString(JSONExtractString(s.attr_values[indexOf(s.attr_keys, 'app.payload')], 'tenant'))`,
+		string(attrs))
+
+	_, err = compileSpanMetricValue("JSONExtractFloat(app.payload)", time.Minute)
+	require.Error(t, err)
+}
+
+func TestCheckSpanMetricAttrKeys(t *testing.T) {
+	type Test struct {
+		attrs  []string
+		where  string
+		wanted int
+	}
+
+	tests := []Test{
+		{[]string{"service.name"}, "service.name = 'api'", 0},
+		{[]string{"service.name"}, "service_name = 'api'", 1},
+		{[]string{"http.status_code"}, "http.status.code = 200", 1},
+		{[]string{"app.tenant"}, "app.tenant = 'acme' and span.kind = 'server'", 0},
+		{nil, "host.name = 'a' and .duration > 1ms", 0},
+		{nil, "app.tenant = 'acme'", 1},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			warnings := checkSpanMetricAttrKeys(&bunconf.SpanMetric{
+				Attrs: test.attrs,
+				Where: []string{test.where},
+			})
+			require.Len(t, warnings, test.wanted, "warnings=%q", warnings)
+		})
+	}
+}
+
+func TestInferSpanMetricInstrument(t *testing.T) {
+	type Test struct {
+		value      string
+		instrument string
+		wanted     string
+	}
+
+	tests := []Test{
+		{"count()", "counter", "count()"},
+		{".count", "counter", ".count"},
+		{"span.error_count", "counter", "span.error_count"},
+		{"sum(toNumber(http.response.body.size, 0))", "counter", "sum(toNumber(http.response.body.size, 0))"},
+		{"max(.duration)", "gauge", "max(.duration)"},
+		{"avg(.duration)", "gauge", "avg(.duration)"},
+		{"p99(.duration)", "histogram", ".duration"},
+		{"quantile((.duration / 1000))", "histogram", "(.duration / 1000)"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric, err := inferSpanMetricInstrument(&bunconf.SpanMetric{Value: test.value})
+			require.NoError(t, err)
+			require.Equal(t, test.instrument, metric.Instrument)
+			require.Equal(t, test.wanted, metric.Value)
+		})
+	}
+
+	for _, value := range []string{".duration / 1000", "http.route"} {
+		_, err := inferSpanMetricInstrument(&bunconf.SpanMetric{Value: value})
+		require.Error(t, err, "value=%q", value)
+	}
+
+	metric := &bunconf.SpanMetric{Instrument: "gauge", Value: "count()"}
+	got, err := inferSpanMetricInstrument(metric)
+	require.NoError(t, err)
+	require.Equal(t, "gauge", got.Instrument)
+}
+
+func TestCompileSpanMetricWhereAttrRef(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{".event_count > span.link_count", `s."event_count" > s."link_count"`},
+		{
+			"span.duration > span.deadline",
+			`s."duration" > toFloat64OrDefault(s.attr_values[indexOf(s.attr_keys, 'deadline')])`,
+		},
+		{".name != span.event_name", `s."name" != s."event_name"`},
+		{
+			"http.host = span.server.address",
+			`s.attr_values[indexOf(s.attr_keys, 'http.host')] = ` +
+				`s.attr_values[indexOf(s.attr_keys, 'server.address')]`,
+		},
+		{"http.host like 'span.%'", `s.attr_values[indexOf(s.attr_keys, 'http.host')] LIKE 'span.%'`},
+		{"span.name = 'span.x'", `s."name" = 'span.x'`},
+		{
+			`http.host != "span.server.address"`,
+			`s.attr_values[indexOf(s.attr_keys, 'http.host')] != 'span.server.address'`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricWhere(test.in, "", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got), "in=%q", test.in)
+		})
+	}
+}
+
+func TestSpanMetricViewNoQuantiles(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "histogram",
+		Value:      ".duration",
+	}
+
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	_, create, err := buildSpanMetricQueries(metric, bunconf.SpanMetricViewName("", metric.Name), "", exprs)
+	require.NoError(t, err)
+	require.Contains(t, create, "quantilesBFloat16State")
+
+	exprs.noQuantiles = true
+	_, create, err = buildSpanMetricQueries(metric, bunconf.SpanMetricViewName("", metric.Name), "", exprs)
+	require.NoError(t, err)
+	require.NotContains(t, create, "AS histogram")
+	require.Contains(t, create, "AS count")
+
+	require.True(t, isUnknownFuncError(fmt.Errorf("wrapped: %w", &ch.Error{Code: 46})))
+	require.False(t, isUnknownFuncError(&ch.Error{Code: 47}))
+}
+
+func TestExpandSpanMetricAttrs(t *testing.T) {
+	catalog := func(ctx context.Context) ([]string, error) {
+		return []string{"http.route", "http.method", "db.system", "http.status_code"}, nil
+	}
+	ctx := context.Background()
+
+	metric := &bunconf.SpanMetric{Attrs: []string{"service.name", "http.*"}}
+	expanded, err := expandSpanMetricAttrs(ctx, metric, catalog)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]string{"service.name", "http.method", "http.route", "http.status_code"}, expanded.Attrs)
+	require.Equal(t, []string{"service.name", "http.*"}, metric.Attrs)
+
+	metric = &bunconf.SpanMetric{Attrs: []string{"http.route", "http.*"}}
+	expanded, err = expandSpanMetricAttrs(ctx, metric, catalog)
+	require.NoError(t, err)
+	require.Equal(t, []string{"http.route", "http.method", "http.status_code"}, expanded.Attrs)
+
+	metric = &bunconf.SpanMetric{Attrs: []string{"service.name"}}
+	expanded, err = expandSpanMetricAttrs(ctx, metric, nil)
+	require.NoError(t, err)
+	require.Same(t, metric, expanded)
+
+	manyKeys := func(ctx context.Context) ([]string, error) {
+		keys := make([]string, spanMetricMaxWildcardAttrs+1)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("http.key%d", i)
+		}
+		return keys, nil
+	}
+	_, err = expandSpanMetricAttrs(ctx, &bunconf.SpanMetric{Attrs: []string{"http.*"}}, manyKeys)
+	require.Error(t, err)
+}
+
+func TestSpanMetricViewRelativeToRoot(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.relative_duration",
+		RelativeTo: "root",
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "INNER JOIN (SELECT trace_id, duration FROM uptrace.spans_index"+
+		" WHERE parent_id = 0 AND duration > 0")
+	require.Contains(t, query, "AS root ON root.trace_id = s.trace_id")
+	require.Contains(t, query, "quantilesBFloat16State(0.5)(toFloat32(s.duration / root.duration))")
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", RelativeTo: "parent"},
+		{Name: "test", RelativeTo: "root", Value: ".duration"},
+		{Name: "test", RelativeTo: "root", Instrument: "counter"},
+	} {
+		_, _, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+		require.Error(t, err)
+	}
+}
+
+func TestSpanMetricViewSelfDuration(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:  "uptrace.tracing.self_duration",
+		Value: "p50(span.self_duration)",
+		Attrs: []string{"service.name"},
+	}
+	metric, err := inferSpanMetricInstrument(metric)
+	require.NoError(t, err)
+	require.Equal(t, "histogram", metric.Instrument)
+
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	require.True(t, exprs.selfDuration)
+
+	conf := new(bunconf.Config)
+	require.ErrorIs(t, checkSpanMetricJoins(exprs, conf), errSelfDurationNotAllowed)
+	conf.AllowSelfDuration = true
+	require.NoError(t, checkSpanMetricJoins(exprs, conf))
+
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "FROM (SELECT s.*, greatest(s.duration - children.duration, 0) "+
+		"AS self_duration FROM uptrace.spans_index AS s LEFT JOIN (SELECT trace_id, parent_id, "+
+		"sum(duration) AS duration FROM uptrace.spans_index")
+	require.Contains(t, query,
+		"ON children.trace_id = s.trace_id AND children.parent_id = s.id) AS s")
+	require.Contains(t, query, `quantilesBFloat16State(0.5)(toFloat32(s."self_duration"))`)
+
+	exprs, err = compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "histogram",
+		Value:      ".duration",
+	})
+	require.NoError(t, err)
+	require.False(t, exprs.selfDuration)
+}
+
+func TestSpanMetricViewErrorDescendant(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.error_propagation",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs:      []string{"service.name"},
+		Where:      []string{"span.status_code != 'error' and span.has_error_descendant = true"},
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	require.True(t, exprs.errorDescendant)
+	require.False(t, exprs.selfDuration)
+
+	conf := new(bunconf.Config)
+	require.ErrorIs(t, checkSpanMetricJoins(exprs, conf), errErrorDescendantNotAllowed)
+	conf.AllowErrorDescendant = true
+	require.NoError(t, checkSpanMetricJoins(exprs, conf))
+
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "FROM (SELECT s.*, has(descendants.error_ancestors, s.id) "+
+		"AS has_error_descendant FROM uptrace.spans_index AS s LEFT JOIN "+
+		"(SELECT trace_id, arrayFilter(x -> x != 0, arrayDistinct(arrayConcat(level1, level2, "+
+		"level3, level4, level5, level6, level7, level8))) AS error_ancestors "+
+		"FROM (SELECT trace_id, groupArray(id) AS ids, groupArray(parent_id) AS parents, "+
+		"arrayFilter((p, c) -> c = 'error' AND p != 0, parents, groupArray(status_code)) AS level1, "+
+		"arrayMap(x -> parents[indexOf(ids, x)], level1) AS level2, ")
+	require.Contains(t, query, "arrayMap(x -> parents[indexOf(ids, x)], level7) AS level8 "+
+		"FROM uptrace.spans_index WHERE time >= now() - INTERVAL 1 HOUR "+
+		"GROUP BY trace_id HAVING countIf(status_code = 'error') > 0)) "+
+		"AS descendants ON descendants.trace_id = s.trace_id) AS s")
+	require.Contains(t, query,
+		`WHERE (s."status_code" != 'error' AND s."has_error_descendant" = true)`)
+	require.Contains(t, query, "count() AS sum")
+}
+
+func TestSpanMetricRawValue(t *testing.T) {
+	var metric bunconf.SpanMetric
+	err := yaml.Unmarshal([]byte(`
+name: uptrace.tracing.raw
+instrument: gauge
+value: { raw: "avg(s.duration)" }
+`), &metric)
+	require.NoError(t, err)
+	require.Equal(t, "", metric.Value)
+	require.Equal(t, "avg(s.duration)", metric.RawValue)
+
+	conf := new(bunconf.Config)
+	require.ErrorIs(t, checkSpanMetricRawValue(&metric, conf), errRawMetricExprNotAllowed)
+
+	conf.AllowRawMetricExpr = true
+	require.NoError(t, checkSpanMetricRawValue(&metric, conf))
+
+	query := renderSpanMetricView(t, &metric)
+	require.Contains(t, query, "avg(s.duration) AS gauge")
+
+	metric.Value = "avg(.duration)"
+	_, _, err = BuildSpanMetricQueries(new(bunconf.Config), &metric)
+	require.Error(t, err)
+}
+
+func TestCompileSpanMetricExemplar(t *testing.T) {
+	got, err := compileSpanMetricAnnotations([]string{"exemplar", "display.name"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`'exemplar', toString(argMax(s.trace_id, s.duration)), `+
+			`'display.name', coalesce(toString(any(s."display_name")), '')`,
+		string(got))
+}
+
+func TestCompileSpanMetricAnnotationsNotNull(t *testing.T) {
+	got, err := compileSpanMetricAnnotations([]string{
+		"display.name as name",
+		"endpoint: http.route",
+		"size: toNumber(http.request.size)",
+		"p50: p50(span.duration)",
+	}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t,
+		`'name', coalesce(toString(any(s."display_name")), ''), `+
+			`'endpoint', coalesce(toString(any(s.attr_values[indexOf(s.attr_keys, 'http.route')])), ''), `+
+			`'size', coalesce(toString(toFloat64OrNull(toString(`+
+			`s.attr_values[indexOf(s.attr_keys, 'http.request.size')]))), ''), `+
+			`'p50', coalesce(toString(quantileTDigest(0.5)(toFloat64OrDefault(s."duration"))), '')`,
+		string(got))
+
+	// Every value is a non-nullable string, so the JSON never contains null.
+	require.Equal(t, 4, strings.Count(string(got), "coalesce(toString("))
+}
+
+func TestSpanMetricViewSkipZero(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.errors",
+		Instrument: "counter",
+		Value:      ".error_count",
+	}
+	query := renderSpanMetricView(t, metric)
+	require.NotContains(t, query, "HAVING")
+
+	metric.SkipZero = true
+	query = renderSpanMetricView(t, metric)
+	require.True(t, strings.HasSuffix(query,
+		" GROUP BY s.project_id, toStartOfMinute(s.time) HAVING (sum != 0)"), query)
+
+	metric.Instrument = "histogram"
+	metric.Value = ".duration"
+	query = renderSpanMetricView(t, metric)
+	require.True(t, strings.HasSuffix(query, " HAVING (count != 0)"), query)
+
+	metric.Instrument = "gauge"
+	metric.Value = "avg(.duration)"
+	_, _, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+	require.Error(t, err)
+}
+
+func TestCompileSpanMetricStatusClass(t *testing.T) {
+	const statusClass = `toString((CASE s.status_code WHEN 'ok' THEN 'ok' ` +
+		`WHEN 'error' THEN 'error' ELSE 'unset' END))`
+
+	attrs, aliases, err := compileSpanMetricAttrs(
+		[]string{"service.name", "span.status_class"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `toString(s."service_name"), `+statusClass, string(attrs))
+	require.Equal(t, []string{"service.name", "span.status_class"}, aliases)
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"status=span.status_class"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "xxHash64(arrayStringConcat(["+statusClass+"], '-')) AS attrs_hash")
+	require.Equal(t, query, renderSpanMetricView(t, metric))
+}
+
+func TestSpanMetricViewRatio(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:      "uptrace.tracing.error_ratio",
+		Numerator: "span.status_code = 'error'",
+		Where:     []string{"span.kind = 'server'"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'ratio' AS instrument")
+	require.Contains(t, query, "toUInt64(count()) AS count, "+
+		`countIf(s."status_code" = 'error') AS sum`)
+	require.Contains(t, query, `WHERE (s."kind" = 'server')`)
+	require.NotContains(t, query, "AS gauge")
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", Instrument: "ratio"},
+		{Name: "test", Instrument: "ratio", Numerator: ".status_code = 'error'", Value: ".count"},
+		{Name: "test", Numerator: ".status_code >"},
+	} {
+		_, _, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+		require.Error(t, err)
+	}
+}
+
+func TestSpanMetricViewRatioDenominator(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:        "uptrace.tracing.slow_server_ratio",
+		Numerator:   "span.kind = 'server' and span.duration > 1s",
+		Denominator: "span.kind = 'server'",
+		Where:       []string{"service.name = 'api'"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'ratio' AS instrument")
+	require.Contains(t, query, `toUInt64(countIf(s."kind" = 'server')) AS count, `+
+		`countIf(s."kind" = 'server' AND s."duration" > 1000000000) AS sum`)
+	require.Contains(t, query, `WHERE (s."service_name" = 'api')`)
+
+	metric.SampleRate = 0.5
+	query = renderSpanMetricView(t, metric)
+	require.Contains(t, query, `toUInt64((countIf(s."kind" = 'server')) / 0.5) AS count`)
+
+	type Test struct {
+		metric *bunconf.SpanMetric
+		field  string
+	}
+
+	tests := []Test{
+		{&bunconf.SpanMetric{
+			Name: "test", Instrument: "ratio", Numerator: ".status_code = 'error'",
+			Denominator: ".kind =",
+		}, "denominator"},
+		{&bunconf.SpanMetric{
+			Name: "test", Instrument: "counter", Value: "count()", Denominator: ".kind = 'server'",
+		}, "denominator"},
+		{&bunconf.SpanMetric{
+			Name: "test", Instrument: "ratio", Denominator: ".kind = 'server'",
+		}, "numerator"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := compileSpanMetric(test.metric)
+			var compileErr *CompileError
+			require.ErrorAs(t, err, &compileErr)
+			require.Equal(t, test.field, compileErr.Field)
+		})
+	}
+}
+
+func TestSpanMetricViewTotal(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"service.name", "route=http.route"},
+		Total:      true,
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "FROM uptrace.spans_index AS s ARRAY JOIN [0, 1] AS is_total")
+
+	// Rows with is_total = 0 are grouped by the attrs,
+	// and rows with is_total = 1 are grouped into a single __total__ series.
+	values := `if(is_total, '__total__', toString(s."service_name")), ` +
+		`if(is_total, '__total__', toString(s.attr_values[indexOf(s.attr_keys, 'http.route')]))`
+	require.Contains(t, query, "['service.name', 'route'] AS string_keys")
+	require.Contains(t, query, "["+values+"] AS string_values")
+	require.Contains(t, query, "GROUP BY s.project_id, toStartOfMinute(s.time), "+values)
+
+	metric.Total = false
+	require.NotContains(t, renderSpanMetricView(t, metric), "is_total")
+
+	_, _, err := BuildSpanMetricQueries(new(bunconf.Config), &bunconf.SpanMetric{
+		Name: "test", Instrument: "counter", Value: ".count", Total: true,
+	})
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "total", compileErr.Field)
+}
+
+func TestSpanMetricViewZeroDuration(t *testing.T) {
+	type Test struct {
+		instrument   string
+		value        string
+		zeroDuration string
+		skipped      bool
+	}
+
+	tests := []Test{
+		{"histogram", ".duration", "", true},
+		{"histogram", ".duration / 1000", "", true},
+		{"histogram", ".duration", "include", false},
+		{"histogram", "toNumber(http.response.body.size)", "", false},
+		{"gauge", "max(.duration)", "", false},
+		{"gauge", "max(.duration)", "skip", true},
+		{"counter", ".count", "skip", true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric := &bunconf.SpanMetric{
+				Name:         "uptrace.tracing.spans",
+				Instrument:   test.instrument,
+				Value:        test.value,
+				ZeroDuration: test.zeroDuration,
+			}
+			query := renderSpanMetricView(t, metric)
+			if test.skipped {
+				require.Contains(t, query, `WHERE (s."duration" > 0)`)
+			} else {
+				require.NotContains(t, query, `s."duration" > 0`)
+			}
+		})
+	}
+
+	_, err := compileSpanMetric(&bunconf.SpanMetric{
+		Name: "test", Instrument: "histogram", Value: ".duration", ZeroDuration: "null",
+	})
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "zero_duration", compileErr.Field)
+}
+
+func TestSpanMetricViewTraceOffset(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:  "uptrace.tracing.trace_offset",
+		Value: "p90(ms(span.trace_offset))",
+		Attrs: []string{"span.name"},
+	}
+	metric, err := inferSpanMetricInstrument(metric)
+	require.NoError(t, err)
+
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	require.True(t, exprs.traceOffset)
+	require.False(t, exprs.selfDuration)
+
+	conf := new(bunconf.Config)
+	require.ErrorIs(t, checkSpanMetricJoins(exprs, conf), errTraceOffsetNotAllowed)
+	conf.AllowTraceOffset = true
+	require.NoError(t, checkSpanMetricJoins(exprs, conf))
+
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "FROM (SELECT s.*, (toInt64(s.time) - toInt64("+
+		"if(trace.start_time = toDateTime(0), s.time, least(trace.start_time, s.time))))"+
+		" * 1000000000 AS trace_offset FROM uptrace.spans_index AS s LEFT JOIN "+
+		"(SELECT trace_id, min(time) AS start_time FROM uptrace.spans_index "+
+		"WHERE time >= now() - INTERVAL 1 HOUR GROUP BY trace_id) AS trace "+
+		"ON trace.trace_id = s.trace_id) AS s")
+	require.Contains(t, query, `quantilesBFloat16State(0.5)(toFloat32((s."trace_offset" / 1000000)))`)
+
+	exprs, err = compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "gauge",
+		Value:      "max(span.trace_offset)",
+		Where:      []string{"span.trace_offset > 1s"},
+	})
+	require.NoError(t, err)
+	require.True(t, exprs.traceOffset)
+	require.Contains(t, string(exprs.where), `s."trace_offset" > 1000000000`)
+}
+
+func TestSpanMetricViewWeightedAvg(t *testing.T) {
+	type Test struct {
+		weight string
+		count  string
+		sum    string
+	}
+
+	tests := []Test{
+		{"", "toUInt64(count()) AS count", `sum(s."duration") AS sum`},
+		{
+			".duration",
+			`toUInt64(round(sum(s."duration"))) AS count`,
+			`sum((s."duration") * (s."duration")) AS sum`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric := &bunconf.SpanMetric{
+				Name:       "uptrace.tracing.avg_duration",
+				Instrument: "weighted_avg",
+				Value:      ".duration",
+				Weight:     test.weight,
+			}
+			query := renderSpanMetricView(t, metric)
+			require.Contains(t, query, "'weighted_avg' AS instrument")
+			require.Contains(t, query, test.count+", "+test.sum)
+			require.NotContains(t, query, "AS gauge")
+
+			exprs, err := compileSpanMetric(metric)
+			require.NoError(t, err)
+			require.Equal(t, []string{"project_id", "metric", "time", "instrument",
+				"count", "sum"}, spanMetricViewColumns(metric, exprs))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:   "uptrace.tracing.avg_duration",
+		Value:  ".duration",
+		Weight: "toNumber(http.request.body.size)",
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'weighted_avg' AS instrument")
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", Instrument: "weighted_avg"},
+		{Name: "test", Instrument: "weighted_avg", Value: "avg(.duration)"},
+		{Name: "test", Instrument: "weighted_avg", Value: ".duration", Weight: "sum(.duration)"},
+		{Name: "test", Instrument: "histogram", Value: ".duration", Weight: ".duration"},
+	} {
+		_, _, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+		require.Error(t, err)
+	}
+}
+
+func TestSpanMetricViewApdex(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:           "uptrace.tracing.apdex",
+		ApdexThreshold: 500 * time.Millisecond,
+		Attrs:          []string{"service.name"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'apdex' AS instrument")
+	require.Contains(t, query, `toUInt64(count()) AS count, `+
+		`countIf(s."duration" <= 500000000) + countIf(s."duration" <= 2000000000) AS sum`)
+	require.NotContains(t, query, "AS gauge")
+
+	inferred, err := inferSpanMetricInstrument(metric)
+	require.NoError(t, err)
+	exprs, err := compileSpanMetric(inferred)
+	require.NoError(t, err)
+	require.Equal(t, []string{"project_id", "metric", "time", "instrument",
+		"attrs_hash", "string_keys", "string_values", "count", "sum"},
+		spanMetricViewColumns(inferred, exprs))
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", Instrument: "apdex"},
+		{Name: "test", Instrument: "apdex", ApdexThreshold: -time.Second},
+		{Name: "test", Instrument: "apdex", ApdexThreshold: time.Second, Value: ".duration"},
+		{Name: "test", Instrument: "histogram", Value: ".duration", ApdexThreshold: time.Second},
+	} {
+		_, _, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+		require.Error(t, err)
+	}
+
+	_, err = compileSpanMetric(&bunconf.SpanMetric{Name: "test", Instrument: "apdex"})
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "apdex_threshold", compileErr.Field)
+}
+
+func TestBuildSpanMetricPopulateQuery(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:        "uptrace.tracing.spans",
+		Instrument:  "histogram",
+		Value:       ".duration",
+		Attrs:       []string{"service.name"},
+		Annotations: []string{"display.name"},
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	before := time.Unix(1700000000, 0)
+	query, err := buildSpanMetricPopulateQuery(metric, exprs, time.Time{}, before)
+	require.NoError(t, err)
+	require.Empty(t, query)
+
+	_, create, err := buildSpanMetricQueries(metric, bunconf.SpanMetricViewName("", metric.Name), "", exprs)
+	require.NoError(t, err)
+	require.NotContains(t, create, "POPULATE")
+
+	metric.Populate = true
+	query, err = buildSpanMetricPopulateQuery(metric, exprs, time.Time{}, before)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(query, "INSERT INTO ?DB.measure_minutes "+
+		"(project_id, metric, time, instrument, attrs_hash, string_keys, string_values, "+
+		"annotations, count, sum, histogram) SELECT s.project_id, "), query)
+	require.Contains(t, query, `WHERE (s."duration" > 0) AND (s.time < toDateTime(1700000000))`)
+	require.NotContains(t, query, "CREATE")
+
+	_, create, err = buildSpanMetricQueries(metric, bunconf.SpanMetricViewName("", metric.Name), "", exprs)
+	require.NoError(t, err)
+	require.NotContains(t, create, "s.time < ")
+
+	query, err = buildSpanMetricPopulateQuery(metric, exprs, before.Add(-time.Hour), before)
+	require.NoError(t, err)
+	require.Contains(t, query,
+		`WHERE (s."duration" > 0) AND (s.time >= toDateTime(1699996400)) `+
+			"AND (s.time < toDateTime(1700000000))")
+
+	// The select is built directly, so a string that looks like the DDL separator
+	// does not cut the query.
+	metric.Where = []string{"span.name = ' AS SELECT '"}
+	exprs, err = compileSpanMetric(metric)
+	require.NoError(t, err)
+	query, err = buildSpanMetricPopulateQuery(metric, exprs, time.Time{}, before)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(query, "INSERT INTO ?DB.measure_minutes "+
+		"(project_id, metric, time, instrument, attrs_hash, string_keys, string_values, "+
+		"annotations, count, sum, histogram) SELECT s.project_id, "), query)
+	require.Contains(t, query, `WHERE (s."name" = ' AS SELECT ')`)
+}
+
+func TestClampSpanMetricBackfill(t *testing.T) {
+	type Test struct {
+		backfill    time.Duration
+		maxBackfill time.Duration
+		wanted      time.Duration
+		clamped     bool
+	}
+
+	tests := []Test{
+		{0, 0, 0, false},
+		{24 * time.Hour, 0, 24 * time.Hour, false},
+		{24 * time.Hour, 48 * time.Hour, 24 * time.Hour, false},
+		{72 * time.Hour, 48 * time.Hour, 48 * time.Hour, true},
+		{0, 48 * time.Hour, 48 * time.Hour, true},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			metric := &bunconf.SpanMetric{Backfill: test.backfill}
+			backfill, clamped := clampSpanMetricBackfill(metric, test.maxBackfill)
+			require.Equal(t, test.wanted, backfill)
+			require.Equal(t, test.clamped, clamped)
+		})
+	}
+}
+
+type cancelingExecer struct {
+	recordingExecer
+	cancel func()
+	after  int
+}
+
+func (db *cancelingExecer) ExecContext(
+	ctx context.Context, query string, args ...any,
+) (sql.Result, error) {
+	res, err := db.recordingExecer.ExecContext(ctx, query, args...)
+	if len(db.queries) == db.after {
+		db.cancel()
+	}
+	return res, err
+}
+
+func TestPopulateSpanMetric(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+		Populate:   true,
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	before := time.Unix(1700000000, 0)
+
+	t.Run("chunks", func(t *testing.T) {
+		db := new(recordingExecer)
+		err := populateSpanMetric(
+			context.Background(), db, metric, exprs, before, 150*time.Minute)
+		require.NoError(t, err)
+		require.Len(t, db.queries, 3)
+		require.Contains(t, db.queries[0], "(s.time >= toDateTime(1699991000)) "+
+			"AND (s.time < toDateTime(1699994600))")
+		require.Contains(t, db.queries[2], "(s.time >= toDateTime(1699998200)) "+
+			"AND (s.time < toDateTime(1700000000))")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		db := &cancelingExecer{cancel: cancel, after: 2}
+		err := populateSpanMetric(ctx, db, metric, exprs, before, 24*time.Hour)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Len(t, db.queries, 2)
+	})
+}
+
+func TestCompileSpanMetricNormalizedAttrs(t *testing.T) {
+	attrs, aliases, err := compileSpanMetricAttrs([]string{
+		"lower(http.request.method)",
+		"env = trim(deployment.environment)",
+		"upper(span.kind)",
+	}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"http.request.method", "env", "span.kind"}, aliases)
+	require.Equal(t,
+		`lowerUTF8(toString(s.attr_values[indexOf(s.attr_keys, 'http.request.method')])), `+
+			`trimBoth(toString(s."deployment_environment")), `+
+			`upperUTF8(toString(if(s."kind" IN ('server', 'client', 'producer', 'consumer'), `+
+			`s."kind", 'internal')))`,
+		string(attrs))
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"lower(http.request.method)"},
+	}
+	query := renderSpanMetricView(t, metric)
+	const attr = `lowerUTF8(toString(s.attr_values[indexOf(s.attr_keys, 'http.request.method')]))`
+	require.Contains(t, query, "xxHash64(arrayStringConcat(["+attr+"], '-')) AS attrs_hash")
+	require.Contains(t, query, "["+attr+"] AS string_values")
+	require.Contains(t, query, "['http.request.method'] AS string_keys")
+}
+
+func TestCompileSpanMetricKindAttr(t *testing.T) {
+	const kind = `if(s."kind" IN ('server', 'client', 'producer', 'consumer'), s."kind", 'internal')`
+
+	for _, attr := range []string{"span.kind", ".kind", "kind = span.kind"} {
+		attrs, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.NoError(t, err, attr)
+		require.Equal(t, "toString("+kind+")", string(attrs), attr)
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs:      []string{"service.name", "span.kind"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "['service.name', 'span.kind'] AS string_keys")
+	require.Contains(t, query, `xxHash64(arrayStringConcat([toString(s."service_name"), `+
+		`toString(`+kind+`)], '-')) AS attrs_hash`)
+	require.Equal(t, query, renderSpanMetricView(t, metric))
+
+	// Filtering by the kind is not required to group by it.
+	require.NotContains(t, query, "WHERE")
+}
+
+func TestDedupeSpanMetricAttrs(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.spans",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs: []string{
+			"service.name", "http.route", "service.name", "route=http.route", " http.route ",
+		},
+	}
+	deduped, dups, err := dedupeSpanMetricAttrs(metric)
+	require.NoError(t, err)
+	require.Equal(t, []string{"service.name", "http.route", "route=http.route"}, deduped.Attrs)
+	require.Equal(t, []string{"service.name", " http.route "}, dups)
+	require.Len(t, metric.Attrs, 5)
+
+	_, create, err := BuildSpanMetricQueries(new(bunconf.Config), metric)
+	require.NoError(t, err)
+	require.Contains(t, create, "['service.name', 'http.route', 'route'] AS string_keys")
+
+	for _, attrs := range [][]string{
+		{"http.route", "lower(http.route)"},
+		{"route=http.route", "route=http.target"},
+	} {
+		metric := &bunconf.SpanMetric{
+			Name: "test", Instrument: "counter", Value: ".count", Attrs: attrs,
+		}
+		_, _, err := dedupeSpanMetricAttrs(metric)
+		var compileErr *CompileError
+		require.ErrorAs(t, err, &compileErr)
+		require.Equal(t, "attrs", compileErr.Field)
+	}
+}
+
+func TestCompileSpanMetricTruncatedAttrs(t *testing.T) {
+	attrs, aliases, err := compileSpanMetricAttrs([]string{
+		"truncate(db.statement, 100)",
+		"route = truncate(http.url, 32)",
+		"lower(truncate(span.name, 8))",
+	}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"db.statement", "route", "span.name"}, aliases)
+	require.Equal(t,
+		`substring(toString(s."db_statement"), 1, 100), `+
+			`substring(toString(s.attr_values[indexOf(s.attr_keys, 'http.url')]), 1, 32), `+
+			`lowerUTF8(substring(toString(s."name"), 1, 8))`,
+		string(attrs))
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"truncate(db.statement, 100)"},
+	}
+	query := renderSpanMetricView(t, metric)
+	const attr = `substring(toString(s."db_statement"), 1, 100)`
+	require.Contains(t, query, "xxHash64(arrayStringConcat(["+attr+"], '-')) AS attrs_hash")
+	require.Contains(t, query, "["+attr+"] AS string_values")
+	require.Contains(t, query, "['db.statement'] AS string_keys")
+
+	for _, attr := range []string{
+		"truncate(db.statement, 0)",
+		"truncate(db.statement, -1)",
+		"truncate(db.statement, abc)",
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricCalendarAttrs(t *testing.T) {
+	attrs := []string{
+		"hour = toHour(span.time)",
+		"dow = toDayOfWeek(span.time, 'Europe/Berlin')",
+		"month = toMonth(.time)",
+	}
+	compiled, aliases, err := compileSpanMetricAttrs(attrs, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hour", "dow", "month"}, aliases)
+	require.Equal(t,
+		`toString(toHour(s.time)), `+
+			`toString(toDayOfWeek(s.time, 'Europe/Berlin')), `+
+			`toString(toMonth(s.time))`,
+		string(compiled))
+
+	// The same attrs always produce the same attrs_hash.
+	again, _, err := compileSpanMetricAttrs(attrs, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, compiled, again)
+
+	metric := &bunconf.SpanMetric{
+		Name:       "uptrace.tracing.requests",
+		Instrument: "counter",
+		Value:      ".count",
+		Attrs:      []string{"hour = toHour(span.time)", "service.name"},
+	}
+	query := renderSpanMetricView(t, metric)
+	const attrs2 = `toString(toHour(s.time)), toString(s."service_name")`
+	require.Contains(t, query, "xxHash64(arrayStringConcat(["+attrs2+"], '-')) AS attrs_hash")
+	require.Contains(t, query, "['hour', 'service.name'] AS string_keys")
+
+	for _, attr := range []string{
+		"toHour(span.duration)",
+		"toHour(span.time, 'Mars/Olympus')",
+		"toHour(span.time, 1)",
+		"toHour()",
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricRegexpExtractAttr(t *testing.T) {
+	attrs, aliases, err := compileSpanMetricAttrs(
+		[]string{`operation = regexpExtract(span.name, '^db\.(\w+)', 1)`}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"operation"}, aliases)
+	require.Equal(t, `toString(regexpExtract(toString(s."name"), '^db\\.(\\w+)', 1))`,
+		string(attrs))
+
+	attrs, _, err = compileSpanMetricAttrs(
+		[]string{`regexpExtract(http.route, '^/api/(v\d+)/')`}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `toString(regexpExtract(toString(`+
+		`s.attr_values[indexOf(s.attr_keys, 'http.route')]), '^/api/(v\\d+)/', 1))`,
+		string(attrs))
+
+	metric := &bunconf.SpanMetric{
+		Name:       "db.latency",
+		Instrument: "histogram",
+		Value:      ".duration",
+		Attrs:      []string{`operation = regexpExtract(span.name, '^db\.(\w+)', 1)`},
+		Where:      []string{"span.name like 'db.%'"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `['operation'] AS string_keys`)
+	require.Contains(t, query, `[toString(regexpExtract(toString(s."name"), '^db\\.(\\w+)', 1))]`)
+	require.Contains(t, query, `s."name" LIKE 'db.%'`)
+
+	for _, attr := range []string{
+		`regexpExtract(span.name, '^db\.(\w+)', 2)`,
+		`regexpExtract(span.name, '^db\.(\w+)', -1)`,
+		`regexpExtract(span.name, '(')`,
+		`regexpExtract(span.name)`,
+		`regexpExtract(count(), 'x')`,
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricConcatAttr(t *testing.T) {
+	attrs, aliases, err := compileSpanMetricAttrs(
+		[]string{"svc_env = concat(service.name, ':', deployment.environment)"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"svc_env"}, aliases)
+	require.Equal(t,
+		`toString(concat(toString(s."service_name"), ':', toString(s."deployment_environment")))`,
+		string(attrs))
+
+	metric := &bunconf.SpanMetric{
+		Name:       "http.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs: []string{
+			"svc_env = concat(service.name, ':', deployment.environment)",
+			"span.kind",
+		},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `['svc_env', 'span.kind'] AS string_keys`)
+	// The composite label is hashed together with the other attrs.
+	require.Contains(t, query, `xxHash64(arrayStringConcat([toString(concat(`+
+		`toString(s."service_name"), ':', toString(s."deployment_environment"))), `+
+		`toString(if(`)
+
+	for _, attr := range []string{
+		"concat(service.name)",
+		"concat(':', '-')",
+		"concat(service.name, 1)",
+		"concat(service.name, sum(span.duration))",
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricPathSegmentAttr(t *testing.T) {
+	type Test struct {
+		attr   string
+		wanted string
+	}
+
+	tests := []Test{
+		{
+			"resource = pathSegment(http.target, 2)",
+			`toString(arrayElement(arrayFilter(x -> x != '', splitByChar('/', splitByChar('?', ` +
+				`toString(s.attr_values[indexOf(s.attr_keys, 'http.target')]))[1])), 2))`,
+		},
+		{
+			// Out of range segments are empty strings in ClickHouse.
+			"pathSegment(url.path, 10)",
+			`toString(arrayElement(arrayFilter(x -> x != '', splitByChar('/', splitByChar('?', ` +
+				`toString(s.attr_values[indexOf(s.attr_keys, 'url.path')]))[1])), 10))`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			attrs, _, err := compileSpanMetricAttrs([]string{test.attr}, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(attrs))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:       "http.requests",
+		Instrument: "counter",
+		Value:      "count()",
+		Attrs:      []string{"resource = pathSegment(http.target, 2)"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `['resource'] AS string_keys`)
+	require.Contains(t, query, `xxHash64(arrayStringConcat([toString(arrayElement(`)
+	require.Equal(t, query, renderSpanMetricView(t, metric))
+
+	for _, attr := range []string{
+		"pathSegment(http.target, 0)",
+		"pathSegment(http.target, -1)",
+		"pathSegment(http.target, 1.5)",
+		"pathSegment(http.target)",
+		"pathSegment(count(), 1)",
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricBucketAttr(t *testing.T) {
+	attrs, aliases, err := compileSpanMetricAttrs(
+		[]string{"size_bucket = bucket(http.request_size, [1024, 10240, 102400])"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, []string{"size_bucket"}, aliases)
+
+	const value = `toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'http.request_size')]))`
+	require.Equal(t, "toString(multiIf(isNull("+value+"), '', "+
+		value+" < 1024, '<1024', "+
+		value+" < 10240, '1024-10240', "+
+		value+" < 102400, '10240-102400', "+
+		"'>=102400'))", string(attrs))
+
+	attrs, _, err = compileSpanMetricAttrs([]string{"bucket(span.duration, [0.5])"}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `toString(multiIf(isNull(toFloat64OrNull(toString(s."duration"))), '', `+
+		`toFloat64OrNull(toString(s."duration")) < 0.5, '<0.5', '>=0.5'))`, string(attrs))
+
+	for _, attr := range []string{
+		"bucket(http.request_size, [])",
+		"bucket(http.request_size, [10240, 1024])",
+		"bucket(http.request_size, [1024, 1024])",
+		"bucket(http.request_size, [1kb])",
+	} {
+		_, _, err := compileSpanMetricAttrs([]string{attr}, time.Minute)
+		require.Error(t, err, attr)
+	}
+}
+
+func TestCompileSpanMetricFirstLast(t *testing.T) {
+	type Test struct {
+		value  string
+		wanted string
+	}
+
+	tests := []Test{
+		{"first(span.duration)", `argMin(toFloat64OrDefault(s."duration"), s.time)`},
+		{
+			"last(app.queue_size)",
+			`argMax(toFloat64OrDefault(s.attr_values[indexOf(s.attr_keys, 'app.queue_size')]), s.time)`,
+		},
+		{
+			"last(toNumber(app.queue_size))",
+			`argMax(toFloat64OrNull(toString(s.attr_values[indexOf(s.attr_keys, 'app.queue_size')])), s.time)`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.value, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:  "app.queue_size",
+		Value: "last(app.queue_size)",
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'gauge' AS instrument")
+	require.Contains(t, query,
+		`argMax(toFloat64OrDefault(s.attr_values[indexOf(s.attr_keys, 'app.queue_size')]), s.time) AS gauge`)
+
+	for _, instrument := range []string{"counter", "histogram"} {
+		_, err := compileSpanMetric(&bunconf.SpanMetric{
+			Name:       "test",
+			Instrument: instrument,
+			Value:      "last(span.duration) - first(span.duration)",
+		})
+		var compileErr *CompileError
+		require.ErrorAs(t, err, &compileErr, instrument)
+		require.Equal(t, "value", compileErr.Field)
+	}
+
+	_, err := compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "additive",
+		Value:      "last(span.duration)",
+	})
+	require.NoError(t, err)
+}
+
+func TestCompileSpanMetricEventCount(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:  "app.cache.misses",
+		Value: "eventCount('cache.miss')",
+		Attrs: []string{"service.name"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "'counter' AS instrument")
+	require.Contains(t, query, "countIf(s.event_name = 'cache.miss') AS sum")
+
+	for _, value := range []string{"eventCount(cache.miss)", "eventCount('')"} {
+		_, err := compileSpanMetricValue(value, time.Minute)
+		require.Error(t, err, value)
+	}
+
+	_, err := compileSpanMetric(&bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "gauge",
+		Value:      "eventCount('cache.miss')",
+	})
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Contains(t, err.Error(), `eventCount requires one of [counter] instruments, got "gauge"`)
+}
+
+func TestCompileSpanMetricValueType(t *testing.T) {
+	type Test struct {
+		value   string
+		invalid string
+	}
+
+	tests := []Test{
+		{"span.duration", ""},
+		{"sum(http.response.status_code)", ""},
+		{"count()", ""},
+		{"max(toNumber(service.name, 0))", ""},
+		{"span.name", "span.name"},
+		{"sum(service.name)", "service.name"},
+		{"p99(host.name)", "host.name"},
+		{"span.duration / (1 + span.kind)", "span.kind"},
+		{"-span.status_code", "span.status_code"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := compileSpanMetric(&bunconf.SpanMetric{
+				Name:       "test",
+				Instrument: "gauge",
+				Value:      test.value,
+			})
+			if test.invalid == "" {
+				require.NoError(t, err)
+				return
+			}
+			var compileErr *CompileError
+			require.ErrorAs(t, err, &compileErr)
+			require.Equal(t, "value", compileErr.Field)
+			require.ErrorContains(t, err,
+				test.invalid+" is a string attribute and can't be used as a number")
+		})
+	}
+}
+
+func TestCompileSpanMetricUnitCast(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	tests := []Test{
+		{"ms(span.duration)", `(s."duration" / 1000000)`},
+		{"sec(span.duration)", `(s."duration" / 1000000000)`},
+		{"avg(ms(span.duration))", `avg((s."duration" / 1000000))`},
+		{"ms(span.duration) + toNumber(retries, 0)",
+			`(s."duration" / 1000000) + ifNull(toFloat64OrNull(toString(` +
+				`s.attr_values[indexOf(s.attr_keys, 'retries')])), 0)`},
+		{"ms(span.self_duration)", `(s."self_duration" / 1000000)`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.in, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got))
+		})
+	}
+
+	for _, value := range []string{"ms(http.status_code)", "sec(count())", "ms(1)"} {
+		_, err := compileSpanMetricValue(value, time.Minute)
+		require.Error(t, err, value)
+	}
+}
+
+func TestCompileSpanMetricValueVars(t *testing.T) {
+	ast.SetVars(map[string]string{"duration": "ms(span.duration)"})
+	defer ast.SetVars(nil)
+
+	got, err := compileSpanMetricValue("avg(${duration})", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `avg((s."duration" / 1000000))`, string(got))
+
+	_, err = compileSpanMetricValue("avg(${size})", time.Minute)
+	require.ErrorContains(t, err, "undefined variable ${size}")
+}
+
+func TestCompileSpanMetricResourceAttrs(t *testing.T) {
+	type Test struct {
+		in     string
+		wanted string
+	}
+
+	const cpu = `s.attr_values[indexOf(s.attr_keys, 'process.cpu.utilization')]`
+	tests := []Test{
+		{"avg(resource.process.cpu.utilization)", "avg(toFloat64OrDefault(" + cpu + "))"},
+		{"max(resource.process.cpu.utilization)", "max(toFloat64OrDefault(" + cpu + "))"},
+		{"resource.process.cpu.utilization", "toFloat64OrDefault(" + cpu + ")"},
+		{"resource.process.cpu.utilization * 100", "toFloat64OrDefault(" + cpu + ") * 100"},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.in, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:  "process.cpu.utilization",
+		Value: "p99(resource.process.cpu.utilization)",
+		Attrs: []string{"resource.host.name"},
+		Where: []string{"resource.deployment.environment = 'prod'"},
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `quantilesBFloat16State(0.5)(toFloat32(toFloat64OrDefault(`+cpu+`)))`)
+	require.Contains(t, query, `['resource.host.name'] AS string_keys, [toString(s."host_name")]`)
+	require.Contains(t, query, `WHERE (s."deployment_environment" = 'prod')`)
+}
+
+func TestCompileSpanMetricQuantileLevel(t *testing.T) {
+	got, err := compileSpanMetricValue("quantile(0.95, span.duration)", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, `quantileTDigest(0.95)(toFloat64OrDefault(s."duration"))`, string(got))
+
+	metric, err := inferSpanMetricInstrument(&bunconf.SpanMetric{
+		Name:  "test",
+		Value: "quantile(0.99, span.duration)",
+	})
+	require.NoError(t, err)
+	require.Equal(t, string(InstrumentHistogram), metric.Instrument)
+	require.Equal(t, "span.duration", metric.Value)
+
+	type Test struct {
+		value string
+		err   string
+	}
+
+	tests := []Test{
+		{"quantile(50, span.duration)", "got 50 (use 0.5 instead)"},
+		{"quantile(99.9, span.duration)", "got 99.9 (use 0.999 instead)"},
+		{"quantile(0, span.duration)", "got 0"},
+		{"quantile(1, span.duration)", "got 1"},
+		{"quantile(100, span.duration)", "got 100"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := compileSpanMetricValue(test.value, time.Minute)
+			require.ErrorContains(t, err, test.err)
+
+			_, err = inferSpanMetricInstrument(&bunconf.SpanMetric{Name: "test", Value: test.value})
+			require.ErrorContains(t, err, test.err)
+		})
+	}
+}
+
+func TestCompileSpanMetricLet(t *testing.T) {
+	type Test struct {
+		value  string
+		wanted string
+	}
+
+	tests := []Test{
+		{"let d = span.duration / 1000; d * d", `(s."duration" / 1000) * (s."duration" / 1000)`},
+		{"let d = span.duration; let d2 = d * 2; d2 + 1", `(s."duration" * 2) + 1`},
+		{"let x = span.duration; avg(x)", `avg(toFloat64OrDefault(s."duration"))`},
+		{
+			"let rows = JSONExtractInt(app.payload, 'a;b'); sum(rows)",
+			`sum(JSONExtractInt(s.attr_values[indexOf(s.attr_keys, 'app.payload')], 'a;b'))`,
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := compileSpanMetricValue(test.value, time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, string(got))
+		})
+	}
+}
+
+func TestCompileSpanMetricStatementErrors(t *testing.T) {
+	type Test struct {
+		value string
+		err   string
+	}
+
+	tests := []Test{
+		{"sum(span.duration); count()", "only let bindings can precede the metric value"},
+		{"let d = span.duration;", "metric value must end with an expression"},
+		{"let d = span.duration; let d = 1; d", "let d: binding is already defined"},
+		{"let http.status_code = 1; http.status_code", "only let bindings can precede the metric value"},
+		{"let d = span.duration; d{a=1}", "bindings don't support filters"},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := compileSpanMetricValue(test.value, time.Minute)
+			require.ErrorContains(t, err, test.err)
+		})
+	}
+}
+
+func TestCompileSpanMetricValueTooLong(t *testing.T) {
+	// Each statement is short, but the whole value is over the limit.
+	value := strings.Repeat("let d = span.duration; ", 400) + "sum(span.duration)"
+	_, err := compileSpanMetricValue(value, time.Minute)
+	require.ErrorContains(t, err, "query is too long")
+
+	var compileErr *CompileError
+	require.ErrorAs(t, err, &compileErr)
+	require.Equal(t, "value", compileErr.Field)
+
+	setMaxQueryLen(&bunconf.Config{MaxQueryLength: 1 << 20})
+	defer setMaxQueryLen(new(bunconf.Config))
+	_, err = compileSpanMetricValue(value, time.Minute)
+	require.ErrorContains(t, err, "binding is already defined")
+}
+
+func TestSpanMetricService(t *testing.T) {
+	type Test struct {
+		where  []string
+		wanted string
+	}
+
+	tests := []Test{
+		{nil, `s."service_name" = 'api'`},
+		{[]string{"http.status_code >= 500"}, `s."service_name" = 'api' AND %s`},
+		{[]string{"http.status_code = 500 or http.status_code = 503"}, `s."service_name" = 'api' AND (%s)`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			exprs, err := compileSpanMetric(&bunconf.SpanMetric{
+				Name:       "test",
+				Instrument: "counter",
+				Value:      "count()",
+				Where:      test.where,
+				Service:    "api",
+			})
+			require.NoError(t, err)
+
+			wanted := test.wanted
+			if len(test.where) > 0 {
+				where, err := compileSpanMetricWhereList(test.where, "", time.Minute)
+				require.NoError(t, err)
+				wanted = fmt.Sprintf(wanted, where)
+			}
+			require.Equal(t, wanted, string(exprs.where))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "counter",
+		Value:      "count()",
+		Service:    "o'reilly",
+	}
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	require.Equal(t, `s."service_name" = 'o\'reilly'`, string(exprs.where))
+	require.Contains(t, renderSpanMetricView(t, metric), `WHERE (s."service_name" = 'o\'reilly')`)
+
+	meta := newSpanMetricMeta(new(bunconf.Config), metric, 1, "")
+	require.Equal(t, "o'reilly", meta.Service)
+}
+
+func TestSpanMetricRootOnly(t *testing.T) {
+	type Test struct {
+		where  []string
+		wanted string
+	}
+
+	tests := []Test{
+		{nil, `(s.parent_id = 0)`},
+		{[]string{"http.status_code >= 500"}, `(s.parent_id = 0) AND %s`},
+		{[]string{"http.status_code = 500 or http.status_code = 503"}, `(s.parent_id = 0) AND (%s)`},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			exprs, err := compileSpanMetric(&bunconf.SpanMetric{
+				Name:       "test",
+				Instrument: "counter",
+				Value:      "count()",
+				Where:      test.where,
+				RootOnly:   true,
+			})
+			require.NoError(t, err)
+
+			wanted := test.wanted
+			if len(test.where) > 0 {
+				where, err := compileSpanMetricWhereList(test.where, "", time.Minute)
+				require.NoError(t, err)
+				wanted = fmt.Sprintf(wanted, where)
+			}
+			require.Equal(t, wanted, string(exprs.where))
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "counter",
+		Value:      "count()",
+		Service:    "api",
+		RootOnly:   true,
+	}
+	require.Contains(t, renderSpanMetricView(t, metric),
+		`WHERE ((s.parent_id = 0) AND s."service_name" = 'api')`)
+
+	meta := newSpanMetricMeta(new(bunconf.Config), metric, 1, "")
+	require.True(t, meta.RootOnly)
+}
+
+func TestSpanMetricHistogramBuckets(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:       "test",
+		Instrument: "histogram",
+		Value:      "span.duration",
+		Attrs:      []string{"service.name"},
+		HistogramBuckets: &bunconf.HistogramBuckets{
+			Bounds: []float64{0.5, 1, 2.5},
+		},
+	}
+
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+	require.Equal(t, []float64{0.5, 1, 2.5}, exprs.bucketBounds)
+	require.Equal(t, []string{"service.name", "le"}, exprs.attrAliases)
+	require.True(t, exprs.noQuantiles)
+
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, "FROM uptrace.spans_index AS s ARRAY JOIN [0.5, 1, 2.5, inf] AS le")
+	require.Contains(t, query, `['service.name', 'le'] AS string_keys`)
+	require.Contains(t, query, `if(isInfinite(le), '+Inf', toString(le))`)
+	require.Contains(t, query, `toUInt64(countIf(s."duration" <= le)) AS count`)
+	require.Contains(t, query, `sumIf(s."duration", s."duration" <= le) AS sum`)
+	require.NotContains(t, query, "quantilesBFloat16State")
+
+	meta := newSpanMetricMeta(new(bunconf.Config), metric, 1, "")
+	require.Equal(t, []string{"service.name", "le"}, meta.AttrKeys)
+	require.Equal(t, []float64{0.5, 1, 2.5}, meta.BucketBounds)
+
+	metric.Instrument = "counter"
+	metric.Value = "count()"
+	_, err = compileSpanMetric(metric)
+	require.ErrorContains(t, err, `histogram_buckets requires a histogram, got "counter"`)
+}
+
+func TestSpanMetricBucketBounds(t *testing.T) {
+	type Test struct {
+		buckets bunconf.HistogramBuckets
+		wanted  []float64
+		err     string
+	}
+
+	tests := []Test{
+		{buckets: bunconf.HistogramBuckets{Bounds: []float64{1, 5, 10}}, wanted: []float64{1, 5, 10}},
+		{
+			buckets: bunconf.HistogramBuckets{Linear: &bunconf.LinearBuckets{Start: 10, Width: 5, Count: 3}},
+			wanted:  []float64{10, 15, 20},
+		},
+		{
+			buckets: bunconf.HistogramBuckets{
+				Exponential: &bunconf.ExponentialBuckets{Start: 1, Factor: 2, Count: 4},
+			},
+			wanted: []float64{1, 2, 4, 8},
+		},
+		{buckets: bunconf.HistogramBuckets{}, err: "requires bounds, linear, or exponential"},
+		{
+			buckets: bunconf.HistogramBuckets{
+				Bounds: []float64{1},
+				Linear: &bunconf.LinearBuckets{Start: 1, Width: 1, Count: 1},
+			},
+			err: "accepts only one of bounds, linear, or exponential",
+		},
+		{buckets: bunconf.HistogramBuckets{Bounds: []float64{1, 10, 5}}, err: "must be ascending"},
+		{buckets: bunconf.HistogramBuckets{Bounds: []float64{1, 1}}, err: "must be ascending"},
+		{buckets: bunconf.HistogramBuckets{Bounds: []float64{0, 1}}, err: "must be positive, got 0"},
+		{
+			buckets: bunconf.HistogramBuckets{Linear: &bunconf.LinearBuckets{Start: -5, Width: 5, Count: 3}},
+			err:     "must be positive, got -5",
+		},
+		{
+			buckets: bunconf.HistogramBuckets{Linear: &bunconf.LinearBuckets{Start: 1, Width: 0, Count: 3}},
+			err:     "linear width must be positive",
+		},
+		{
+			buckets: bunconf.HistogramBuckets{
+				Exponential: &bunconf.ExponentialBuckets{Start: 1, Factor: 1, Count: 3},
+			},
+			err: "exponential factor must be greater than 1",
+		},
+		{
+			buckets: bunconf.HistogramBuckets{
+				Exponential: &bunconf.ExponentialBuckets{Start: 1, Factor: 2, Count: 100},
+			},
+			err: "exponential count must be between 1 and 64, got 100",
+		},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			bounds, err := spanMetricBucketBounds(&test.buckets)
+			if test.err != "" {
+				require.ErrorContains(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wanted, bounds)
+		})
+	}
+}
+
+type fakeColumnsScanner struct {
+	query   string
+	missing string
+}
+
+func (db *fakeColumnsScanner) scanRow(ctx context.Context, query string, dest ...any) error {
+	db.query = query
+	*dest[0].(*string) = db.missing
+	return nil
+}
+
+func TestSpanMetricSourceTable(t *testing.T) {
+	metric := &bunconf.SpanMetric{
+		Name:             "test",
+		Instrument:       "counter",
+		Value:            "count()",
+		SourceTable:      "spans_sampled",
+		SourceSampleRate: 0.1,
+	}
+	query := renderSpanMetricView(t, metric)
+	require.Contains(t, query, `FROM uptrace."spans_sampled" AS s`)
+	require.NotContains(t, query, "uptrace.spans_index AS s")
+	require.Contains(t, query, "(count()) / 0.1 AS sum")
+
+	metric.SampleRate = 0.5
+	require.Equal(t, 0.05, metric.ScaleRate())
+	meta := newSpanMetricMeta(new(bunconf.Config), metric, 1, "")
+	require.Equal(t, 0.05, meta.SampleRate)
+
+	for _, metric := range []*bunconf.SpanMetric{
+		{Name: "test", Value: "count()", SourceTable: "spans; DROP TABLE spans"},
+		{Name: "test", Value: "count()", SourceTable: "spans_sampled", SourceSampleRate: 2},
+		{Name: "test", Value: "count()", SourceSampleRate: 0.1},
+	} {
+		_, err := compileSpanMetric(metric)
+		require.Error(t, err)
+	}
+
+	ctx := context.Background()
+	db := &fakeColumnsScanner{}
+	require.NoError(t, checkSpanMetricSourceTable(ctx, db, "uptrace", "spans_sampled"))
+	require.Contains(t, db.query, "table = 'spans_sampled'")
+
+	db.missing = "duration, kind"
+	err := checkSpanMetricSourceTable(ctx, db, "uptrace", "spans_sampled")
+	require.EqualError(t, err,
+		`source table "spans_sampled" lacks spans_index columns: duration, kind`)
+}
+
+// measureMinutesColumns are the columns of measure_minutes after all migrations.
+var measureMinutesColumns = []string{
+	"project_id", "metric", "time", "attrs_hash", "instrument",
+	"min", "max", "sum", "count", "gauge", "histogram", "tdigest",
+	"string_keys", "string_values", "annotations",
+}
+
+type fakeTargetColumnsScanner struct {
+	query   string
+	columns []string
+}
+
+func (db *fakeTargetColumnsScanner) scanRow(ctx context.Context, query string, dest ...any) error {
+	db.query = query
+	*dest[0].(*string) = strings.Join(db.columns, ",")
+	return nil
+}
+
+func TestSpanMetricTargetColumns(t *testing.T) {
+	type Test struct {
+		metric *bunconf.SpanMetric
+	}
+
+	tests := []Test{
+		{&bunconf.SpanMetric{Instrument: "counter", Value: "count()"}},
+		{&bunconf.SpanMetric{Instrument: "gauge", Value: "avg(span.duration)"}},
+		{&bunconf.SpanMetric{Instrument: "additive", Value: "sum(span.duration)"}},
+		{&bunconf.SpanMetric{Instrument: "histogram", Value: "p50(span.duration)"}},
+		{&bunconf.SpanMetric{
+			Instrument: "histogram", Value: "p50(span.duration)", QuantileAlgorithm: QuantileTDigest,
+		}},
+		{&bunconf.SpanMetric{Instrument: "ratio", Numerator: ".status_code = 'error'"}},
+		{&bunconf.SpanMetric{
+			Instrument: "counter", Value: "count()", Attrs: []string{"service.name"},
+			Annotations: []string{"host.name"},
+		}},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			test.metric.Name = "test"
+			metric, err := inferSpanMetricInstrument(test.metric)
+			require.NoError(t, err)
+			exprs, err := compileSpanMetric(metric)
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			db := &fakeTargetColumnsScanner{columns: measureMinutesColumns}
+			require.NoError(t, checkSpanMetricTargetColumns(ctx, db, "uptrace", metric, exprs))
+			require.Contains(t, db.query, "database = 'uptrace' AND table = 'measure_minutes'")
+		})
+	}
+
+	metric := &bunconf.SpanMetric{
+		Name:              "test",
+		Instrument:        "histogram",
+		Value:             "p50(span.duration)",
+		QuantileAlgorithm: QuantileTDigest,
+	}
+	metric, err := inferSpanMetricInstrument(metric)
+	require.NoError(t, err)
+	exprs, err := compileSpanMetric(metric)
+	require.NoError(t, err)
+
+	// The target table was created before the tdigest column was added.
+	var columns []string
+	for _, col := range measureMinutesColumns {
+		if col != "tdigest" {
+			columns = append(columns, col)
+		}
+	}
+	db := &fakeTargetColumnsScanner{columns: columns}
+	err = checkSpanMetricTargetColumns(context.Background(), db, "uptrace", metric, exprs)
+	require.EqualError(t, err,
+		`span metric "test" writes columns that measure_minutes lacks: tdigest`)
+}
+
+func TestSupportedMetricFuncs(t *testing.T) {
+	sampleExpr := func(name string, numArg int) string {
+		args := make([]string, numArg)
+		for i := range args {
+			if i == 0 && name == "eventCount" {
+				args[i] = "'cache.miss'"
+			} else if i == 1 && (name == "coalesce" || name == "ifNull") {
+				args[i] = "0"
+			} else if i == 0 {
+				args[i] = "span.duration"
+			} else {
+				args[i] = "'field'"
+			}
+		}
+		return name + "(" + strings.Join(args, ", ") + ")"
+	}
+
+	specs := SupportedMetricFuncs()
+	require.NotEmpty(t, specs)
+	for _, spec := range specs {
+		require.NotEmpty(t, spec.Instruments, spec.Name)
+
+		_, err := compileSpanMetricValue(sampleExpr(spec.Name, spec.MinArgs), time.Minute)
+		require.NoError(t, err, spec.Name)
+
+		if spec.MaxArgs >= 0 {
+			_, err := compileSpanMetricValue(sampleExpr(spec.Name, spec.MaxArgs+1), time.Minute)
+			require.Error(t, err, spec.Name)
+		}
+	}
+
+	for _, funcName := range []string{"top3", "median", "foo"} {
+		_, err := compileSpanMetricValue(sampleExpr(funcName, 1), time.Minute)
+		require.Error(t, err, funcName)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/go-clickhouse/ch/chschema"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"github.com/uptrace/uptrace/pkg/bunapp"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"golang.org/x/exp/slices"
+)
+
+// ValidateAllAgainstDB creates the views of all enabled span metrics in a scratch database
+// and drops the database afterwards, so CI can catch errors that depend on the ClickHouse
+// version and schema without touching the production views. The scratch tables copy the
+// columns of spans_index and measure_minutes with the Null engine, so they store nothing.
+func ValidateAllAgainstDB(ctx context.Context, app *bunapp.App) error {
+	scratch := app.CH.Config().Database + "_validate_" +
+		strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	return validateSpanMetrics(
+		ctx, app.Zap(ctx), app.CH, scratch, currentSpanMetrics(app),
+		func(metric *bunconf.SpanMetric) (*bunconf.SpanMetric, *spanMetricExprs, error) {
+			return prepareSpanMetric(ctx, app, metric)
+		},
+	)
+}
+
+type spanMetricPrepareFunc func(
+	metric *bunconf.SpanMetric,
+) (*bunconf.SpanMetric, *spanMetricExprs, error)
+
+func validateSpanMetrics(
+	ctx context.Context,
+	log otelzap.LoggerWithCtx,
+	db chExecer,
+	scratch string,
+	metrics []bunconf.SpanMetric,
+	prepare spanMetricPrepareFunc,
+) (err error) {
+	tables := []string{"spans_index", "measure_minutes"}
+	for i := range metrics {
+		if table := metrics[i].SourceTable; table != "" && !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+
+	scratchIdent := string(chschema.AppendIdent(nil, scratch))
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE "+scratchIdent); err != nil {
+		return fmt.Errorf("can't create scratch database %q: %w", scratch, err)
+	}
+	defer func() {
+		if _, dropErr := db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+scratchIdent); dropErr != nil {
+			err = errors.Join(err, fmt.Errorf("can't drop scratch database %q: %w", scratch, dropErr))
+		}
+	}()
+
+	for _, table := range tables {
+		ident := string(chschema.AppendIdent(nil, table))
+		if _, err := db.ExecContext(ctx, "CREATE TABLE "+scratchIdent+"."+ident+
+			" AS ?DB."+ident+" ENGINE = Null"); err != nil {
+			return fmt.Errorf("can't copy table %q: %w", table, err)
+		}
+	}
+
+	scratchDB := scratchExecer{db: db, database: scratchIdent}
+
+	var errs []error
+	for i := range metrics {
+		if !metrics[i].IsEnabled() {
+			continue
+		}
+
+		metric, exprs, err := prepare(&metrics[i])
+		if err == nil {
+			exprs.comment, err = spanMetricViewComment(metric)
+		}
+		if err == nil {
+			// Views are created locally even when the production views are ON CLUSTER.
+			viewName := "metrics_validate_" + strconv.Itoa(i) + "_mv"
+			_, err = execSpanMetricViewWithFallbacks(
+				ctx, log, scratchDB, metric, viewName, "", exprs, false)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("span metric %q: %w", metrics[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// scratchExecer runs the queries of span metric views in the scratch database.
+type scratchExecer struct {
+	db       chExecer
+	database string
+}
+
+var _ chExecer = scratchExecer{}
+
+func (db scratchExecer) ExecContext(
+	ctx context.Context, query string, args ...any,
+) (sql.Result, error) {
+	fmter := chschema.NewFormatter().WithNamedArg("DB", ch.Safe(db.database))
+	return db.db.ExecContext(ctx, fmter.FormatQuery(query, args...))
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/go-clickhouse/ch"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"github.com/uptrace/uptrace/pkg/bunconf"
+	"go.uber.org/zap"
+)
+
+func TestValidateSpanMetrics(t *testing.T) {
+	ctx := context.Background()
+	log := otelzap.New(zap.NewNop()).Ctx(ctx)
+
+	disabled := false
+	metrics := []bunconf.SpanMetric{
+		{Name: "requests", Instrument: "counter", Value: "count()", SourceTable: "spans_sampled"},
+		{Name: "disabled", Instrument: "counter", Value: "count()", Enabled: &disabled},
+		{Name: "broken", Instrument: "counter", Value: "count()"},
+		{Name: "invalid", Instrument: "counter", Value: "sum("},
+	}
+	prepare := func(metric *bunconf.SpanMetric) (*bunconf.SpanMetric, *spanMetricExprs, error) {
+		exprs, err := compileSpanMetric(metric)
+		if err != nil {
+			return nil, nil, err
+		}
+		return metric, exprs, nil
+	}
+
+	db := &recordingExecer{
+		errs: map[string]error{
+			`CREATE MATERIALIZED VIEW "uptrace_validate"."metrics_validate_2_mv"`: &ch.Error{Code: 47},
+		},
+	}
+	err := validateSpanMetrics(ctx, log, db, "uptrace_validate", metrics, prepare)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `span metric "broken": `)
+	require.Contains(t, err.Error(), `span metric "invalid": `)
+	require.NotContains(t, err.Error(), `"requests"`)
+	require.NotContains(t, err.Error(), `"disabled"`)
+
+	require.Equal(t, []string{
+		`CREATE DATABASE "uptrace_validate"`,
+		`CREATE TABLE "uptrace_validate"."spans_index" AS ?DB."spans_index" ENGINE = Null`,
+		`CREATE TABLE "uptrace_validate"."measure_minutes" AS ?DB."measure_minutes" ENGINE = Null`,
+		`CREATE TABLE "uptrace_validate"."spans_sampled" AS ?DB."spans_sampled" ENGINE = Null`,
+	}, db.queries[:4])
+	require.Equal(t, `DROP DATABASE IF EXISTS "uptrace_validate"`, db.queries[len(db.queries)-1])
+
+	var views []string
+	for _, query := range db.queries {
+		if strings.HasPrefix(query, "CREATE MATERIALIZED VIEW") {
+			views = append(views, query)
+			// Every view is created in the scratch database and reads the scratch tables.
+			require.True(t, strings.HasPrefix(query,
+				`CREATE MATERIALIZED VIEW "uptrace_validate"."metrics_validate_`), query)
+			require.Contains(t, query, `TO "uptrace_validate".measure_minutes`)
+			require.NotContains(t, query, "?DB")
+			require.NotContains(t, query, "ON CLUSTER")
+		}
+	}
+	require.Len(t, views, 2)
+	require.Contains(t, views[0], `"uptrace_validate"."metrics_validate_0_mv"`)
+	require.Contains(t, views[0], `FROM "uptrace_validate"."spans_sampled" AS s`)
+	require.Contains(t, views[0], " COMMENT '")
+
+	db = &recordingExecer{
+		errs: map[string]error{"CREATE DATABASE": &ch.Error{Code: 82}},
+	}
+	err = validateSpanMetrics(ctx, log, db, "uptrace_validate", metrics, prepare)
+	require.ErrorContains(t, err, `can't create scratch database "uptrace_validate"`)
+	require.Len(t, db.queries, 1)
+}
@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_requests_mv";
+
+CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv" TO ?DB.measure_minutes AS SELECT s.project_id, 'uptrace.tracing.requests' AS metric, toStartOfMinute(s.time) AS time, 'counter' AS instrument, sum(s.count) AS sum FROM ?DB.spans_index AS s GROUP BY s.project_id, toStartOfMinute(s.time);
@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_requests_mv";
+
+CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_requests_mv" TO ?DB.measure_minutes AS SELECT s.project_id, 'uptrace.tracing.requests' AS metric, toStartOfMinute(s.time) AS time, 'counter' AS instrument, xxHash64(arrayStringConcat([toString(s.attr_values[indexOf(s.attr_keys, 'http.response.status_code')]), toString(s."host_name")], '-')) AS attrs_hash, ['status', 'host.name'] AS string_keys, [toString(s.attr_values[indexOf(s.attr_keys, 'http.response.status_code')]), toString(s."host_name")] AS string_values, toJSONString(map('endpoint', coalesce(toString(any(s.attr_values[indexOf(s.attr_keys, 'http.route')])), ''))) AS annotations, sum(s.count) AS sum FROM ?DB.spans_index AS s WHERE ((s.parent_id = 0) = true) GROUP BY s.project_id, toStartOfMinute(s.time), toString(s.attr_values[indexOf(s.attr_keys, 'http.response.status_code')]), toString(s."host_name");
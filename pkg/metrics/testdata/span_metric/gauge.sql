@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_gauge_mv";
+
+CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_gauge_mv" TO ?DB.measure_minutes AS SELECT s.project_id, 'uptrace.tracing.gauge' AS metric, toStartOfMinute(s.time) AS time, 'gauge' AS instrument, max(toFloat64OrDefault(s."duration")) AS gauge FROM ?DB.spans_index AS s GROUP BY s.project_id, toStartOfMinute(s.time);
@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_gauge_mv";
+
+CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_gauge_mv" TO ?DB.measure_minutes AS SELECT s.project_id, 'uptrace.tracing.gauge' AS metric, toStartOfMinute(s.time) AS time, 'gauge' AS instrument, xxHash64(arrayStringConcat([toString(s."system"), toString(s."service_name")], '-')) AS attrs_hash, ['.system', 'service.name'] AS string_keys, [toString(s."system"), toString(s."service_name")] AS string_values, toJSONString(map('display.name', coalesce(toString(any(s."display_name")), ''))) AS annotations, max(toFloat64OrDefault(s."duration")) AS gauge FROM ?DB.spans_index AS s WHERE (s."kind" = 'server') GROUP BY s.project_id, toStartOfMinute(s.time), toString(s."system"), toString(s."service_name");
@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS ?DB."metrics_uptrace_tracing_spans_mv";
+
+CREATE MATERIALIZED VIEW ?DB."metrics_uptrace_tracing_spans_mv" TO ?DB.measure_minutes AS SELECT s.project_id, 'uptrace.tracing.spans' AS metric, toStartOfMinute(s.time) AS time, 'histogram' AS instrument, xxHash64(arrayStringConcat([toString(s."system"), toString(s."group_id"), toString(s."service_name"), toString(s."status_code")], '-')) AS attrs_hash, ['.system', '.group_id', 'service.name', '.status_code'] AS string_keys, [toString(s."system"), toString(s."group_id"), toString(s."service_name"), toString(s."status_code")] AS string_values, toJSONString(map('display.name', coalesce(toString(any(s."display_name")), ''), 'p50', coalesce(toString(quantileTDigest(0.5)(toFloat64OrDefault(s."duration"))), ''))) AS annotations, toUInt64(count()) AS count, sum(s."duration" / 1000) AS sum, quantilesBFloat16State(0.5)(toFloat32(s."duration" / 1000)) AS histogram FROM ?DB.spans_index AS s WHERE (s."duration" > 10000000) AND (s."duration" > 0) GROUP BY s.project_id, toStartOfMinute(s.time), toString(s."system"), toString(s."group_id"), toString(s."service_name"), toString(s."status_code");
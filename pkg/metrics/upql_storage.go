@@ -16,6 +16,7 @@ import (
 	"github.com/uptrace/uptrace/pkg/metrics/mql/ast"
 	"github.com/uptrace/uptrace/pkg/org"
 	"github.com/uptrace/uptrace/pkg/unsafeconv"
+	"golang.org/x/exp/slices"
 )
 
 type CHStorageConfig struct {
@@ -158,6 +159,12 @@ func (s *CHStorage) subquery(
 		q = q.Where(where)
 	}
 
+	if len(metric.BucketBounds) > 0 && !usesBucketLe(f) {
+		// Fixed-bucket histograms store a row for every bound,
+		// and only the +Inf row counts all values.
+		q = q.Where("? = '+Inf'", CHColumn(spanMetricLe))
+	}
+
 	if len(f.Grouping) > 0 {
 		for _, attrKey := range f.Grouping {
 			col := CHColumn(attrKey)
@@ -224,6 +231,27 @@ func (s *CHStorage) subquery(
 	return q, nil
 }
 
+// usesBucketLe reports whether the filter selects the buckets of a fixed-bucket histogram
+// with the le attr.
+func usesBucketLe(f *mql.TimeseriesFilter) bool {
+	if f.GroupByAll || slices.Contains(f.Grouping, spanMetricLe) {
+		return true
+	}
+	for _, filter := range f.Filters {
+		if filter.LHS == spanMetricLe {
+			return true
+		}
+	}
+	for _, filters := range f.Where {
+		for _, filter := range filters {
+			if filter.LHS == spanMetricLe {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func compileFilters(filters []ast.Filter) (string, error) {
 	var b []byte
 	for i := range filters {
@@ -400,19 +428,46 @@ func (s *CHStorage) agg(
 			q = q.ColumnExpr("max(max) AS value")
 			return q, nil
 		case mql.AggP50:
-			q = quantileColumn(q, 0.5)
+			q = quantileColumn(q, metric, 0.5)
 			return q, nil
 		case mql.AggP75:
-			q = quantileColumn(q, 0.75)
+			q = quantileColumn(q, metric, 0.75)
 			return q, nil
 		case mql.AggP90:
-			q = quantileColumn(q, 0.9)
+			q = quantileColumn(q, metric, 0.9)
 			return q, nil
 		case mql.AggP95:
-			q = quantileColumn(q, 0.95)
+			q = quantileColumn(q, metric, 0.95)
 			return q, nil
 		case mql.AggP99:
-			q = quantileColumn(q, 0.99)
+			q = quantileColumn(q, metric, 0.99)
+			return q, nil
+		case mql.AggCount:
+			q = q.ColumnExpr("sumWithOverflow(count) AS value")
+			return q, nil
+		default:
+			return nil, unsupportedInstrumentFunc(metric.Instrument, f.AggFunc)
+		}
+
+	case InstrumentRatio, InstrumentWeightedAvg:
+		switch f.AggFunc {
+		case "", mql.AggAvg:
+			q = q.ColumnExpr("sumWithOverflow(sum) / sumWithOverflow(count) AS value")
+			return q, nil
+		case mql.AggSum:
+			q = q.ColumnExpr("sumWithOverflow(sum) AS value")
+			return q, nil
+		case mql.AggCount:
+			q = q.ColumnExpr("sumWithOverflow(count) AS value")
+			return q, nil
+		default:
+			return nil, unsupportedInstrumentFunc(metric.Instrument, f.AggFunc)
+		}
+
+	case InstrumentApdex:
+		switch f.AggFunc {
+		case "", mql.AggAvg:
+			q = q.ColumnExpr("sumWithOverflow(sum) / (2 * sumWithOverflow(count)) AS value")
 			return q, nil
 		case mql.AggCount:
 			q = q.ColumnExpr("sumWithOverflow(count) AS value")
@@ -487,7 +542,10 @@ func (s *CHStorage) newTimeseries(
 	return timeseries, nil
 }
 
-func quantileColumn(q *ch.SelectQuery, quantile float64) *ch.SelectQuery {
+func quantileColumn(q *ch.SelectQuery, metric *Metric, quantile float64) *ch.SelectQuery {
+	if metric.QuantileAlgorithm == QuantileTDigest {
+		return q.ColumnExpr("quantileTDigestMerge(?)(tdigest) AS value", quantile)
+	}
 	return q.ColumnExpr("quantileBFloat16Merge(?)(histogram) AS value", quantile)
 }
 
@@ -566,6 +624,8 @@ func tableValue(
 	switch instrument {
 	case InstrumentCounter:
 		return sumTableValue(value)
+	case InstrumentRatio, InstrumentWeightedAvg, InstrumentApdex:
+		return avgTableValue(value)
 	default:
 		return lastTableValue(value)
 	}
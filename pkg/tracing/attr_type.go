@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"github.com/uptrace/uptrace/pkg/attrkey"
+)
+
+// AttrType is the type of the values of an attr.
+type AttrType string
+
+const (
+	AttrTypeString AttrType = "string"
+	AttrTypeNumber AttrType = "number"
+	AttrTypeBool   AttrType = "bool"
+)
+
+func (t AttrType) IsNum() bool {
+	return t == AttrTypeNumber
+}
+
+// AttrCatalog knows the types of the attrs received by a project.
+// Span attrs are stored as strings, so the types come from the catalog.
+type AttrCatalog interface {
+	AttrType(projectID uint32, key string) (AttrType, bool)
+}
+
+// AttrTypeMap is an AttrCatalog with the attr types of every project.
+type AttrTypeMap map[uint32]map[string]AttrType
+
+var _ AttrCatalog = AttrTypeMap(nil)
+
+func (m AttrTypeMap) AttrType(projectID uint32, key string) (AttrType, bool) {
+	typ, ok := m[projectID][key]
+	return typ, ok
+}
+
+var columnAttrTypes = map[string]AttrType{
+	attrkey.SpanSystem:        AttrTypeString,
+	attrkey.SpanName:          AttrTypeString,
+	attrkey.SpanEventName:     AttrTypeString,
+	attrkey.SpanKind:          AttrTypeString,
+	attrkey.SpanStatusCode:    AttrTypeString,
+	attrkey.SpanStatusMessage: AttrTypeString,
+	attrkey.SpanStatusClass:   AttrTypeString,
+
+	attrkey.SpanIsRoot:  AttrTypeBool,
+	attrkey.SpanIsEvent: AttrTypeBool,
+
+	attrkey.TraceSampled:           AttrTypeBool,
+	attrkey.SpanHasErrorDescendant: AttrTypeBool,
+
+	attrkey.SpanDuration:        AttrTypeNumber,
+	attrkey.SpanSelfDuration:    AttrTypeNumber,
+	attrkey.SpanTraceOffset:     AttrTypeNumber,
+	attrkey.SpanCount:           AttrTypeNumber,
+	attrkey.SpanCountPerMin:     AttrTypeNumber,
+	attrkey.SpanErrorCount:      AttrTypeNumber,
+	attrkey.SpanErrorPct:        AttrTypeNumber,
+	attrkey.SpanErrorRate:       AttrTypeNumber,
+	attrkey.SpanLinkCount:       AttrTypeNumber,
+	attrkey.SpanEventCount:      AttrTypeNumber,
+	attrkey.SpanEventErrorCount: AttrTypeNumber,
+	attrkey.SpanEventLogCount:   AttrTypeNumber,
+}
+
+// LookupAttrType returns the type of the attr in the project. Span columns and
+// indexed attrs have fixed types; other attrs are looked up in the catalog,
+// which may be nil. It returns false when the type is unknown.
+func LookupAttrType(catalog AttrCatalog, projectID uint32, key string) (AttrType, bool) {
+	if resourceKey, ok := ResourceAttrKey(key); ok {
+		key = resourceKey
+	}
+	if typ, ok := columnAttrTypes[key]; ok {
+		return typ, true
+	}
+	if IsIndexedAttr(key) {
+		return AttrTypeString, true
+	}
+	if catalog == nil {
+		return "", false
+	}
+	return catalog.AttrType(projectID, key)
+}
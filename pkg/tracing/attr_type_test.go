@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/uptrace/pkg/attrkey"
+)
+
+func TestLookupAttrType(t *testing.T) {
+	type Test struct {
+		catalog   AttrCatalog
+		projectID uint32
+		key       string
+		typ       AttrType
+		ok        bool
+	}
+
+	catalog := AttrTypeMap{
+		1: {
+			"http.status_code":  AttrTypeNumber,
+			"http.method":       AttrTypeString,
+			"messaging.dropped": AttrTypeBool,
+		},
+		2: {
+			"http.status_code": AttrTypeString,
+		},
+	}
+
+	tests := []Test{
+		{catalog, 1, "http.status_code", AttrTypeNumber, true},
+		{catalog, 1, "resource.http.status_code", AttrTypeNumber, true},
+		{catalog, 1, "http.method", AttrTypeString, true},
+		{catalog, 1, "messaging.dropped", AttrTypeBool, true},
+		{catalog, 1, "foo.bar", "", false},
+		{catalog, 2, "http.status_code", AttrTypeString, true},
+		{catalog, 3, "http.status_code", "", false},
+		{catalog, 1, attrkey.SpanDuration, AttrTypeNumber, true},
+		{catalog, 1, attrkey.SpanIsRoot, AttrTypeBool, true},
+		{catalog, 1, attrkey.ServiceName, AttrTypeString, true},
+		{nil, 1, attrkey.SpanCount, AttrTypeNumber, true},
+		{nil, 1, "http.status_code", "", false},
+	}
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			typ, ok := LookupAttrType(test.catalog, test.projectID, test.key)
+			require.Equal(t, test.ok, ok)
+			require.Equal(t, test.typ, typ)
+			require.Equal(t, test.typ == AttrTypeNumber, typ.IsNum())
+		})
+	}
+}
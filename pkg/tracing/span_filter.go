@@ -86,13 +86,19 @@ func isNumColumn(v any) bool {
 	}
 }
 
+// AttrUnit returns the unit of the values stored for the attr key, for example,
+// nanoseconds for span durations, or an empty string when the unit is unknown.
+func AttrUnit(attrKey string) string {
+	return unitFromName(tql.Name{AttrKey: attrKey})
+}
+
 func unitFromName(name tql.Name) string {
 	var unit string
 
 	switch name.AttrKey {
 	case attrkey.SpanErrorPct, attrkey.SpanErrorRate:
 		unit = bununit.Utilization
-	case attrkey.SpanDuration:
+	case attrkey.SpanDuration, attrkey.SpanSelfDuration, attrkey.SpanTraceOffset:
 		unit = bununit.Nanoseconds
 	}
 
@@ -286,6 +292,13 @@ func AppendCHColumn(b []byte, name tql.Name, dur time.Duration) []byte {
 	case attrkey.SpanIsEvent:
 		return chschema.AppendQuery(
 			b, "s.type IN ?", ch.In(EventTypes))
+	case attrkey.SpanIsRoot:
+		return append(b, "(s.parent_id = 0)"...)
+	case attrkey.TraceSampled:
+		return appendTraceSampled(b)
+	case attrkey.SpanStatusClass:
+		return append(b, "(CASE s.status_code WHEN 'ok' THEN 'ok' "+
+			"WHEN 'error' THEN 'error' ELSE 'unset' END)"...)
 	default:
 		if name.FuncName != "" {
 			b = append(b, name.FuncName...)
@@ -311,6 +324,15 @@ func AppendCHColumn(b []byte, name tql.Name, dur time.Duration) []byte {
 	}
 }
 
+// ResourceAttrPrefix scopes an attr to the resource that produced the span, for example,
+// resource.process.cpu.utilization. Resource attrs are stored together with span attrs.
+const ResourceAttrPrefix = "resource."
+
+// ResourceAttrKey returns the stored key of a resource-scoped attr.
+func ResourceAttrKey(key string) (string, bool) {
+	return strings.CutPrefix(key, ResourceAttrPrefix)
+}
+
 func CHAttrExpr(key string) ch.Safe {
 	return ch.Safe(AppendCHAttrExpr(nil, key))
 }
@@ -401,6 +423,56 @@ func AppendFilter(filter tql.Filter, dur time.Duration) []byte {
 		b = chschema.AppendQuery(b, "?", ch.Array(values))
 		b = append(b, ")"...)
 
+		return b
+	case tql.FilterLike, tql.FilterNotLike:
+		b = AppendCHColumn(b, filter.LHS, dur)
+		if filter.Op == tql.FilterNotLike {
+			b = append(b, " NOT LIKE "...)
+		} else {
+			b = append(b, " LIKE "...)
+		}
+		return appendPatternString(b, filter.RHS.String())
+	case tql.FilterRegexp, tql.FilterNotRegexp:
+		if filter.Op == tql.FilterNotRegexp {
+			b = append(b, "NOT "...)
+		}
+		b = append(b, "match("...)
+		b = AppendCHColumn(b, filter.LHS, dur)
+		b = append(b, ", "...)
+		b = appendPatternString(b, filter.RHS.String())
+		b = append(b, ")"...)
+		return b
+	case tql.FilterBetween, tql.FilterNotBetween:
+		rng, ok := filter.RHS.(tql.ValueRange)
+		if !ok {
+			panic(fmt.Errorf("unsupported BETWEEN filter value type: %T", filter.RHS))
+		}
+
+		var convToNum bool
+		if _, ok := rng.Min.(*tql.Number); ok {
+			convToNum = !filter.LHS.IsNum()
+		}
+
+		b = appendFilterColumn(b, filter.LHS, dur, convToNum)
+		if filter.Op == tql.FilterNotBetween {
+			b = append(b, " NOT BETWEEN "...)
+		} else {
+			b = append(b, " BETWEEN "...)
+		}
+		b = appendFilterValue(b, rng.Min, convToNum)
+		b = append(b, " AND "...)
+		b = appendFilterValue(b, rng.Max, convToNum)
+		return b
+	}
+
+	if ref, ok := filter.RHS.(AttrRef); ok {
+		// Compare numerically when either side is a number.
+		lhsNum, rhsNum := filter.LHS.IsNum(), ref.Name.IsNum()
+		b = appendFilterColumn(b, filter.LHS, dur, rhsNum && !lhsNum)
+		b = append(b, ' ')
+		b = append(b, filter.Op...)
+		b = append(b, ' ')
+		b = appendFilterColumn(b, ref.Name, dur, lhsNum && !rhsNum)
 		return b
 	}
 
@@ -409,19 +481,82 @@ func AppendFilter(filter tql.Filter, dur time.Duration) []byte {
 		convToNum = !filter.LHS.IsNum()
 	}
 
+	b = appendFilterColumn(b, filter.LHS, dur, convToNum)
+
+	b = append(b, ' ')
+	b = append(b, filter.Op...)
+	b = append(b, ' ')
+
+	if value, ok := filter.RHS.(tql.StringValue); ok && isBoolAttr(filter.LHS) {
+		switch strings.ToLower(value.Text) {
+		case "true", "false":
+			return append(b, strings.ToLower(value.Text)...)
+		}
+	}
+
+	b = appendFilterValue(b, filter.RHS, convToNum)
+
+	return b
+}
+
+// appendPatternString appends a LIKE pattern or a regexp as a string literal.
+// ClickHouse unescapes backslashes in literals, so they are escaped to reach the pattern.
+func appendPatternString(b []byte, s string) []byte {
+	return chschema.AppendString(b, strings.ReplaceAll(s, `\`, `\\`))
+}
+
+func isBoolAttr(name tql.Name) bool {
+	if name.FuncName != "" {
+		return false
+	}
+	switch name.AttrKey {
+	case attrkey.SpanIsRoot, attrkey.SpanIsEvent, attrkey.TraceSampled,
+		attrkey.SpanHasErrorDescendant:
+		return true
+	default:
+		return false
+	}
+}
+
+// appendTraceSampled appends whether the trace was sampled. OTLP spans don't carry
+// the sampled trace flag, so it comes from the sampling.priority attr: a priority of 0
+// drops the trace, and spans without the attr were sampled because SDKs only export
+// sampled spans.
+func appendTraceSampled(b []byte) []byte {
+	return chschema.AppendQuery(b,
+		"(NOT has(s.attr_keys, ?) OR toFloat64OrZero(?) > 0)",
+		attrkey.SamplingPriority, CHAttrExpr(attrkey.SamplingPriority))
+}
+
+func appendFilterColumn(b []byte, name tql.Name, dur time.Duration, convToNum bool) []byte {
 	if convToNum {
 		b = append(b, "toFloat64OrDefault("...)
 	}
-	b = AppendCHColumn(b, filter.LHS, dur)
+	b = AppendCHColumn(b, name, dur)
 	if convToNum {
 		b = append(b, ')')
 	}
+	return b
+}
 
-	b = append(b, ' ')
-	b = append(b, filter.Op...)
-	b = append(b, ' ')
+// AttrRef is a filter value that references another span attribute.
+type AttrRef struct {
+	Name tql.Name
+}
+
+func (r AttrRef) String() string {
+	return r.Name.String()
+}
 
-	switch value := filter.RHS.(type) {
+// RawValue is a filter value that is appended to the query as is.
+type RawValue string
+
+func (v RawValue) String() string {
+	return string(v)
+}
+
+func appendFilterValue(b []byte, value tql.Value, convToNum bool) []byte {
+	switch value := value.(type) {
 	case *tql.Number:
 		if convToNum {
 			b = append(b, "toFloat64OrDefault("...)
@@ -447,10 +582,11 @@ func AppendFilter(filter tql.Filter, dur time.Duration) []byte {
 		if convToNum {
 			b = append(b, ')')
 		}
+	case RawValue:
+		b = append(b, value...)
 	default:
 		b = chschema.AppendString(b, value.String())
 	}
-
 	return b
 }
 
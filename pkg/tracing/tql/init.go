@@ -12,8 +12,9 @@ func ParsePart(s string) (any, error) {
 	}
 
 	p := &queryParser{
-		lexer: newLexer(s),
+		lexer: acquireLexer(s),
 	}
+	defer releaseLexer(p.lexer)
 
 	expr, err := p.parseQuery()
 	if err == errBacktrack {
@@ -3,7 +3,10 @@ package tql
 import (
 	"errors"
 	"strconv"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/uptrace/uptrace/pkg/bunlex"
 )
@@ -52,12 +55,58 @@ type lexer struct {
 
 func newLexer(s string) *lexer {
 	lex := &lexer{
-		tokens: make([]Token, 0, 32),
+		tokens: make([]Token, 0, tokensCapHint(s)),
 	}
 	lex.Reset(s)
 	return lex
 }
 
+// tokensCapHint estimates the number of tokens in s, so long queries don't
+// reallocate the tokens slice several times.
+func tokensCapHint(s string) int {
+	const minCap = 32
+	if n := len(s) / 4; n > minCap {
+		return n
+	}
+	return minCap
+}
+
+// reserveTokens grows the tokens slice to fit the tokens of s.
+func (l *lexer) reserveTokens(s string) {
+	if n := tokensCapHint(s); cap(l.tokens) < n {
+		l.tokens = make([]Token, 0, n)
+	}
+}
+
+// maxPooledTokens prevents lexers that parsed very long queries from staying in the pool.
+const maxPooledTokens = 1024
+
+var lexerPool = sync.Pool{
+	New: func() any {
+		return &lexer{
+			tokens: make([]Token, 0, 32),
+		}
+	},
+}
+
+// acquireLexer returns a lexer from the pool reset to s.
+// The lexer must not be used by other goroutines and must be released with releaseLexer.
+func acquireLexer(s string) *lexer {
+	lex := lexerPool.Get().(*lexer)
+	lex.reserveTokens(s)
+	lex.Reset(s)
+	return lex
+}
+
+// releaseLexer returns the lexer to the pool. Tokens must not be used after the release.
+func releaseLexer(lex *lexer) {
+	if cap(lex.tokens) > maxPooledTokens {
+		return
+	}
+	lex.Reset("")
+	lexerPool.Put(lex)
+}
+
 func (l *lexer) Reset(s string) error {
 	l.s = s
 	l.lex.Reset(s)
@@ -126,6 +175,13 @@ func (l *lexer) readToken() (*Token, error) {
 	if bunlex.IsDigit(c) {
 		return l.number(), nil
 	}
+	if c >= utf8.RuneSelf {
+		start := l.lex.Pos() - 1
+		if r, _ := utf8.DecodeRuneInString(l.s[start:]); unicode.IsLetter(r) {
+			l.lex.Rewind()
+			return l.ident(start), nil
+		}
+	}
 
 	return l.charToken(BYTE_TOKEN), nil
 }
@@ -138,7 +194,7 @@ func (l *lexer) charToken(id TokenID) *Token {
 func (l *lexer) quotedValue(end byte) (*Token, error) {
 	start := l.lex.Pos() - 1
 
-	s, err := l.lex.ReadUnquoted(end)
+	s, err := l.lex.ReadUnquotedKeepEscapes(end)
 	if err != nil {
 		return nil, err
 	}
@@ -166,11 +222,12 @@ func (l *lexer) number() *Token {
 
 func (l *lexer) ident(start int) *Token {
 	for l.lex.Valid() {
-		c := l.lex.PeekByte()
-		if !isIdent(c) {
+		pos := l.lex.Pos()
+		r, size := utf8.DecodeRuneInString(l.s[pos:])
+		if !isIdent(r) {
 			break
 		}
-		l.lex.Advance()
+		l.lex.SetPos(pos + size)
 	}
 
 	s := l.s[start:l.lex.Pos()]
@@ -201,6 +258,6 @@ func (l *lexer) isWordBoundary(c byte) bool {
 	return false
 }
 
-func isIdent(c byte) bool {
-	return bunlex.IsAlnum(c) || c == '_' || c == '.'
+func isIdent(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
 }
@@ -84,6 +84,20 @@ func (p *queryParser) filter() (Filter, error) {
 		RHS: values,
 	}, nil
 
+	// if-match: name "between" valueRange
+	return Filter{
+		LHS: name,
+		Op:  FilterBetween,
+		RHS: valueRange,
+	}, nil
+
+	// if-match: name "not" "between" valueRange
+	return Filter{
+		LHS: name,
+		Op:  FilterNotBetween,
+		RHS: valueRange,
+	}, nil
+
 	// if-match: name filterOp value
 	return Filter{
 		LHS: name,
@@ -91,6 +105,18 @@ func (p *queryParser) filter() (Filter, error) {
 		RHS: value,
 	}, nil
 
+	// if-match: "not" "exists" '(' key=(IDENT | VALUE) ')'
+	return Filter{
+		LHS: Name{AttrKey: clean(key.Text)},
+		Op:  FilterNotExists,
+	}, nil
+
+	// if-match: "exists" '(' key=(IDENT | VALUE) ')'
+	return Filter{
+		LHS: Name{AttrKey: clean(key.Text)},
+		Op:  FilterExists,
+	}, nil
+
 	// if-match: key=(IDENT | VALUE) "does"? "not" ("exist" | "exists")
 	return Filter{
 		LHS: Name{AttrKey: clean(key.Text)},
@@ -103,6 +129,13 @@ func (p *queryParser) filter() (Filter, error) {
 		Op:  FilterExists,
 	}, nil
 
+	// if-match: "match" '(' key=(IDENT | VALUE) ',' pattern=VALUE ')'
+	return Filter{
+		LHS: Name{AttrKey: clean(key.Text)},
+		Op:  FilterRegexp,
+		RHS: StringValue{Text: pattern.Text},
+	}, nil
+
 	// match: key=IDENT
 	return Filter{
 		LHS: Name{AttrKey: clean(key.Text)},
@@ -154,7 +187,15 @@ func (p *queryParser) value() (Value, error) {
 	return number, nil
 
 	// match: t=(IDENT | VALUE)
-	return StringValue{Text: t.Text}, nil
+	return StringValue{Text: t.Text, Ident: t.ID == IDENT_TOKEN}, nil
+}
+
+func (p *queryParser) valueRange() (ValueRange, error) {
+	// match: value
+	min := value
+
+	// match: "and" value
+	return ValueRange{Min: min, Max: value}, nil
 }
 
 func (p *queryParser) number() (*Number, error) {
@@ -492,6 +492,107 @@ func (p *queryParser) filter() (Filter, error) {
 	r1_i0_group_end:
 	}
 
+	{
+		var name Name
+		var valueRange ValueRange
+		_pos1 := p.Pos()
+		{
+			var _err error
+			name, _err = p.name()
+			if _err != nil && _err != errBacktrack {
+				return Filter{}, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r2_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 7 && (_tok.Text[0] == 'b' || _tok.Text[0] == 'B') && (_tok.Text[1] == 'e' || _tok.Text[1] == 'E') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T') && (_tok.Text[3] == 'w' || _tok.Text[3] == 'W') && (_tok.Text[4] == 'e' || _tok.Text[4] == 'E') && (_tok.Text[5] == 'e' || _tok.Text[5] == 'E') && (_tok.Text[6] == 'n' || _tok.Text[6] == 'N')
+			if !_match {
+				p.ResetPos(_pos1)
+				name = Name{}
+				goto r2_i0_group_end
+			}
+		}
+		{
+			var _err error
+			valueRange, _err = p.valueRange()
+			if _err != nil && _err != errBacktrack {
+				return Filter{}, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+				name = Name{}
+				goto r2_i0_group_end
+			}
+		}
+		return Filter{
+			LHS: name,
+			Op:  FilterBetween,
+			RHS: valueRange,
+		}, nil
+	r2_i0_group_end:
+	}
+
+	{
+		var name Name
+		var valueRange ValueRange
+		_pos1 := p.Pos()
+		{
+			var _err error
+			name, _err = p.name()
+			if _err != nil && _err != errBacktrack {
+				return Filter{}, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r3_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 3 && (_tok.Text[0] == 'n' || _tok.Text[0] == 'N') && (_tok.Text[1] == 'o' || _tok.Text[1] == 'O') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T')
+			if !_match {
+				p.ResetPos(_pos1)
+				name = Name{}
+				goto r3_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 7 && (_tok.Text[0] == 'b' || _tok.Text[0] == 'B') && (_tok.Text[1] == 'e' || _tok.Text[1] == 'E') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T') && (_tok.Text[3] == 'w' || _tok.Text[3] == 'W') && (_tok.Text[4] == 'e' || _tok.Text[4] == 'E') && (_tok.Text[5] == 'e' || _tok.Text[5] == 'E') && (_tok.Text[6] == 'n' || _tok.Text[6] == 'N')
+			if !_match {
+				p.ResetPos(_pos1)
+				name = Name{}
+				goto r3_i0_group_end
+			}
+		}
+		{
+			var _err error
+			valueRange, _err = p.valueRange()
+			if _err != nil && _err != errBacktrack {
+				return Filter{}, _err
+			}
+			_match := _err == nil
+			if !_match {
+				p.ResetPos(_pos1)
+				name = Name{}
+				goto r3_i0_group_end
+			}
+		}
+		return Filter{
+			LHS: name,
+			Op:  FilterNotBetween,
+			RHS: valueRange,
+		}, nil
+	r3_i0_group_end:
+	}
+
 	{
 		var filterOp FilterOp
 		var name Name
@@ -506,7 +607,7 @@ func (p *queryParser) filter() (Filter, error) {
 			_match := _err == nil
 			if !_match {
 				p.ResetPos(_pos1)
-				goto r2_i0_group_end
+				goto r4_i0_group_end
 			}
 		}
 		{
@@ -519,7 +620,7 @@ func (p *queryParser) filter() (Filter, error) {
 			if !_match {
 				p.ResetPos(_pos1)
 				name = Name{}
-				goto r2_i0_group_end
+				goto r4_i0_group_end
 			}
 		}
 		{
@@ -533,7 +634,7 @@ func (p *queryParser) filter() (Filter, error) {
 				p.ResetPos(_pos1)
 				name = Name{}
 				filterOp = ""
-				goto r2_i0_group_end
+				goto r4_i0_group_end
 			}
 		}
 		return Filter{
@@ -541,7 +642,145 @@ func (p *queryParser) filter() (Filter, error) {
 			Op:  filterOp,
 			RHS: value,
 		}, nil
-	r2_i0_group_end:
+	r4_i0_group_end:
+	}
+
+	{
+		var key *Token
+		_pos1 := p.Pos()
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 3 && (_tok.Text[0] == 'n' || _tok.Text[0] == 'N') && (_tok.Text[1] == 'o' || _tok.Text[1] == 'O') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T')
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r5_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 6 && (_tok.Text[0] == 'e' || _tok.Text[0] == 'E') && (_tok.Text[1] == 'x' || _tok.Text[1] == 'X') && (_tok.Text[2] == 'i' || _tok.Text[2] == 'I') && (_tok.Text[3] == 's' || _tok.Text[3] == 'S') && (_tok.Text[4] == 't' || _tok.Text[4] == 'T') && (_tok.Text[5] == 's' || _tok.Text[5] == 'S')
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r5_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == "("
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r5_i0_group_end
+			}
+		}
+		// key=IDENT
+		{
+			_pos5 := p.Pos()
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == IDENT_TOKEN
+				if !_match {
+					p.ResetPos(_pos5)
+					goto r5_i0_i3_alt1
+				}
+				key = _tok
+			}
+			goto r5_i0_i3_has_match
+		}
+
+	r5_i0_i3_alt1:
+		// key=VALUE
+		{
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == VALUE_TOKEN
+				if !_match {
+					p.ResetPos(_pos1)
+					goto r5_i0_group_end
+				}
+				key = _tok
+			}
+		}
+
+	r5_i0_i3_has_match:
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == ")"
+			if !_match {
+				p.ResetPos(_pos1)
+				key = nil
+				goto r5_i0_group_end
+			}
+		}
+		return Filter{
+			LHS: Name{AttrKey: clean(key.Text)},
+			Op:  FilterNotExists,
+		}, nil
+	r5_i0_group_end:
+	}
+
+	{
+		var key *Token
+		_pos1 := p.Pos()
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 6 && (_tok.Text[0] == 'e' || _tok.Text[0] == 'E') && (_tok.Text[1] == 'x' || _tok.Text[1] == 'X') && (_tok.Text[2] == 'i' || _tok.Text[2] == 'I') && (_tok.Text[3] == 's' || _tok.Text[3] == 'S') && (_tok.Text[4] == 't' || _tok.Text[4] == 'T') && (_tok.Text[5] == 's' || _tok.Text[5] == 'S')
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r6_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == "("
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r6_i0_group_end
+			}
+		}
+		// key=IDENT
+		{
+			_pos4 := p.Pos()
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == IDENT_TOKEN
+				if !_match {
+					p.ResetPos(_pos4)
+					goto r6_i0_i2_alt1
+				}
+				key = _tok
+			}
+			goto r6_i0_i2_has_match
+		}
+
+	r6_i0_i2_alt1:
+		// key=VALUE
+		{
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == VALUE_TOKEN
+				if !_match {
+					p.ResetPos(_pos1)
+					goto r6_i0_group_end
+				}
+				key = _tok
+			}
+		}
+
+	r6_i0_i2_has_match:
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == ")"
+			if !_match {
+				p.ResetPos(_pos1)
+				key = nil
+				goto r6_i0_group_end
+			}
+		}
+		return Filter{
+			LHS: Name{AttrKey: clean(key.Text)},
+			Op:  FilterExists,
+		}, nil
+	r6_i0_group_end:
 	}
 
 	{
@@ -554,14 +793,14 @@ func (p *queryParser) filter() (Filter, error) {
 				_match := _tok.ID == IDENT_TOKEN
 				if !_match {
 					p.ResetPos(_pos1)
-					goto r3_i0_i0_alt1
+					goto r7_i0_i0_alt1
 				}
 				key = _tok
 			}
-			goto r3_i0_i0_has_match
+			goto r7_i0_i0_has_match
 		}
 
-	r3_i0_i0_alt1:
+	r7_i0_i0_alt1:
 		// key=VALUE
 		{
 			{
@@ -570,13 +809,13 @@ func (p *queryParser) filter() (Filter, error) {
 				if !_match {
 					p.ResetPos(_pos1)
 					key = nil
-					goto r3_i0_group_end
+					goto r7_i0_group_end
 				}
 				key = _tok
 			}
 		}
 
-	r3_i0_i0_has_match:
+	r7_i0_i0_has_match:
 		{
 			_pos6 := p.Pos()
 			_tok := p.NextToken()
@@ -592,7 +831,7 @@ func (p *queryParser) filter() (Filter, error) {
 			if !_match {
 				p.ResetPos(_pos1)
 				key = nil
-				goto r3_i0_group_end
+				goto r7_i0_group_end
 			}
 		}
 		// "exist"
@@ -603,13 +842,13 @@ func (p *queryParser) filter() (Filter, error) {
 				_match := len(_tok.Text) == 5 && (_tok.Text[0] == 'e' || _tok.Text[0] == 'E') && (_tok.Text[1] == 'x' || _tok.Text[1] == 'X') && (_tok.Text[2] == 'i' || _tok.Text[2] == 'I') && (_tok.Text[3] == 's' || _tok.Text[3] == 'S') && (_tok.Text[4] == 't' || _tok.Text[4] == 'T')
 				if !_match {
 					p.ResetPos(_pos8)
-					goto r3_i0_i3_alt1
+					goto r7_i0_i3_alt1
 				}
 			}
-			goto r3_i0_i3_has_match
+			goto r7_i0_i3_has_match
 		}
 
-	r3_i0_i3_alt1:
+	r7_i0_i3_alt1:
 		// "exists"
 		{
 			{
@@ -618,17 +857,17 @@ func (p *queryParser) filter() (Filter, error) {
 				if !_match {
 					p.ResetPos(_pos1)
 					key = nil
-					goto r3_i0_group_end
+					goto r7_i0_group_end
 				}
 			}
 		}
 
-	r3_i0_i3_has_match:
+	r7_i0_i3_has_match:
 		return Filter{
 			LHS: Name{AttrKey: clean(key.Text)},
 			Op:  FilterNotExists,
 		}, nil
-	r3_i0_group_end:
+	r7_i0_group_end:
 	}
 
 	{
@@ -641,14 +880,14 @@ func (p *queryParser) filter() (Filter, error) {
 				_match := _tok.ID == IDENT_TOKEN
 				if !_match {
 					p.ResetPos(_pos1)
-					goto r4_i0_i0_alt1
+					goto r8_i0_i0_alt1
 				}
 				key = _tok
 			}
-			goto r4_i0_i0_has_match
+			goto r8_i0_i0_has_match
 		}
 
-	r4_i0_i0_alt1:
+	r8_i0_i0_alt1:
 		// key=VALUE
 		{
 			{
@@ -657,13 +896,13 @@ func (p *queryParser) filter() (Filter, error) {
 				if !_match {
 					p.ResetPos(_pos1)
 					key = nil
-					goto r4_i0_group_end
+					goto r8_i0_group_end
 				}
 				key = _tok
 			}
 		}
 
-	r4_i0_i0_has_match:
+	r8_i0_i0_has_match:
 		// "exist"
 		{
 			_pos6 := p.Pos()
@@ -672,13 +911,13 @@ func (p *queryParser) filter() (Filter, error) {
 				_match := len(_tok.Text) == 5 && (_tok.Text[0] == 'e' || _tok.Text[0] == 'E') && (_tok.Text[1] == 'x' || _tok.Text[1] == 'X') && (_tok.Text[2] == 'i' || _tok.Text[2] == 'I') && (_tok.Text[3] == 's' || _tok.Text[3] == 'S') && (_tok.Text[4] == 't' || _tok.Text[4] == 'T')
 				if !_match {
 					p.ResetPos(_pos6)
-					goto r4_i0_i1_alt1
+					goto r8_i0_i1_alt1
 				}
 			}
-			goto r4_i0_i1_has_match
+			goto r8_i0_i1_has_match
 		}
 
-	r4_i0_i1_alt1:
+	r8_i0_i1_alt1:
 		// "exists"
 		{
 			{
@@ -687,17 +926,104 @@ func (p *queryParser) filter() (Filter, error) {
 				if !_match {
 					p.ResetPos(_pos1)
 					key = nil
-					goto r4_i0_group_end
+					goto r8_i0_group_end
 				}
 			}
 		}
 
-	r4_i0_i1_has_match:
+	r8_i0_i1_has_match:
 		return Filter{
 			LHS: Name{AttrKey: clean(key.Text)},
 			Op:  FilterExists,
 		}, nil
-	r4_i0_group_end:
+	r8_i0_group_end:
+	}
+
+	{
+		var key *Token
+		var pattern *Token
+		_pos1 := p.Pos()
+		{
+			_tok := p.NextToken()
+			_match := len(_tok.Text) == 5 && (_tok.Text[0] == 'm' || _tok.Text[0] == 'M') && (_tok.Text[1] == 'a' || _tok.Text[1] == 'A') && (_tok.Text[2] == 't' || _tok.Text[2] == 'T') && (_tok.Text[3] == 'c' || _tok.Text[3] == 'C') && (_tok.Text[4] == 'h' || _tok.Text[4] == 'H')
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r9_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == "("
+			if !_match {
+				p.ResetPos(_pos1)
+				goto r9_i0_group_end
+			}
+		}
+		// key=IDENT
+		{
+			_pos4 := p.Pos()
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == IDENT_TOKEN
+				if !_match {
+					p.ResetPos(_pos4)
+					goto r9_i0_i2_alt1
+				}
+				key = _tok
+			}
+			goto r9_i0_i2_has_match
+		}
+
+	r9_i0_i2_alt1:
+		// key=VALUE
+		{
+			{
+				_tok := p.NextToken()
+				_match := _tok.ID == VALUE_TOKEN
+				if !_match {
+					p.ResetPos(_pos1)
+					goto r9_i0_group_end
+				}
+				key = _tok
+			}
+		}
+
+	r9_i0_i2_has_match:
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == ","
+			if !_match {
+				p.ResetPos(_pos1)
+				key = nil
+				goto r9_i0_group_end
+			}
+		}
+		{
+			_tok := p.NextToken()
+			_match := _tok.ID == VALUE_TOKEN
+			if !_match {
+				p.ResetPos(_pos1)
+				key = nil
+				goto r9_i0_group_end
+			}
+			pattern = _tok
+		}
+		{
+			_tok := p.NextToken()
+			_match := _tok.Text == ")"
+			if !_match {
+				p.ResetPos(_pos1)
+				key = nil
+				pattern = nil
+				goto r9_i0_group_end
+			}
+		}
+		return Filter{
+			LHS: Name{AttrKey: clean(key.Text)},
+			Op:  FilterRegexp,
+			RHS: StringValue{Text: pattern.Text},
+		}, nil
+	r9_i0_group_end:
 	}
 
 	var key *Token
@@ -1075,7 +1401,45 @@ r1_i0_alt1:
 	}
 
 r1_i0_has_match:
-	return StringValue{Text: t.Text}, nil
+	return StringValue{Text: t.Text, Ident: t.ID == IDENT_TOKEN}, nil
+}
+
+func (p *queryParser) valueRange() (ValueRange, error) {
+
+	var value Value
+
+	{
+		var _err error
+		value, _err = p.value()
+		if _err != nil && _err != errBacktrack {
+			return ValueRange{}, _err
+		}
+		_match := _err == nil
+		if !_match {
+			return ValueRange{}, errBacktrack
+		}
+	}
+	min := value
+
+	{
+		_tok := p.NextToken()
+		_match := len(_tok.Text) == 3 && (_tok.Text[0] == 'a' || _tok.Text[0] == 'A') && (_tok.Text[1] == 'n' || _tok.Text[1] == 'N') && (_tok.Text[2] == 'd' || _tok.Text[2] == 'D')
+		if !_match {
+			return ValueRange{}, errBacktrack
+		}
+	}
+	{
+		var _err error
+		value, _err = p.value()
+		if _err != nil && _err != errBacktrack {
+			return ValueRange{}, _err
+		}
+		_match := _err == nil
+		if !_match {
+			return ValueRange{}, errBacktrack
+		}
+	}
+	return ValueRange{Min: min, Max: value}, nil
 }
 
 func (p *queryParser) number() (*Number, error) {
@@ -44,6 +44,7 @@ func (n Name) IsNum() bool {
 		attrkey.SpanParentID,
 		attrkey.SpanGroupID,
 		attrkey.SpanDuration,
+		attrkey.SpanTraceOffset,
 
 		attrkey.SpanLinkCount,
 		attrkey.SpanEventCount,
@@ -150,6 +151,9 @@ const (
 	FilterExists    FilterOp = "exists"
 	FilterNotExists FilterOp = "not exists"
 
+	FilterBetween    FilterOp = "between"
+	FilterNotBetween FilterOp = "not between"
+
 	// For compatibility with metrics.
 	FilterRegexp    FilterOp = "~"
 	FilterNotRegexp FilterOp = "!~"
@@ -161,6 +165,9 @@ type Value interface {
 
 type StringValue struct {
 	Text string
+	// Ident is true when the value is an unquoted identifier, e.g. span.name, and false
+	// for quoted strings.
+	Ident bool
 }
 
 func (v StringValue) String() string {
@@ -175,6 +182,16 @@ func (v StringValues) String() string {
 	return strings.Join(v.Values, "|")
 }
 
+// ValueRange is an inclusive range of values used by the between filter.
+type ValueRange struct {
+	Min Value
+	Max Value
+}
+
+func (v ValueRange) String() string {
+	return v.Min.String() + " and " + v.Max.String()
+}
+
 type NumberKind int
 
 const (
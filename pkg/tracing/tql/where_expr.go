@@ -0,0 +1,143 @@
+package tql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WhereExpr is a boolean expression tree of filters. Leaves have a Filter, and groups
+// join their Exprs with Op. Unlike Where, it keeps parenthesized groups.
+type WhereExpr struct {
+	Op     BoolOp
+	Exprs  []*WhereExpr
+	Filter *Filter
+}
+
+// Walk calls fn for every filter in the tree.
+func (e *WhereExpr) Walk(fn func(filter *Filter) error) error {
+	if e.Filter != nil {
+		return fn(e.Filter)
+	}
+	for _, expr := range e.Exprs {
+		if err := expr.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseWhereExpr parses filters joined with and/or and grouped with parentheses,
+// for example, `a > 1 and (b < 2 or c = 3)`. AND has higher precedence than OR.
+// The leading where keyword is optional.
+func ParseWhereExpr(s string) (*WhereExpr, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("can't parse empty where")
+	}
+
+	p := &queryParser{
+		lexer: acquireLexer(s),
+	}
+	defer releaseLexer(p.lexer)
+
+	if tok := p.PeekToken(); tok.ID == IDENT_TOKEN && strings.EqualFold(tok.Text, "where") {
+		p.NextToken()
+	}
+
+	expr, err := p.whereOr()
+	if err == errBacktrack {
+		return nil, p.errorWithHint(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.PeekToken(); tok.ID != EOF_TOKEN {
+		return nil, p.errorWithHint(s)
+	}
+	return expr, nil
+}
+
+func (p *queryParser) whereOr() (*WhereExpr, error) {
+	return p.whereGroup(BoolOr, "or", p.whereAnd)
+}
+
+func (p *queryParser) whereAnd() (*WhereExpr, error) {
+	return p.whereGroup(BoolAnd, "and", p.wherePrimary)
+}
+
+func (p *queryParser) whereGroup(
+	op BoolOp, keyword string, next func() (*WhereExpr, error),
+) (*WhereExpr, error) {
+	expr, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := []*WhereExpr{expr}
+	for {
+		tok := p.PeekToken()
+		if tok.ID != IDENT_TOKEN || !strings.EqualFold(tok.Text, keyword) {
+			break
+		}
+		p.NextToken()
+
+		expr, err := next()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return &WhereExpr{Op: op, Exprs: exprs}, nil
+}
+
+func (p *queryParser) wherePrimary() (*WhereExpr, error) {
+	tok := p.PeekToken()
+	if tok.ID == BYTE_TOKEN {
+		switch tok.Text {
+		case "(":
+			p.NextToken()
+			p.cut()
+
+			expr, err := p.whereOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if tok := p.NextToken(); tok.ID != BYTE_TOKEN || tok.Text != ")" {
+				return nil, errBacktrack
+			}
+			p.cut()
+			return expr, nil
+		case "{":
+			// {attr1,attr2} = value matches any of the attrs.
+			filters, err := p.filters()
+			if err != nil {
+				return nil, err
+			}
+			p.cut()
+
+			group := &WhereExpr{Op: BoolOr}
+			for i := range filters {
+				filter := filters[i]
+				filter.BoolOp = ""
+				group.Exprs = append(group.Exprs, &WhereExpr{Filter: &filter})
+			}
+			if len(group.Exprs) == 1 {
+				return group.Exprs[0], nil
+			}
+			return group, nil
+		}
+	}
+
+	filter, err := p.filter()
+	if err != nil {
+		return nil, err
+	}
+	p.cut()
+	return &WhereExpr{Filter: &filter}, nil
+}